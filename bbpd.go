@@ -2,9 +2,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_admin"
+	"github.com/smugmug/bbpd/lib/bbpd_conf"
 	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
 	"github.com/smugmug/bbpd/lib/bbpd_route"
+	"github.com/smugmug/bbpd/lib/bbpd_tls"
 	conf "github.com/smugmug/godynamo/conf"
 	conf_file "github.com/smugmug/godynamo/conf_file"
 	conf_iam "github.com/smugmug/godynamo/conf_iam"
@@ -13,34 +18,69 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 )
 
-// handle signals. we prefer 1,3,15 and will panic on 2
+// handle signals. we prefer 3,15, will panic on 2, and reload the tls certificates on 1
 func sigHandle(c <-chan os.Signal) {
 	for sig := range c {
-		if sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGHUP {
-			log.Printf("*** caught signal %v, stop\n", sig)
-			log.Printf("bbpd is in a closed state and is no longer accepting connections")
-			stop_err := bbpd_route.StopBBPD()
-			if stop_err != nil {
-				log.Printf("graceful shutdown not possible:%s", stop_err.Error())
+		if sig == syscall.SIGHUP {
+			bbpd_log.Infof("*** caught signal %v, reload\n", sig)
+			if !bbpd_tls.Enabled() {
+				bbpd_log.Infof("tls is not configured, nothing to reload")
+				continue
 			}
-			log.Printf("bbpd exit\n")
-			os.Exit(0)
+			reload_err := bbpd_tls.Reload()
+			if reload_err != nil {
+				bbpd_log.Errorf("keeping the current certificates:%s", reload_err.Error())
+			}
+		} else if sig == syscall.SIGTERM || sig == syscall.SIGQUIT {
+			bbpd_log.Infof("*** caught signal %v, stop\n", sig)
+			shutdown()
 		} else if sig == syscall.SIGINT {
-			log.Printf("*** caught signal %v, PANIC stop\n", sig)
+			bbpd_log.Infof("*** caught signal %v, PANIC stop\n", sig)
 			panic("bbpd panic")
 			os.Exit(1)
 		} else {
-			log.Printf("**** caught unchecked signal %v\n", sig)
+			bbpd_log.Infof("**** caught unchecked signal %v\n", sig)
 		}
 	}
 }
 
+// shutdown stops bbpd gracefully and exits. it is called on SIGTERM and SIGQUIT, and from
+// the admin endpoints.
+func shutdown() {
+	bbpd_log.Infof("bbpd is in a closed state and is no longer accepting connections")
+	stop_err := bbpd_route.StopBBPD()
+	if stop_err != nil {
+		bbpd_log.Errorf("graceful shutdown not possible:%s", stop_err.Error())
+	}
+	bbpd_log.Infof("bbpd exit\n")
+	os.Exit(0)
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	bbpd_conf_path := flag.String("conf", "",
+		"path to the bbpd conf file (default $HOME/."+bbpd_conf.CONF_FILE_NAME+" or "+bbpd_conf.ETC_CONF_FILE+")")
+	listen_addresses := flag.String("listen", "",
+		"comma-separated host:port addresses to listen on, overriding the conf file")
+	listen_socket := flag.String("socket", "",
+		"path of a unix domain socket to listen on, overriding the conf file")
+	listen_socket_mode := flag.String("socket-mode", "",
+		"octal permissions of the unix domain socket (default 0660)")
+	read_only := flag.Bool("read-only", false,
+		"refuse writes and table changes, overriding the conf file")
+	log_level := flag.String("log-level", "",
+		"one of debug, info, error or off, overriding the conf file")
+	admin_address := flag.String("admin", "",
+		"host:port address of the admin endpoints, overriding the conf file")
+	flag.Parse()
+
+	bbpd_log.Install()
+
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan)
 	go sigHandle(sigchan)
@@ -52,12 +92,12 @@ func main() {
 		panic("the conf.Vals global conf struct has not been initialized, " +
 			"invoke with conf_file.Read()")
 	} else {
-		log.Printf("global conf.Vals initialized")
+		bbpd_log.Infof("global conf.Vals initialized")
 	}
 
 	// launch a background poller to keep conns to aws alive
 	if conf.Vals.Network.DynamoDB.KeepAlive {
-		log.Printf("launching background keepalive")
+		bbpd_log.Infof("launching background keepalive")
 		go keepalive.KeepAlive([]string{conf.Vals.Network.DynamoDB.URL})
 	}
 
@@ -75,24 +115,78 @@ func main() {
 			panic("iam is not ready? auth problem")
 		}
 	} else {
-		log.Printf("not using iam, assume credentials hardcoded in conf file")
+		bbpd_log.Infof("not using iam, assume credentials hardcoded in conf file")
+	}
+
+	// the bbpd conf is optional, but if one is found it must be valid
+	bbpd_conf_err := bbpd_conf.Read(*bbpd_conf_path)
+	if bbpd_conf_err != nil {
+		log.Fatal(bbpd_conf_err.Error())
+	}
+	// flags override the conf file, including when it is reloaded
+	override := func() {
+		bbpd_conf.Vals.ConfLock.Lock()
+		if *listen_addresses != "" {
+			bbpd_conf.Vals.Listen.Addresses = strings.Split(*listen_addresses, ",")
+		}
+		if *listen_socket != "" {
+			bbpd_conf.Vals.Listen.Socket = *listen_socket
+		}
+		if *listen_socket_mode != "" {
+			bbpd_conf.Vals.Listen.SocketMode = *listen_socket_mode
+		}
+		if *read_only {
+			bbpd_conf.Vals.ReadOnly = true
+		}
+		if *log_level != "" {
+			bbpd_conf.Vals.LogLevel = *log_level
+		}
+		if *admin_address != "" {
+			bbpd_conf.Vals.Admin.Address = *admin_address
+		}
+		bbpd_conf.Vals.ConfLock.Unlock()
+	}
+	override()
+	bbpd_route.Configure()
+
+	// the admin endpoints reload the conf file that was read at startup
+	reload := func() error {
+		bbpd_conf.Vals.ConfLock.RLock()
+		path := bbpd_conf.Vals.Path
+		bbpd_conf.Vals.ConfLock.RUnlock()
+		read_err := bbpd_conf.Read(path)
+		if read_err != nil {
+			return read_err
+		}
+		override()
+		bbpd_route.Configure()
+		if bbpd_tls.Enabled() {
+			tls_err := bbpd_tls.Reload()
+			if tls_err != nil {
+				bbpd_log.Errorf("keeping the current certificates:%s", tls_err.Error())
+			}
+		}
+		return nil
 	}
+	bbpd_admin.SetHooks(reload, shutdown)
 
-	log.Printf("starting bbpd...")
+	bbpd_log.Infof("starting bbpd...")
 	pid := syscall.Getpid()
-	e := fmt.Sprintf("induce panic with ctrl-c (kill -2 %v) or graceful termination with kill -[1,3,15] %v", pid, pid)
-	log.Printf(e)
+	e := fmt.Sprintf("induce panic with ctrl-c (kill -2 %v) or graceful termination with kill -[3,15] %v", pid, pid)
+	bbpd_log.Infof(e)
+	e = fmt.Sprintf("reload tls certificates with kill -1 %v", pid)
+	bbpd_log.Infof(e)
 	ports := []int{bbpd_const.PORT, bbpd_const.PORT2}
 	start_bbpd_err := bbpd_route.StartBBPD(ports)
 	if start_bbpd_err == nil {
 		// all ports are in use. exit with 0 so our rc system does not
 		// respawn the program
-		log.Printf("all bbpd ports appear to be in use: exit with code 0")
+		bbpd_log.Infof("all bbpd ports appear to be in use: exit with code 0")
 		os.Exit(0)
 	} else {
 		// abnormal exit - allow the rc system to try to respawn by returning
 		// exit code 1
-		log.Printf("bbpd invocation error")
+		bbpd_log.Errorf("bbpd invocation error")
 		log.Fatal(start_bbpd_err.Error())
 	}
 }
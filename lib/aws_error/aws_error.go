@@ -0,0 +1,82 @@
+// Classification of the error responses returned by DynamoDB, and construction of the
+// error responses bbpd returns in the same form.
+package aws_error
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	PROVISIONED_THROUGHPUT_EXCEEDED = "ProvisionedThroughputExceededException"
+	THROTTLING                      = "ThrottlingException"
+	REQUEST_LIMIT_EXCEEDED          = "RequestLimitExceeded"
+	VALIDATION                      = "ValidationException"
+	ACCESS_DENIED                   = "AccessDeniedException"
+	UNKNOWN_OPERATION               = "UnknownOperationException"
+	INTERNAL_SERVER_ERROR           = "InternalServerError"
+	SERVICE_UNAVAILABLE             = "ServiceUnavailable"
+
+	// the service prefixes of the __type of DynamoDB errors
+	DYNAMODB_PREFIX     = "com.amazonaws.dynamodb.v20120810#"
+	VALIDATE_PREFIX     = "com.amazon.coral.validate#"
+	SERVICE_PREFIX      = "com.amazon.coral.service#"
+	AVAILABILITY_PREFIX = "com.amazon.coral.availability#"
+)
+
+// the body of a DynamoDB error response
+type errorBody struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// Type returns the AWS error type of the error response resp_body, without the service
+// prefix; for example "ProvisionedThroughputExceededException" rather than
+// "com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException".
+// An empty string is returned if resp_body is not a DynamoDB error.
+func Type(resp_body []byte) string {
+	var b errorBody
+	if um_err := json.Unmarshal(resp_body, &b); um_err != nil {
+		return ""
+	}
+	if i := strings.LastIndex(b.Type, "#"); i != -1 {
+		return b.Type[i+1:]
+	}
+	return b.Type
+}
+
+// Throttled returns true if the error response resp_body is due to throttling, in which
+// case the request may succeed if retried later.
+func Throttled(resp_body []byte) bool {
+	switch Type(resp_body) {
+	case PROVISIONED_THROUGHPUT_EXCEEDED, THROTTLING, REQUEST_LIMIT_EXCEEDED:
+		return true
+	}
+	return false
+}
+
+// TypeForStatus returns the __type DynamoDB uses for errors with the HTTP status code,
+// for errors that bbpd reports itself.
+func TypeForStatus(code int) string {
+	switch code {
+	case http.StatusForbidden:
+		return DYNAMODB_PREFIX + ACCESS_DENIED
+	case http.StatusNotFound:
+		return SERVICE_PREFIX + UNKNOWN_OPERATION
+	case http.StatusTooManyRequests:
+		return AVAILABILITY_PREFIX + THROTTLING
+	case http.StatusServiceUnavailable:
+		return DYNAMODB_PREFIX + SERVICE_UNAVAILABLE
+	}
+	if code >= 500 {
+		return DYNAMODB_PREFIX + INTERNAL_SERVER_ERROR
+	}
+	return VALIDATE_PREFIX + VALIDATION
+}
+
+// Body returns a DynamoDB error response body with the __type aws_type and the message.
+func Body(aws_type, message string) []byte {
+	b, _ := json.Marshal(errorBody{Type: aws_type, Message: message})
+	return b
+}
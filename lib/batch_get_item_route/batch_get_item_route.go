@@ -2,20 +2,51 @@
 package batch_get_item_route
 
 import (
-	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_cache"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
 	ep "github.com/smugmug/godynamo/endpoint"
 	bgi "github.com/smugmug/godynamo/endpoints/batch_get_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// batchGet relays the BatchGetItem request in bodybytes, serving what it can from the item cache.
+func batchGet(bodybytes []byte, origin string) ([]byte, int, error) {
+	remaining, pending := bbpd_cache.LookupBatchGetItem(bodybytes)
+	var resp_body []byte
+	code := http.StatusOK
+	// remaining is nil if every key was found in the cache
+	if remaining != nil {
+		if len(remaining) > bgi.QUERY_LIM_BYTES {
+			e := fmt.Sprintf("%s - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted", origin)
+			bbpd_log.Infof(e)
+		}
+
+		var resp_err error
+		resp_body, code, resp_err = raw.BatchGetReq(remaining)
+		if resp_err != nil || ep.HttpErr(code) {
+			return resp_body, code, resp_err
+		}
+	}
+	if pending != nil {
+		merged, merge_err := pending.Merge(resp_body)
+		if merge_err != nil {
+			return nil, 0, merge_err
+		}
+		return merged, code, nil
+	}
+	return resp_body, code, nil
+}
+
 // BatchGetItemHandler accepts arbitrarily-sized BatchGetItem requests and relays them to Dynamo.
 func BatchGetItemHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
@@ -24,49 +55,37 @@ func BatchGetItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "batch_get_item_route.BatchGetItemHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "batch_get_item_route.BatchGetItemHandler:cannot parse path. try /batch-get-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
 	bodybytes, read_err := ioutil.ReadAll(req.Body)
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	req.Body.Close()
 
-	var b bgi.BatchGetItem
-
-	um_err := json.Unmarshal(bodybytes, &b)
-	if um_err != nil {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemHandler unmarshal err on %s to BatchGetItem %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	if bbpd_ratelimit.Limited(w, req, bodybytes, raw.BATCHGETITEM_ENDPOINT) {
 		return
 	}
 
-	if len(bodybytes) > bgi.QUERY_LIM_BYTES {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemHandler - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted")
-		log.Printf(e)
-	}
-
-	resp_body, code, resp_err := b.DoBatchGet()
-
+	resp_body, code, resp_err := batchGet(bodybytes, "batch_get_item_route.BatchGetItemHandler")
 	if resp_err != nil {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -84,10 +103,13 @@ func BatchGetItemHandler(w http.ResponseWriter, req *http.Request) {
 		bgi.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
 
+// BBPD-only endpoint.
+// BatchGetItemJSONHandler accepts BatchGetItem requests whose Keys may be given in basic JSON,
+// and returns the Items of the response in basic JSON.
 func BatchGetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
@@ -95,49 +117,45 @@ func BatchGetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "batch_get_item_route.BatchGetItemJSONHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "batch_get_item_route.BatchGetItemJSONHandler:cannot parse path. try /batch-get-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
 	bodybytes, read_err := ioutil.ReadAll(req.Body)
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	req.Body.Close()
 
-	var b bgi.BatchGetItem
-
-	um_err := json.Unmarshal(bodybytes, &b)
-	if um_err != nil {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler unmarshal err on %s to BatchGetItem %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	if bbpd_ratelimit.Limited(w, req, bodybytes, raw.BATCHGETITEM_ENDPOINT) {
 		return
 	}
 
-	if len(bodybytes) > bgi.QUERY_LIM_BYTES {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted")
-		log.Printf(e)
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
 	}
 
-	resp_body, code, resp_err := b.DoBatchGet()
-
+	resp_body, code, resp_err := batchGet(reqbytes, "batch_get_item_route.BatchGetItemJSONHandler")
 	if resp_err != nil {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -146,30 +164,12 @@ func BatchGetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// translate the Response to a ResponseItemsJSON
-	resp := bgi.NewResponse()
-	um_err = json.Unmarshal([]byte(resp_body), resp)
-	if um_err != nil {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler:err %s",
-			um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
-	}
-	resp_json, rerr := resp.ToResponseItemsJSON()
-	if rerr != nil {
-		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler:err %s",
-			rerr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
-	}
-	json_body, jerr := json.Marshal(resp_json)
+	json_body, jerr := bbpd_json.BatchGetResponseToJSON(resp_body)
 	if jerr != nil {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler:err %s",
 			jerr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -182,6 +182,6 @@ func BatchGetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 		bgi.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("batch_get_item_route.BatchGetItemJSONHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
@@ -4,19 +4,32 @@ package batch_write_item_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_spool"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
 	ep "github.com/smugmug/godynamo/endpoint"
 	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// errCode returns the status code of the response to a request that failed with err.
+func errCode(err error) int {
+	if raw.IsRequestErr(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 // BatchWriteItemHandler accepts arbitrarily-sized BatchWriteItem requests and relays them to Dynamo.
+// If the spool is configured, the request is spooled should Dynamo be unavailable.
 func BatchWriteItemHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
@@ -24,49 +37,52 @@ func BatchWriteItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "batch_write_item_route.BatchWriteItemHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "batch_write_item_route.BatchWriteItemHandler:cannot parse path. try /batch-get-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
 	bodybytes, read_err := ioutil.ReadAll(req.Body)
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	req.Body.Close()
 
+	if bbpd_ratelimit.Limited(w, req, bodybytes, raw.BATCHWRITEITEM_ENDPOINT) {
+		return
+	}
+
 	if len(bodybytes) > bwi.QUERY_LIM_BYTES {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemHandler - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted")
-		log.Printf(e)
+		bbpd_log.Infof(e)
 	}
 
 	b := bwi.NewBatchWriteItem()
-
 	um_err := json.Unmarshal(bodybytes, b)
 	if um_err != nil {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemHandler unmarshal err on %s to BatchWriteItem %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
-	resp_body, code, resp_err := b.DoBatchWrite()
+	resp_body, code, resp_err := bbpd_spool.Req(bodybytes, raw.BATCHWRITEITEM_ENDPOINT)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, errCode(resp_err))
 		return
 	}
 
@@ -84,16 +100,15 @@ func BatchWriteItemHandler(w http.ResponseWriter, req *http.Request) {
 		bwi.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
 
 // BBPD-only endpoint.
-// BatchWriteItemJSONHandler relays the BatchWriteItem request to Dynamo but first
-// validates it through a local type.
-// This variant allows the Items to be encoded as basic JSON. As there is always a conversion that
-// needs to be performed from a PutIemJSON struct to a BatchWriteItem, this endpoint cannot utilize
-// RawPost.
+// BatchWriteItemJSONHandler relays the BatchWriteItem request to Dynamo.
+// This variant allows the Items of PutRequests and the Keys of DeleteRequests to be encoded as
+// basic JSON. As there is always a conversion that needs to be performed, this endpoint cannot
+// utilize RawPost.
 func BatchWriteItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
@@ -101,57 +116,51 @@ func BatchWriteItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "batch_write_item_route.BatchWriteItemJSONHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "batch_write_item_route.BatchWriteItemJSONHandler:cannot parse path. try /batch-get-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
 	bodybytes, read_err := ioutil.ReadAll(req.Body)
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	req.Body.Close()
 
-	if len(bodybytes) > bwi.QUERY_LIM_BYTES {
-		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted")
-		log.Printf(e)
+	if bbpd_ratelimit.Limited(w, req, bodybytes, raw.BATCHWRITEITEM_ENDPOINT) {
+		return
 	}
 
-	b_json := bwi.NewBatchWriteItemJSON()
-
-	um_err := json.Unmarshal(bodybytes, b_json)
-	if um_err != nil {
-		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler unmarshal err on %s to BatchWriteItem %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
+	if len(bodybytes) > bwi.QUERY_LIM_BYTES {
+		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler - payload over 1024kb, may be rejected by aws! splitting into segmented requests will likely mean each segment is accepted")
+		bbpd_log.Infof(e)
 	}
 
-	b, berr := b_json.ToBatchWriteItem()
-	if berr != nil {
-		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler cannot convert BatchWriteItemJSON to BatchWriteItem:%s", berr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	bbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
-	resp_body, code, resp_err := b.DoBatchWrite()
+	resp_body, code, resp_err := bbpd_spool.Req(bbytes, raw.BATCHWRITEITEM_ENDPOINT)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, errCode(resp_err))
 		return
 	}
 
@@ -169,6 +178,6 @@ func BatchWriteItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 		bwi.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("batch_write_item_route.BatchWriteItemJSONHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
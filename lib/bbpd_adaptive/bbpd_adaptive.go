@@ -0,0 +1,299 @@
+// Adaptive limiting of the number of concurrent requests to each table. GoDynamo retries a
+// throttled request with backoff, but the other callers of bbpd keep sending; the limit
+// lets bbpd as a whole back off instead. Each table's limit is cut multiplicatively when
+// DynamoDB throttles a request to it, and grown additively, by about one per limit's worth
+// of successful requests, so that the callers behind one bbpd settle at what the table can
+// serve rather than stampeding it.
+package bbpd_adaptive
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
+	ep "github.com/smugmug/godynamo/endpoint"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MIN_LIMIT = 1
+	DEFAULT_BACKOFF   = 0.5
+	DEFAULT_MAX_WAIT  = time.Second
+	// the error type returned to a request that could not start within the configured wait
+	THROTTLED_TYPE = aws_error.DYNAMODB_PREFIX + aws_error.PROVISIONED_THROUGHPUT_EXCEEDED
+)
+
+// operations whose requests are limited
+var operations = map[string]bool{
+	"GetItem":            true,
+	"BatchGetItem":       true,
+	"Query":              true,
+	"Scan":               true,
+	"TransactGetItems":   true,
+	"PutItem":            true,
+	"UpdateItem":         true,
+	"DeleteItem":         true,
+	"BatchWriteItem":     true,
+	"TransactWriteItems": true,
+}
+
+// State reports the state of one table's limit.
+type State struct {
+	Table     string
+	Limit     float64
+	InFlight  int
+	Throttled uint64
+	Decreases uint64
+	TimedOut  uint64
+}
+
+type limiter struct {
+	limit     float64
+	in_flight int
+	// requests started before this were sent under a larger limit, so their throttling
+	// does not cut the limit again
+	last_decrease time.Time
+	// closed and replaced when a request finishes, to wake waiting requests
+	released  chan struct{}
+	throttled uint64
+	decreases uint64
+	timed_out uint64
+}
+
+var (
+	initial_limit float64
+	min_limit     float64
+	max_limit     float64
+	backoff       float64
+	max_wait      time.Duration
+	limiters      map[string]*limiter
+	adaptive_lock sync.Mutex
+)
+
+func init() {
+	limiters = make(map[string]*limiter)
+}
+
+// Configure sets the bounds of each table's concurrency limit, the limit a table starts
+// with, the factor the limit is multiplied by when a request is throttled, and how long a
+// request may wait to start, by default one second. A max of 0 disables limiting. Existing
+// limits are discarded.
+func Configure(initial, min, max int, backoff_factor float64, wait time.Duration) {
+	if min < 1 {
+		min = DEFAULT_MIN_LIMIT
+	}
+	if max != 0 && max < min {
+		max = min
+	}
+	if initial < min || initial > max {
+		initial = max
+	}
+	if backoff_factor <= 0 || backoff_factor >= 1 {
+		backoff_factor = DEFAULT_BACKOFF
+	}
+	if wait <= 0 {
+		wait = DEFAULT_MAX_WAIT
+	}
+	adaptive_lock.Lock()
+	initial_limit = float64(initial)
+	min_limit = float64(min)
+	max_limit = float64(max)
+	backoff = backoff_factor
+	max_wait = wait
+	limiters = make(map[string]*limiter)
+	adaptive_lock.Unlock()
+}
+
+// Enabled returns true if concurrency is limited.
+func Enabled() bool {
+	adaptive_lock.Lock()
+	defer adaptive_lock.Unlock()
+	return max_limit != 0
+}
+
+// tables returns the tables the request bodybytes reads or writes, in order.
+func tables(bodybytes []byte) []string {
+	var r struct {
+		TableName     string
+		RequestItems  map[string]json.RawMessage
+		TransactItems []map[string]struct {
+			TableName string
+		}
+	}
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	found[r.TableName] = true
+	for table := range r.RequestItems {
+		found[table] = true
+	}
+	for _, item := range r.TransactItems {
+		for _, action := range item {
+			found[action.TableName] = true
+		}
+	}
+	delete(found, "")
+	names := make([]string, 0, len(found))
+	for table := range found {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getLimiter returns the limiter for the table. adaptive_lock must be held.
+func getLimiter(table string) *limiter {
+	l, ok := limiters[table]
+	if !ok {
+		l = &limiter{limit: initial_limit, released: make(chan struct{})}
+		limiters[table] = l
+	}
+	return l
+}
+
+// acquire waits until a request to each of the tables may start, and returns false if that
+// took longer than the configured wait. Tables are acquired in order, so that requests to
+// several tables cannot hold each other up.
+func acquire(names []string) bool {
+	adaptive_lock.Lock()
+	deadline := time.Now().Add(max_wait)
+	adaptive_lock.Unlock()
+	for i, table := range names {
+		if !acquireOne(table, deadline) {
+			release(names[:i])
+			return false
+		}
+	}
+	return true
+}
+
+func acquireOne(table string, deadline time.Time) bool {
+	for {
+		adaptive_lock.Lock()
+		l := getLimiter(table)
+		if l.in_flight < int(math.Max(1, math.Floor(l.limit))) {
+			l.in_flight++
+			adaptive_lock.Unlock()
+			return true
+		}
+		released := l.released
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			l.timed_out++
+			adaptive_lock.Unlock()
+			return false
+		}
+		adaptive_lock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// release ends a request to each of the tables and wakes the requests waiting on them.
+func release(names []string) {
+	adaptive_lock.Lock()
+	for _, table := range names {
+		l := getLimiter(table)
+		// the limits may have been reconfigured while the request was in flight
+		if l.in_flight > 0 {
+			l.in_flight--
+		}
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+	adaptive_lock.Unlock()
+}
+
+// adjust grows or cuts the limit of each of the tables according to the outcome of a
+// request started at start.
+func adjust(names []string, start time.Time, throttled bool) {
+	adaptive_lock.Lock()
+	for _, table := range names {
+		l := getLimiter(table)
+		if throttled {
+			l.throttled++
+			if start.After(l.last_decrease) {
+				l.limit = math.Max(min_limit, l.limit*backoff)
+				l.last_decrease = time.Now()
+				l.decreases++
+			}
+		} else {
+			l.limit = math.Min(max_limit, l.limit+1/l.limit)
+		}
+	}
+	adaptive_lock.Unlock()
+}
+
+// unprocessed returns true if resp_body is a batch response that left requests unprocessed,
+// which is how DynamoDB throttles part of a batch.
+func unprocessed(resp_body []byte) bool {
+	var r struct {
+		UnprocessedKeys  map[string]json.RawMessage
+		UnprocessedItems map[string]json.RawMessage
+	}
+	if um_err := json.Unmarshal(resp_body, &r); um_err != nil {
+		return false
+	}
+	return len(r.UnprocessedKeys) != 0 || len(r.UnprocessedItems) != 0
+}
+
+// Do makes the request bodybytes to amzTarget with fn once the tables it uses are below
+// their limits. If it cannot start within the configured wait, it is not made, and a
+// ProvisionedThroughputExceededException is returned as DynamoDB would, so that callers
+// and bbpd's own retrying components treat it as throttled.
+func Do(bodybytes []byte, amzTarget string, fn func([]byte) ([]byte, int, error)) ([]byte, int, error) {
+	if !operations[amzTarget[strings.LastIndex(amzTarget, ".")+1:]] || !Enabled() {
+		return fn(bodybytes)
+	}
+	names := tables(bodybytes)
+	if len(names) == 0 {
+		return fn(bodybytes)
+	}
+	if !acquire(names) {
+		e := fmt.Sprintf("bbpd_adaptive.Do:concurrency limit reached for %s calling %s",
+			strings.Join(names, ","), amzTarget)
+		return aws_error.Body(THROTTLED_TYPE, e), http.StatusBadRequest, nil
+	}
+	start := time.Now()
+	resp_body, code, resp_err := fn(bodybytes)
+	release(names)
+	switch {
+	case resp_err != nil:
+	case ep.HttpErr(code):
+		if aws_error.Throttled(resp_body) {
+			adjust(names, start, true)
+		}
+	default:
+		adjust(names, start, unprocessed(resp_body))
+	}
+	return resp_body, code, resp_err
+}
+
+// GetState returns the state of the limit of every table used.
+func GetState() []State {
+	adaptive_lock.Lock()
+	defer adaptive_lock.Unlock()
+	states := make([]State, 0, len(limiters))
+	for table, l := range limiters {
+		states = append(states, State{
+			Table:     table,
+			Limit:     l.limit,
+			InFlight:  l.in_flight,
+			Throttled: l.throttled,
+			Decreases: l.decreases,
+			TimedOut:  l.timed_out})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Table < states[j].Table
+	})
+	return states
+}
@@ -0,0 +1,180 @@
+package bbpd_adaptive
+
+import (
+	"github.com/smugmug/bbpd/lib/aws_error"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	GET_ITEM = "DynamoDB_20120810.GetItem"
+	BODY     = `{"TableName":"t","Key":{"id":{"S":"a"}}}`
+)
+
+// respond returns a request func that responds with resp_body and code, counting its calls.
+func respond(resp_body string, code int, calls *int) func([]byte) ([]byte, int, error) {
+	return func([]byte) ([]byte, int, error) {
+		*calls++
+		return []byte(resp_body), code, nil
+	}
+}
+
+// state returns the state of table's limit.
+func state(t *testing.T, table string) State {
+	for _, s := range GetState() {
+		if s.Table == table {
+			return s
+		}
+	}
+	t.Fatalf("no limit for %s", table)
+	return State{}
+}
+
+func TestConfigureDefaults(t *testing.T) {
+	defer Configure(0, 0, 0, 0, 0)
+	Configure(0, 0, 8, 2, 0)
+	if initial_limit != 8 || min_limit != DEFAULT_MIN_LIMIT || backoff != DEFAULT_BACKOFF || max_wait != DEFAULT_MAX_WAIT {
+		t.Errorf("initial %v min %v backoff %v wait %v, want the defaults",
+			initial_limit, min_limit, backoff, max_wait)
+	}
+	Configure(4, 10, 2, 0.25, time.Millisecond)
+	if max_limit != 10 || initial_limit != 10 {
+		t.Errorf("max %v initial %v, want both raised to the min 10", max_limit, initial_limit)
+	}
+	Configure(0, 0, 0, 0, 0)
+	if Enabled() {
+		t.Errorf("enabled with a max of 0")
+	}
+}
+
+func TestTables(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"TableName":"b"}`:                "b",
+		`{"RequestItems":{"b":{},"a":{}}}`: "a,b",
+		`{"TransactItems":[{"Put":{"TableName":"c"}},{"Get":{"TableName":"a"}}]}`: "a,c",
+		`{}`:       "",
+		`not json`: "",
+	} {
+		if got := strings.Join(tables([]byte(body)), ","); got != want {
+			t.Errorf("tables(%s) = %s, want %s", body, got, want)
+		}
+	}
+}
+
+func TestCutOnThrottle(t *testing.T) {
+	Configure(8, 1, 8, 0.5, time.Second)
+	defer Configure(0, 0, 0, 0, 0)
+	calls := 0
+	throttled := string(aws_error.Body(THROTTLED_TYPE, "slow down"))
+	Do([]byte(BODY), GET_ITEM, respond(throttled, http.StatusBadRequest, &calls))
+	s := state(t, "t")
+	if s.Limit != 4 || s.Throttled != 1 || s.Decreases != 1 || s.InFlight != 0 {
+		t.Errorf("after a throttle %+v, want the limit cut to 4", s)
+	}
+	// part of a batch left unprocessed is throttling too
+	Do([]byte(BODY), GET_ITEM, respond(`{"UnprocessedKeys":{"t":{"Keys":[]}}}`, http.StatusOK, &calls))
+	if s := state(t, "t"); s.Limit != 2 {
+		t.Errorf("after unprocessed keys limit %v, want 2", s.Limit)
+	}
+	// other errors leave the limit alone
+	Do([]byte(BODY), GET_ITEM, respond(`{"__type":"x#ValidationException"}`, http.StatusBadRequest, &calls))
+	if s := state(t, "t"); s.Limit != 2 {
+		t.Errorf("after a validation error limit %v, want 2", s.Limit)
+	}
+	if calls != 3 {
+		t.Errorf("%d requests made, want 3", calls)
+	}
+}
+
+func TestLastDecrease(t *testing.T) {
+	Configure(8, 3, 8, 0.5, time.Second)
+	defer Configure(0, 0, 0, 0, 0)
+	names := []string{"t"}
+	start := time.Now()
+	adjust(names, start, true)
+	// requests sent before the cut were sent under the old limit
+	adjust(names, start, true)
+	if s := state(t, "t"); s.Limit != 4 || s.Throttled != 2 || s.Decreases != 1 {
+		t.Errorf("after two throttles sent together %+v, want one cut to 4", s)
+	}
+	time.Sleep(time.Millisecond)
+	adjust(names, time.Now(), true)
+	if s := state(t, "t"); s.Limit != 3 || s.Decreases != 2 {
+		t.Errorf("after a later throttle %+v, want a cut to the min 3", s)
+	}
+}
+
+func TestAdditiveGrowth(t *testing.T) {
+	Configure(4, 1, 6, 0.5, time.Second)
+	defer Configure(0, 0, 0, 0, 0)
+	calls := 0
+	for i := 0; i < 4; i++ {
+		Do([]byte(BODY), GET_ITEM, respond(`{}`, http.StatusOK, &calls))
+	}
+	// about one per limit's worth of successes
+	if s := state(t, "t"); s.Limit <= 4.8 || s.Limit >= 5 {
+		t.Errorf("after 4 successes limit %v, want just under 5", s.Limit)
+	}
+	for i := 0; i < 100; i++ {
+		Do([]byte(BODY), GET_ITEM, respond(`{}`, http.StatusOK, &calls))
+	}
+	if s := state(t, "t"); s.Limit != 6 {
+		t.Errorf("limit %v, want it to stop at the max 6", s.Limit)
+	}
+}
+
+func TestTimedOut(t *testing.T) {
+	Configure(1, 1, 1, 0.5, 20*time.Millisecond)
+	defer Configure(0, 0, 0, 0, 0)
+	names := []string{"t"}
+	if !acquire(names) {
+		t.Fatalf("first request could not start")
+	}
+	calls := 0
+	resp_body, code, err := Do([]byte(BODY), GET_ITEM, respond(`{}`, http.StatusOK, &calls))
+	if calls != 0 || err != nil || code != http.StatusBadRequest || !aws_error.Throttled(resp_body) {
+		t.Errorf("at the limit Do made %d requests and returned %d %s %v, want a synthetic throttle",
+			calls, code, resp_body, err)
+	}
+	if aws_error.Type(resp_body) != aws_error.PROVISIONED_THROUGHPUT_EXCEEDED {
+		t.Errorf("error type %s, want %s", aws_error.Type(resp_body), aws_error.PROVISIONED_THROUGHPUT_EXCEEDED)
+	}
+	if s := state(t, "t"); s.TimedOut != 1 || s.InFlight != 1 {
+		t.Errorf("%+v, want one timed out request and the first in flight", s)
+	}
+	// operations that are not limited go ahead
+	Do([]byte(BODY), "DynamoDB_20120810.DescribeTable", respond(`{}`, http.StatusOK, &calls))
+	if calls != 1 {
+		t.Errorf("DescribeTable was limited")
+	}
+
+	// a waiting request starts when the first is released
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release(names)
+	}()
+	if _, code, _ := Do([]byte(BODY), GET_ITEM, respond(`{}`, http.StatusOK, &calls)); code != http.StatusOK || calls != 2 {
+		t.Errorf("waiting request returned %d after %d requests, want it made", code, calls)
+	}
+	if s := state(t, "t"); s.InFlight != 0 {
+		t.Errorf("%d in flight, want 0", s.InFlight)
+	}
+}
+
+func TestAcquireReleasesOnTimeout(t *testing.T) {
+	Configure(1, 1, 1, 0.5, 10*time.Millisecond)
+	defer Configure(0, 0, 0, 0, 0)
+	if !acquire([]string{"b"}) {
+		t.Fatalf("could not acquire b")
+	}
+	// a is acquired before b times out, and must be given back
+	if acquire([]string{"a", "b"}) {
+		t.Fatalf("acquired b over its limit")
+	}
+	if s := state(t, "a"); s.InFlight != 0 {
+		t.Errorf("a has %d in flight after the request timed out, want 0", s.InFlight)
+	}
+	release([]string{"b"})
+}
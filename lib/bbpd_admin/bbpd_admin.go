@@ -0,0 +1,312 @@
+// The admin endpoints of bbpd, which report and change its state at runtime. They are served
+// on their own address or socket, apart from the DynamoDB endpoints, and are not affected by
+// draining. Without an authentication policy, they are only served to local clients.
+package bbpd_admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_auth"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_readonly"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+const (
+	STATEPATH       = "/State"
+	DRAINPATH       = "/Drain"
+	RESUMEPATH      = "/Resume"
+	SHUTDOWNPATH    = "/Shutdown"
+	RELOADPATH      = "/Reload"
+	LOGLEVELPATH    = "/LogLevel"
+	READONLYPATH    = "/ReadOnly"
+	GOROUTINESPATH  = "/Goroutines"
+	CONNECTIONSPATH = "/Connections"
+)
+
+// State_Struct is the response from STATEPATH.
+type State_Struct struct {
+	Accepting  bool
+	ReadOnly   bool
+	LogLevel   string
+	OpenConns  int64
+	Goroutines int
+}
+
+// ReadOnly_Struct is the body of a request to, and response from, READONLYPATH.
+type ReadOnly_Struct struct {
+	ReadOnly bool
+}
+
+// LogLevel_Struct is the body of a request to, and response from, LOGLEVELPATH.
+type LogLevel_Struct struct {
+	LogLevel string
+}
+
+var (
+	reload    func() error
+	shutdown  func()
+	hooks_mut sync.RWMutex
+)
+
+// SetHooks sets the functions that reload the configuration and shut bbpd down, which
+// belong to its main package.
+func SetHooks(reload_fn func() error, shutdown_fn func()) {
+	hooks_mut.Lock()
+	reload = reload_fn
+	shutdown = shutdown_fn
+	hooks_mut.Unlock()
+}
+
+// Handler returns the handler of the admin endpoints. Unless an authentication policy decides
+// who may use them, requests from clients that are not local are refused.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(STATEPATH, stateHandler)
+	mux.HandleFunc(DRAINPATH, drainHandler)
+	mux.HandleFunc(RESUMEPATH, resumeHandler)
+	mux.HandleFunc(SHUTDOWNPATH, shutdownHandler)
+	mux.HandleFunc(RELOADPATH, reloadHandler)
+	mux.HandleFunc(LOGLEVELPATH, logLevelHandler)
+	mux.HandleFunc(READONLYPATH, readOnlyHandler)
+	mux.HandleFunc(GOROUTINESPATH, goroutinesHandler)
+	mux.HandleFunc(CONNECTIONSPATH, connectionsHandler)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !bbpd_auth.Enabled() && !local(req) {
+			e := fmt.Sprintf("bbpd_admin:%s is not local, and no authentication policy is configured", req.RemoteAddr)
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// local returns true if req was made over a Unix domain socket or from a loopback address.
+func local(req *http.Request) bool {
+	host, _, split_err := net.SplitHostPort(req.RemoteAddr)
+	if split_err != nil {
+		// Unix domain socket peers have no host and port
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// methodIs writes an error and returns false if req was not made with method.
+func methodIs(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	e := fmt.Sprintf("bbpd_admin:%s only supports %s", req.URL.Path, method)
+	bbpd_log.Errorf(e)
+	route_response.Error(w, e, http.StatusBadRequest)
+	return false
+}
+
+// getState returns the current state.
+func getState() State_Struct {
+	return State_Struct{
+		Accepting:  bbpd_runinfo.IsAccepting(),
+		ReadOnly:   bbpd_readonly.Enabled(),
+		LogLevel:   bbpd_log.Level(),
+		OpenConns:  bbpd_runinfo.OpenConns(),
+		Goroutines: runtime.NumGoroutine()}
+}
+
+// stateHandler reports the state of bbpd.
+func stateHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "GET") {
+		return
+	}
+	respond(w, req, getState(), start, "State")
+}
+
+// drainHandler stops bbpd accepting requests, which are answered with 503 until it resumes.
+// It does not wait for requests in progress.
+func drainHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "POST") {
+		return
+	}
+	bbpd_log.Infof("bbpd_admin.drainHandler:%s drains bbpd", req.RemoteAddr)
+	bbpd_runinfo.Drain()
+	respond(w, req, getState(), start, "Drain")
+}
+
+// resumeHandler has bbpd accept requests again after a drain.
+func resumeHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "POST") {
+		return
+	}
+	bbpd_log.Infof("bbpd_admin.resumeHandler:%s resumes bbpd", req.RemoteAddr)
+	bbpd_runinfo.SetBBPDAccept()
+	respond(w, req, getState(), start, "Resume")
+}
+
+// shutdownHandler shuts bbpd down gracefully, as SIGTERM does, once it has responded.
+func shutdownHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "POST") {
+		return
+	}
+	hooks_mut.RLock()
+	shutdown_fn := shutdown
+	hooks_mut.RUnlock()
+	if shutdown_fn == nil {
+		e := "bbpd_admin.shutdownHandler:shutdown is not available"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusNotImplemented)
+		return
+	}
+	bbpd_log.Infof("bbpd_admin.shutdownHandler:%s shuts bbpd down", req.RemoteAddr)
+	respond(w, req, getState(), start, "Shutdown")
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go shutdown_fn()
+}
+
+// reloadHandler reads the configuration file again and applies it.
+func reloadHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "POST") {
+		return
+	}
+	hooks_mut.RLock()
+	reload_fn := reload
+	hooks_mut.RUnlock()
+	if reload_fn == nil {
+		e := "bbpd_admin.reloadHandler:reload is not available"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusNotImplemented)
+		return
+	}
+	bbpd_log.Infof("bbpd_admin.reloadHandler:%s reloads the configuration", req.RemoteAddr)
+	reload_err := reload_fn()
+	if reload_err != nil {
+		e := fmt.Sprintf("bbpd_admin.reloadHandler:cannot reload: %s", reload_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	respond(w, req, getState(), start, "Reload")
+}
+
+// readBody reads the JSON request body of req into v, writing an error and returning false
+// if it cannot.
+func readBody(w http.ResponseWriter, req *http.Request, v interface{}, origin string) bool {
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("%s err reading req body: %s", origin, read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return false
+	}
+	if um_err := json.Unmarshal(bodybytes, v); um_err != nil {
+		e := fmt.Sprintf("%s:cannot parse %s: %s", origin, string(bodybytes), um_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// logLevelHandler reports the log level on GET, and sets it on POST, as {"LogLevel":"debug"}.
+func logLevelHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	switch req.Method {
+	case "GET":
+	case "POST":
+		var r LogLevel_Struct
+		if !readBody(w, req, &r, "bbpd_admin.logLevelHandler") {
+			return
+		}
+		if set_err := bbpd_log.SetLevel(r.LogLevel); set_err != nil {
+			bbpd_log.Errorf(set_err.Error())
+			route_response.Error(w, set_err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		e := fmt.Sprintf("bbpd_admin.logLevelHandler:bad method %s", req.Method)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	respond(w, req, LogLevel_Struct{LogLevel: bbpd_log.Level()}, start, "LogLevel")
+}
+
+// readOnlyHandler reports whether bbpd is in read-only mode on GET, and turns it on or off
+// on POST, as {"ReadOnly":true}. A setting made here is kept when the configuration is reloaded.
+func readOnlyHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	switch req.Method {
+	case "GET":
+	case "POST":
+		var r ReadOnly_Struct
+		if !readBody(w, req, &r, "bbpd_admin.readOnlyHandler") {
+			return
+		}
+		bbpd_log.Infof("bbpd_admin.readOnlyHandler:%s sets read-only mode %v", req.RemoteAddr, r.ReadOnly)
+		bbpd_readonly.Set(r.ReadOnly)
+	default:
+		e := fmt.Sprintf("bbpd_admin.readOnlyHandler:bad method %s", req.Method)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	respond(w, req, ReadOnly_Struct{ReadOnly: bbpd_readonly.Enabled()}, start, "ReadOnly")
+}
+
+// goroutinesHandler writes the stack of every goroutine as text.
+func goroutinesHandler(w http.ResponseWriter, req *http.Request) {
+	if !methodIs(w, req, "GET") {
+		return
+	}
+	w.Header().Set(bbpd_const.CONTENTTYPE, "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// connectionsHandler reports each open connection to the DynamoDB endpoints.
+func connectionsHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !methodIs(w, req, "GET") {
+		return
+	}
+	respond(w, req, bbpd_runinfo.GetConns(), start, "Connections")
+}
+
+// respond writes v as the JSON response.
+func respond(w http.ResponseWriter, req *http.Request, v interface{}, start time.Time, endpoint_name string) {
+	b, m_err := json.Marshal(v)
+	if m_err != nil {
+		e := fmt.Sprintf("bbpd_admin.respond:marshal err %s", m_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		b,
+		http.StatusOK,
+		start,
+		endpoint_name)
+	if mr_err != nil {
+		e := fmt.Sprintf("bbpd_admin.respond %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
@@ -0,0 +1,403 @@
+// Authentication of clients by static API key or TLS client certificate, and authorization of
+// their requests by a policy file that maps each client to the operations and table name
+// patterns it may use. Requests that are not allowed are rejected with 403 Forbidden and logged.
+//
+// A policy file looks like:
+//
+//	{
+//	    "Public": ["Status"],
+//	    "Clients": [
+//	        {
+//	            "Name": "reporting",
+//	            "APIKeys": ["5f2b0c..."],
+//	            "Identities": ["reporting.example.com"],
+//	            "Rules": [
+//	                {"Operations": ["GetItem", "Query", "Scan"], "Tables": ["reports_*"]}
+//	            ]
+//	        }
+//	    ]
+//	}
+//
+// Operations are named as in X-Amz-Target, without the API version, or "*" for all.
+// Tables are shell patterns as matched by path.Match.
+package bbpd_auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// matches every operation or table
+	ANY = "*"
+)
+
+// operations whose tables cannot be read from the request, such as PartiQL statements. They
+// are only allowed by rules that allow every table.
+var opaque_operations = map[string]bool{
+	"ExecuteStatement":      true,
+	"BatchExecuteStatement": true,
+	"ExecuteTransaction":    true,
+}
+
+// Rule allows Operations on the tables matching any of Tables.
+type Rule struct {
+	Operations []string
+	Tables     []string
+}
+
+// Client is a caller, known by any of its APIKeys or by the common name or a DNS name of its
+// TLS client certificate.
+type Client struct {
+	Name       string
+	APIKeys    []string
+	Identities []string
+	Rules      []Rule
+}
+
+// Policy is the content of a policy file.
+type Policy struct {
+	// operations that any caller may use, authenticated or not, such as Status for health checks
+	Public  []string
+	Clients []Client
+}
+
+var (
+	enabled     bool
+	policy_file string
+	public      map[string]bool
+	by_key      map[[sha256.Size]byte]*Client
+	by_identity map[string]*Client
+	auth_mut    sync.RWMutex
+)
+
+// Configure reads the policy file at policy_path. An empty policy_path disables
+// authentication. If the file cannot be read, an error is returned and the policy loaded
+// before is kept; if there was none, every request is denied until a policy is loaded.
+func Configure(policy_path string) error {
+	if policy_path == "" {
+		auth_mut.Lock()
+		enabled = false
+		policy_file = ""
+		auth_mut.Unlock()
+		return nil
+	}
+	p, read_err := read(policy_path)
+	auth_mut.Lock()
+	defer auth_mut.Unlock()
+	if read_err != nil {
+		if !enabled || policy_file != policy_path {
+			enabled = true
+			policy_file = policy_path
+			install(&Policy{})
+		}
+		return read_err
+	}
+	enabled = true
+	policy_file = policy_path
+	install(p)
+	return nil
+}
+
+// read parses and checks the policy file at policy_path.
+func read(policy_path string) (*Policy, error) {
+	b, read_err := ioutil.ReadFile(policy_path)
+	if read_err != nil {
+		e := fmt.Sprintf("bbpd_auth.read:cannot read %s: %s", policy_path, read_err.Error())
+		return nil, errors.New(e)
+	}
+	var p Policy
+	if um_err := json.Unmarshal(b, &p); um_err != nil {
+		e := fmt.Sprintf("bbpd_auth.read:cannot parse %s: %s", policy_path, um_err.Error())
+		return nil, errors.New(e)
+	}
+	keys := make(map[string]string)
+	for _, c := range p.Clients {
+		for _, k := range c.APIKeys {
+			if k == "" {
+				e := fmt.Sprintf("bbpd_auth.read:empty API key for client %s in %s", c.Name, policy_path)
+				return nil, errors.New(e)
+			}
+			if other, ok := keys[k]; ok {
+				e := fmt.Sprintf("bbpd_auth.read:clients %s and %s share an API key in %s", other, c.Name, policy_path)
+				return nil, errors.New(e)
+			}
+			keys[k] = c.Name
+		}
+		for _, r := range c.Rules {
+			for _, t := range r.Tables {
+				if _, match_err := path.Match(t, ""); match_err != nil {
+					e := fmt.Sprintf("bbpd_auth.read:bad table pattern '%s' for client %s in %s", t, c.Name, policy_path)
+					return nil, errors.New(e)
+				}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// install indexes the policy p. auth_mut must be held.
+func install(p *Policy) {
+	public = make(map[string]bool)
+	for _, op := range p.Public {
+		public[op] = true
+	}
+	by_key = make(map[[sha256.Size]byte]*Client)
+	by_identity = make(map[string]*Client)
+	for i := range p.Clients {
+		c := &p.Clients[i]
+		// keys are compared by their hashes, so that the lookup takes no longer for a
+		// key that shares a prefix with a valid one
+		for _, k := range c.APIKeys {
+			by_key[sha256.Sum256([]byte(k))] = c
+		}
+		for _, id := range c.Identities {
+			by_identity[id] = c
+		}
+	}
+}
+
+// Enabled returns true if a policy file is configured.
+func Enabled() bool {
+	auth_mut.RLock()
+	defer auth_mut.RUnlock()
+	return enabled
+}
+
+// identify returns the client that made req, or nil if it is not known. An API key takes
+// precedence over a client certificate. auth_mut must be held.
+func identify(req *http.Request) *Client {
+	if k := req.Header.Get(bbpd_const.X_BBPD_API_KEY); k != "" {
+		return by_key[sha256.Sum256([]byte(k))]
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := req.TLS.PeerCertificates[0]
+	if c, ok := by_identity[cert.Subject.CommonName]; ok && cert.Subject.CommonName != "" {
+		return c
+	}
+	for _, name := range cert.DNSNames {
+		if c, ok := by_identity[name]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// ClientName returns the name of the client that made req, or "" if it is not known.
+func ClientName(req *http.Request) string {
+	auth_mut.RLock()
+	defer auth_mut.RUnlock()
+	if c := identify(req); c != nil {
+		return c.Name
+	}
+	return ""
+}
+
+// matches returns true if s is in patterns, or patterns has ANY.
+func matches(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if p == ANY || p == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if a rule of c allows op on every one of tables. If known is false,
+// the tables could not be determined, and only a rule allowing every table will do.
+func (c *Client) allows(op string, tables []string, known bool) bool {
+	for _, table := range tables {
+		allowed := false
+		for _, r := range c.Rules {
+			if !matches(r.Operations, op) {
+				continue
+			}
+			for _, t := range r.Tables {
+				if m, _ := path.Match(t, table); m {
+					allowed = true
+					break
+				}
+			}
+			if allowed {
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(tables) != 0 {
+		return true
+	}
+	for _, r := range c.Rules {
+		if matches(r.Operations, op) && (known || matches(r.Tables, ANY)) {
+			return true
+		}
+	}
+	return false
+}
+
+// tableName returns the table named in the DynamoDB ARN arn, or "" if it names none.
+func tableName(arn string) string {
+	i := strings.Index(arn, ":table/")
+	if i == -1 {
+		return ""
+	}
+	name := arn[i+len(":table/"):]
+	if j := strings.Index(name, "/"); j != -1 {
+		name = name[:j]
+	}
+	return name
+}
+
+// tables returns the tables that the request bodybytes for op uses. known is false if they
+// cannot be determined.
+func tables(op string, bodybytes []byte) (names []string, known bool) {
+	if opaque_operations[op] {
+		return nil, false
+	}
+	if len(bytes.TrimSpace(bodybytes)) == 0 {
+		return nil, true
+	}
+	var r struct {
+		TableName       string
+		TargetTableName string
+		SourceTableName string
+		TableArn        string
+		SourceTableArn  string
+		ResourceArn     string
+		BackupArn       string
+		RequestItems    map[string]json.RawMessage
+		TransactItems   []map[string]struct {
+			TableName string
+		}
+	}
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil {
+		return nil, false
+	}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	add(r.TableName)
+	add(r.TargetTableName)
+	add(r.SourceTableName)
+	add(tableName(r.TableArn))
+	add(tableName(r.SourceTableArn))
+	add(tableName(r.ResourceArn))
+	add(tableName(r.BackupArn))
+	for table := range r.RequestItems {
+		add(table)
+	}
+	for _, item := range r.TransactItems {
+		for _, action := range item {
+			add(action.TableName)
+		}
+	}
+	return names, true
+}
+
+// pathTable returns the table named in the path of a request such as /DescribeTable/mytable,
+// or "" if there is none.
+func pathTable(req *http.Request) string {
+	pathElts := strings.Split(req.URL.Path, "/")
+	if len(pathElts) != 3 {
+		return ""
+	}
+	table, ue_err := url.QueryUnescape(pathElts[2])
+	if ue_err != nil {
+		return ""
+	}
+	return table
+}
+
+// Authorized returns true if the client that made req may call the operation op with it,
+// reading the tables from the request body. The body is replaced so that it may be read
+// again by the handler. If the request is not allowed, it is logged, a 403 Forbidden
+// response is written, and false is returned.
+func Authorized(w http.ResponseWriter, req *http.Request, op string) bool {
+	return authorized(w, req, op, false)
+}
+
+// authorized is Authorized, reading the table from the path first if in_path is set.
+func authorized(w http.ResponseWriter, req *http.Request, op string, in_path bool) bool {
+	if !Enabled() {
+		return true
+	}
+	var names []string
+	known := true
+	if table := pathTable(req); in_path && table != "" {
+		names = []string{table}
+	} else if req.Body != nil {
+		bodybytes, read_err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if read_err != nil && read_err != io.EOF {
+			e := fmt.Sprintf("bbpd_auth.Authorized err reading req body: %s", read_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusInternalServerError)
+			return false
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(bodybytes))
+		names, known = tables(op, bodybytes)
+	}
+
+	auth_mut.RLock()
+	if public[op] {
+		auth_mut.RUnlock()
+		return true
+	}
+	c := identify(req)
+	allowed := c != nil && c.allows(op, names, known)
+	auth_mut.RUnlock()
+	if allowed {
+		return true
+	}
+
+	client := "unauthenticated client"
+	if c != nil {
+		client = "client " + c.Name
+	}
+	e := fmt.Sprintf("bbpd_auth.Authorized:%s at %s may not call %s", client, req.RemoteAddr, op)
+	if len(names) != 0 {
+		e += " on " + strings.Join(names, ",")
+	}
+	bbpd_log.Errorf(e)
+	route_response.Error(w, e, http.StatusForbidden)
+	return false
+}
+
+// Handler returns a handler that calls h with requests that may call the operation op.
+func Handler(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if authorized(w, req, op, false) {
+			h(w, req)
+		}
+	}
+}
+
+// PathHandler is Handler for routes that name the table in the path, as /DescribeTable/mytable.
+func PathHandler(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if authorized(w, req, op, true) {
+			h(w, req)
+		}
+	}
+}
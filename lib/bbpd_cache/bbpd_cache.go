@@ -0,0 +1,550 @@
+// An optional in-process LRU cache of Items read by GetItem and BatchGetItem.
+// Only eventually-consistent reads of whole Items are served from the cache.
+// Entries are invalidated when a PutItem, UpdateItem, DeleteItem, BatchWriteItem or
+// TransactWriteItems for the same key passes through bbpd, and every entry for a table is
+// invalidated by a PartiQL statement that writes to it. Writes made by other clients are
+// not seen, so the TTL bounds how stale a cached Item may be.
+package bbpd_cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/smugmug/bbpd/lib/bbpd_endpoints"
+	"github.com/smugmug/bbpd/lib/bbpd_stats"
+	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
+	delete_item "github.com/smugmug/godynamo/endpoints/delete_item"
+	put "github.com/smugmug/godynamo/endpoints/put_item"
+	update_item "github.com/smugmug/godynamo/endpoints/update_item"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RETURN_CONSUMED_CAPACITY_NONE = "NONE"
+	KEY_SEP                       = "\x00"
+	// how long an Item may be served from the cache, if no TTL is configured
+	DEFAULT_TTL = 30 * time.Second
+)
+
+// a cached Item. a nil item records that the key has no Item.
+type entry struct {
+	key     string
+	table   string
+	item    json.RawMessage
+	expires time.Time
+}
+
+var (
+	max_size int
+	ttl      time.Duration
+	lru      *list.List
+	entries  map[string]*list.Element
+	// the attribute names that make up the primary key of each table, as seen in requests
+	key_names map[string][]string
+	// bumped whenever a write for a table passes through. a read that started before
+	// a write to its table may not store its result.
+	generations map[string]uint64
+	cache_mut   sync.Mutex
+)
+
+func init() {
+	Configure(0, 0)
+}
+
+// Configure sets the cache size and TTL, discarding any cached Items.
+// A size of 0 disables the cache. A TTL of 0 or less is DEFAULT_TTL.
+func Configure(size int, item_ttl time.Duration) {
+	if item_ttl <= 0 {
+		item_ttl = DEFAULT_TTL
+	}
+	cache_mut.Lock()
+	max_size = size
+	ttl = item_ttl
+	lru = list.New()
+	entries = make(map[string]*list.Element)
+	key_names = make(map[string][]string)
+	generations = make(map[string]uint64)
+	cache_mut.Unlock()
+}
+
+// TTL returns how long an Item may be served from the cache.
+func TTL() time.Duration {
+	cache_mut.Lock()
+	defer cache_mut.Unlock()
+	return ttl
+}
+
+// Enabled returns true if the cache has been configured with a non-zero size.
+func Enabled() bool {
+	cache_mut.Lock()
+	defer cache_mut.Unlock()
+	return max_size > 0
+}
+
+// Len returns the number of cached Items.
+func Len() int {
+	cache_mut.Lock()
+	defer cache_mut.Unlock()
+	return lru.Len()
+}
+
+// the fields of a GetItem request, or a BatchGetItem table request, that decide
+// whether it can be served from the cache
+type readReq struct {
+	TableName              string
+	Key                    map[string]json.RawMessage
+	ConsistentRead         bool
+	AttributesToGet        []string
+	ProjectionExpression   string
+	ReturnConsumedCapacity string
+}
+
+func (r *readReq) cacheable() bool {
+	return !r.ConsistentRead &&
+		len(r.AttributesToGet) == 0 &&
+		r.ProjectionExpression == "" &&
+		(r.ReturnConsumedCapacity == "" || r.ReturnConsumedCapacity == RETURN_CONSUMED_CAPACITY_NONE)
+}
+
+// canonicalKey serializes the key attributes in sorted name order so that equal
+// keys map to equal strings. The second return value is the sorted attribute names.
+// Values are compared as serialized, so {"N":"1"} and {"N":"1.0"} are distinct.
+func canonicalKey(table string, key map[string]json.RawMessage) (string, []string, bool) {
+	names := make([]string, 0, len(key))
+	for k := range key {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canon := make(map[string]interface{}, len(key))
+	for k, v := range key {
+		var i interface{}
+		if um_err := json.Unmarshal(v, &i); um_err != nil {
+			return "", nil, false
+		}
+		canon[k] = i
+	}
+	b, m_err := json.Marshal(canon)
+	if m_err != nil || len(names) == 0 {
+		return "", nil, false
+	}
+	return table + KEY_SEP + string(b), names, true
+}
+
+// itemKey projects an Item onto the key attribute names of its table.
+func itemKey(table string, item map[string]json.RawMessage, names []string) (string, bool) {
+	if len(names) == 0 {
+		return "", false
+	}
+	key := make(map[string]json.RawMessage, len(names))
+	for _, n := range names {
+		v, v_ok := item[n]
+		if !v_ok {
+			return "", false
+		}
+		key[n] = v
+	}
+	k, _, ok := canonicalKey(table, key)
+	return k, ok
+}
+
+// lookup returns the cached entry for key, if present and unexpired. cache_mut must be held.
+func lookup(key string) (*entry, bool) {
+	elt, ok := entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elt.Value.(*entry)
+	if time.Now().After(e.expires) {
+		lru.Remove(elt)
+		delete(entries, key)
+		return nil, false
+	}
+	lru.MoveToFront(elt)
+	return e, true
+}
+
+// store adds or replaces an entry, evicting the least recently used if full.
+// cache_mut must be held.
+func store(table, key string, item json.RawMessage) {
+	if elt, ok := entries[key]; ok {
+		e := elt.Value.(*entry)
+		e.item = item
+		e.expires = time.Now().Add(ttl)
+		lru.MoveToFront(elt)
+		return
+	}
+	entries[key] = lru.PushFront(&entry{key: key, table: table, item: item, expires: time.Now().Add(ttl)})
+	for lru.Len() > max_size {
+		oldest := lru.Back()
+		lru.Remove(oldest)
+		delete(entries, oldest.Value.(*entry).key)
+	}
+}
+
+// remove drops an entry. cache_mut must be held.
+func remove(key string) {
+	if elt, ok := entries[key]; ok {
+		lru.Remove(elt)
+		delete(entries, key)
+	}
+}
+
+// Pending records a cache miss so that the result of the upstream read can be stored.
+type Pending struct {
+	table      string
+	key        string
+	generation uint64
+}
+
+// LookupGetItem returns a GetItem response body if the request can be served from the cache.
+// Otherwise, if the request is cacheable, a *Pending is returned, on which Store should be
+// called with the upstream response.
+func LookupGetItem(bodybytes []byte) ([]byte, *Pending) {
+	if !Enabled() {
+		return nil, nil
+	}
+	var r readReq
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil || !r.cacheable() {
+		return nil, nil
+	}
+	key, names, key_ok := canonicalKey(r.TableName, r.Key)
+	if !key_ok {
+		return nil, nil
+	}
+	cache_mut.Lock()
+	key_names[r.TableName] = names
+	e, hit := lookup(key)
+	if hit {
+		cache_mut.Unlock()
+		bbpd_stats.AddCacheHit()
+		if e.item == nil {
+			return []byte("{}"), nil
+		}
+		resp_body, _ := json.Marshal(map[string]json.RawMessage{"Item": e.item})
+		return resp_body, nil
+	}
+	p := &Pending{table: r.TableName, key: key, generation: generations[r.TableName]}
+	cache_mut.Unlock()
+	bbpd_stats.AddCacheMiss()
+	return nil, p
+}
+
+// Store caches the Item in a successful GetItem response, unless a write to the table
+// has passed through since the lookup.
+func (p *Pending) Store(resp_body []byte) {
+	var resp struct {
+		Item json.RawMessage
+	}
+	if um_err := json.Unmarshal(resp_body, &resp); um_err != nil {
+		return
+	}
+	if string(resp.Item) == "null" {
+		resp.Item = nil
+	}
+	cache_mut.Lock()
+	if max_size > 0 && generations[p.table] == p.generation {
+		store(p.table, p.key, resp.Item)
+	}
+	cache_mut.Unlock()
+}
+
+// the per-table portion of a BatchGetItem request
+type batchTableReq struct {
+	Keys                 []map[string]json.RawMessage
+	ConsistentRead       bool
+	AttributesToGet      []string
+	ProjectionExpression string
+}
+
+// BatchPending records the cacheable tables of a BatchGetItem request.
+type BatchPending struct {
+	generations map[string]uint64
+	// cached Items, by table, to be merged into the upstream response
+	hits map[string][]json.RawMessage
+}
+
+// LookupBatchGetItem serves what it can of a BatchGetItem request from the cache.
+// It returns the request body to send upstream for the remaining keys (nil if every key
+// was found in the cache) and a *BatchPending (nil if nothing was cacheable).
+// The caller should pass the upstream response to Merge.
+func LookupBatchGetItem(bodybytes []byte) ([]byte, *BatchPending) {
+	if !Enabled() {
+		return bodybytes, nil
+	}
+	var reqmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(bodybytes, &reqmap); um_err != nil {
+		return bodybytes, nil
+	}
+	var rcc string
+	if v, ok := reqmap["ReturnConsumedCapacity"]; ok {
+		json.Unmarshal(v, &rcc)
+	}
+	if rcc != "" && rcc != RETURN_CONSUMED_CAPACITY_NONE {
+		return bodybytes, nil
+	}
+	var request_items map[string]map[string]json.RawMessage
+	if um_err := json.Unmarshal(reqmap["RequestItems"], &request_items); um_err != nil {
+		return bodybytes, nil
+	}
+
+	p := &BatchPending{
+		generations: make(map[string]uint64),
+		hits:        make(map[string][]json.RawMessage)}
+	hit_count, miss_count := 0, 0
+	cache_mut.Lock()
+	for table, table_req_map := range request_items {
+		table_req_bytes, _ := json.Marshal(table_req_map)
+		var table_req batchTableReq
+		if um_err := json.Unmarshal(table_req_bytes, &table_req); um_err != nil {
+			continue
+		}
+		r := readReq{
+			ConsistentRead:       table_req.ConsistentRead,
+			AttributesToGet:      table_req.AttributesToGet,
+			ProjectionExpression: table_req.ProjectionExpression}
+		if !r.cacheable() {
+			continue
+		}
+		p.generations[table] = generations[table]
+		misses := make([]map[string]json.RawMessage, 0)
+		for _, k := range table_req.Keys {
+			key, names, key_ok := canonicalKey(table, k)
+			if !key_ok {
+				misses = append(misses, k)
+				continue
+			}
+			key_names[table] = names
+			e, hit := lookup(key)
+			if !hit {
+				miss_count++
+				misses = append(misses, k)
+				continue
+			}
+			hit_count++
+			if e.item != nil {
+				p.hits[table] = append(p.hits[table], e.item)
+			}
+		}
+		if len(misses) == 0 {
+			delete(request_items, table)
+		} else {
+			keys_bytes, _ := json.Marshal(misses)
+			table_req_map["Keys"] = keys_bytes
+		}
+	}
+	cache_mut.Unlock()
+	for i := 0; i < hit_count; i++ {
+		bbpd_stats.AddCacheHit()
+	}
+	for i := 0; i < miss_count; i++ {
+		bbpd_stats.AddCacheMiss()
+	}
+	if len(p.generations) == 0 {
+		return bodybytes, nil
+	}
+	if len(request_items) == 0 {
+		return nil, p
+	}
+	request_items_bytes, m_err := json.Marshal(request_items)
+	if m_err != nil {
+		return bodybytes, nil
+	}
+	reqmap["RequestItems"] = request_items_bytes
+	remaining, m_err := json.Marshal(reqmap)
+	if m_err != nil {
+		return bodybytes, nil
+	}
+	return remaining, p
+}
+
+// Merge stores the Items of a successful BatchGetItem response for the cacheable tables,
+// and adds the Items served from the cache. resp_body may be nil if nothing was sent upstream.
+func (p *BatchPending) Merge(resp_body []byte) ([]byte, error) {
+	respmap := make(map[string]json.RawMessage)
+	responses := make(map[string][]json.RawMessage)
+	if resp_body != nil {
+		if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+			return nil, um_err
+		}
+		if r, ok := respmap["Responses"]; ok {
+			if um_err := json.Unmarshal(r, &responses); um_err != nil {
+				return nil, um_err
+			}
+		}
+	} else {
+		respmap["UnprocessedKeys"] = json.RawMessage("{}")
+	}
+
+	cache_mut.Lock()
+	for table, gen := range p.generations {
+		if max_size == 0 || generations[table] != gen {
+			continue
+		}
+		for _, item_bytes := range responses[table] {
+			var item map[string]json.RawMessage
+			if um_err := json.Unmarshal(item_bytes, &item); um_err != nil {
+				continue
+			}
+			if key, key_ok := itemKey(table, item, key_names[table]); key_ok {
+				store(table, key, item_bytes)
+			}
+		}
+	}
+	cache_mut.Unlock()
+
+	for table, items := range p.hits {
+		responses[table] = append(responses[table], items...)
+	}
+	responses_bytes, m_err := json.Marshal(responses)
+	if m_err != nil {
+		return nil, m_err
+	}
+	respmap["Responses"] = responses_bytes
+	return json.Marshal(respmap)
+}
+
+// invalidateItem drops the entry for an Item or Key of table. cache_mut must be held.
+func invalidateItem(table string, item map[string]json.RawMessage) {
+	generations[table]++
+	if key, key_ok := itemKey(table, item, key_names[table]); key_ok {
+		remove(key)
+	}
+}
+
+// invalidateTable drops every entry for table, or for every table if table is empty.
+// cache_mut must be held.
+func invalidateTable(table string) {
+	if table == "" {
+		// every table with a pending read has had its key names recorded
+		for t := range key_names {
+			generations[t]++
+		}
+	} else {
+		generations[table]++
+	}
+	for elt := lru.Front(); elt != nil; {
+		next := elt.Next()
+		if e := elt.Value.(*entry); table == "" || e.table == table {
+			lru.Remove(elt)
+			delete(entries, e.key)
+		}
+		elt = next
+	}
+}
+
+// the table written by a PartiQL INSERT, UPDATE or DELETE statement
+var partiql_write = regexp.MustCompile(`(?is)^\s*(?:INSERT\s+INTO|UPDATE|DELETE\s+FROM)\s+(?:"([^"]+)"|([A-Za-z0-9_.-]+))`)
+
+// invalidateStatement drops the entries for the table written by a PartiQL statement. If
+// the statement is not a SELECT and its table cannot be found, every entry is dropped.
+// cache_mut must be held.
+func invalidateStatement(statement string) {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(statement)), "SELECT") {
+		return
+	}
+	m := partiql_write.FindStringSubmatch(statement)
+	if m == nil {
+		invalidateTable("")
+		return
+	}
+	invalidateTable(m[1] + m[2])
+}
+
+// Invalidate drops any cached Item written by a PutItem, UpdateItem, DeleteItem,
+// BatchWriteItem or TransactWriteItems request, and the Items of any table written by an
+// ExecuteStatement or BatchExecuteStatement request. Requests for other targets are ignored.
+func Invalidate(amzTarget string, bodybytes []byte) {
+	if !Enabled() {
+		return
+	}
+	// BatchWriteItem requests relayed as they are, such as through RawPost
+	if amzTarget == bbpd_endpoints.TARGET_PREFIX+bwi.ENDPOINT_NAME {
+		InvalidateBatchWrite(bodybytes)
+		return
+	}
+	var w struct {
+		TableName     string
+		Key           map[string]json.RawMessage
+		Item          map[string]json.RawMessage
+		TransactItems []map[string]struct {
+			TableName string
+			Key       map[string]json.RawMessage
+			Item      map[string]json.RawMessage
+		}
+		Statement  string
+		Statements []struct {
+			Statement string
+		}
+	}
+	switch amzTarget {
+	case put.PUTITEM_ENDPOINT, update_item.UPDATEITEM_ENDPOINT, delete_item.DELETEITEM_ENDPOINT,
+		bbpd_endpoints.TRANSACTWRITEITEMS_ENDPOINT, bbpd_endpoints.EXECUTESTATEMENT_ENDPOINT,
+		bbpd_endpoints.BATCHEXECUTESTATEMENT_ENDPOINT:
+		if um_err := json.Unmarshal(bodybytes, &w); um_err != nil {
+			return
+		}
+	default:
+		return
+	}
+	cache_mut.Lock()
+	defer cache_mut.Unlock()
+	switch amzTarget {
+	case bbpd_endpoints.TRANSACTWRITEITEMS_ENDPOINT:
+		for _, item := range w.TransactItems {
+			for _, action := range item {
+				if action.Key != nil {
+					invalidateItem(action.TableName, action.Key)
+				} else if action.Item != nil {
+					invalidateItem(action.TableName, action.Item)
+				}
+			}
+		}
+	case bbpd_endpoints.EXECUTESTATEMENT_ENDPOINT:
+		invalidateStatement(w.Statement)
+	case bbpd_endpoints.BATCHEXECUTESTATEMENT_ENDPOINT:
+		for _, st := range w.Statements {
+			invalidateStatement(st.Statement)
+		}
+	default:
+		if w.Key != nil {
+			invalidateItem(w.TableName, w.Key)
+		} else {
+			invalidateItem(w.TableName, w.Item)
+		}
+	}
+}
+
+// InvalidateBatchWrite drops any cached Item written by a BatchWriteItem request.
+func InvalidateBatchWrite(bodybytes []byte) {
+	if !Enabled() {
+		return
+	}
+	var b struct {
+		RequestItems map[string][]struct {
+			PutRequest *struct {
+				Item map[string]json.RawMessage
+			}
+			DeleteRequest *struct {
+				Key map[string]json.RawMessage
+			}
+		}
+	}
+	if um_err := json.Unmarshal(bodybytes, &b); um_err != nil {
+		return
+	}
+	cache_mut.Lock()
+	for table, writes := range b.RequestItems {
+		for _, w := range writes {
+			if w.PutRequest != nil {
+				invalidateItem(table, w.PutRequest.Item)
+			}
+			if w.DeleteRequest != nil {
+				invalidateItem(table, w.DeleteRequest.Key)
+			}
+		}
+	}
+	cache_mut.Unlock()
+}
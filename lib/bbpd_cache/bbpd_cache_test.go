@@ -0,0 +1,222 @@
+package bbpd_cache
+
+import (
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_endpoints"
+	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
+	delete_item "github.com/smugmug/godynamo/endpoints/delete_item"
+	put "github.com/smugmug/godynamo/endpoints/put_item"
+	update_item "github.com/smugmug/godynamo/endpoints/update_item"
+	"testing"
+	"time"
+)
+
+// getItem returns the body of a GetItem request for the Item with id in table.
+func getItem(table, id string) []byte {
+	return []byte(fmt.Sprintf(`{"TableName":%q,"Key":{"id":{"S":%q}}}`, table, id))
+}
+
+// item returns the JSON of the Item with id.
+func item(id string) string {
+	return fmt.Sprintf(`{"id":{"S":%q},"v":{"N":"1"}}`, id)
+}
+
+// cache looks up the Item with id in table, which must miss, and stores it.
+func cache(t *testing.T, table, id string) {
+	resp_body, p := LookupGetItem(getItem(table, id))
+	if resp_body != nil || p == nil {
+		t.Fatalf("%s %s: want a miss, got %s", table, id, resp_body)
+	}
+	p.Store([]byte(`{"Item":` + item(id) + `}`))
+}
+
+// cached returns true if the Item with id in table is served from the cache.
+func cached(table, id string) bool {
+	resp_body, _ := LookupGetItem(getItem(table, id))
+	return resp_body != nil
+}
+
+func TestConfigureTTL(t *testing.T) {
+	defer Configure(0, 0)
+	for _, c := range []struct {
+		ttl, want time.Duration
+	}{
+		{0, DEFAULT_TTL},
+		{-time.Second, DEFAULT_TTL},
+		{time.Second, time.Second},
+	} {
+		Configure(10, c.ttl)
+		if TTL() != c.want {
+			t.Errorf("Configure with TTL %v: TTL %v, want %v", c.ttl, TTL(), c.want)
+		}
+	}
+}
+
+func TestLookupGetItem(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	cache(t, "t", "a")
+	resp_body, p := LookupGetItem(getItem("t", "a"))
+	if p != nil || string(resp_body) != `{"Item":`+item("a")+`}` {
+		t.Errorf("hit %s, want the stored Item", resp_body)
+	}
+	// the order of the key attributes does not matter
+	if resp_body, _ := LookupGetItem([]byte(`{"Key":{"id":{"S":"a"}},"TableName":"t"}`)); resp_body == nil {
+		t.Errorf("reordered request missed")
+	}
+	// a key with no Item is cached as such
+	_, p = LookupGetItem(getItem("t", "none"))
+	p.Store([]byte(`{}`))
+	if resp_body, _ := LookupGetItem(getItem("t", "none")); string(resp_body) != "{}" {
+		t.Errorf("hit %s for a missing Item, want {}", resp_body)
+	}
+	if Len() != 2 {
+		t.Errorf("Len %d, want 2", Len())
+	}
+}
+
+func TestLookupGetItemNotCacheable(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	for _, body := range []string{
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ConsistentRead":true}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"v"}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"AttributesToGet":["v"]}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ReturnConsumedCapacity":"TOTAL"}`,
+		`{"TableName":"t","Key":{}}`,
+		`not json`,
+	} {
+		if resp_body, p := LookupGetItem([]byte(body)); resp_body != nil || p != nil {
+			t.Errorf("%s was cacheable", body)
+		}
+	}
+	Configure(0, 0)
+	if resp_body, p := LookupGetItem(getItem("t", "a")); resp_body != nil || p != nil {
+		t.Errorf("disabled cache was used")
+	}
+}
+
+func TestLRU(t *testing.T) {
+	Configure(2, 0)
+	defer Configure(0, 0)
+	cache(t, "t", "a")
+	cache(t, "t", "b")
+	// a is now the most recently used
+	if !cached("t", "a") {
+		t.Fatalf("a missed")
+	}
+	cache(t, "t", "c")
+	if Len() != 2 {
+		t.Errorf("Len %d, want 2", Len())
+	}
+	if cached("t", "b") {
+		t.Errorf("least recently used b was kept")
+	}
+	if !cached("t", "a") || !cached("t", "c") {
+		t.Errorf("a or c was evicted")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	Configure(10, time.Hour)
+	defer Configure(0, 0)
+	cache(t, "t", "a")
+	cache_mut.Lock()
+	for _, elt := range entries {
+		elt.Value.(*entry).expires = time.Now().Add(-time.Second)
+	}
+	cache_mut.Unlock()
+	if cached("t", "a") {
+		t.Errorf("expired Item was served")
+	}
+	if Len() != 0 {
+		t.Errorf("expired Item was kept")
+	}
+}
+
+func TestStoreAfterWrite(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	_, p := LookupGetItem(getItem("t", "a"))
+	// a write to the table while the read is in flight, even of another Item
+	Invalidate(put.PUTITEM_ENDPOINT, []byte(`{"TableName":"t","Item":`+item("b")+`}`))
+	p.Store([]byte(`{"Item":` + item("a") + `}`))
+	if cached("t", "a") {
+		t.Errorf("read that started before a write was stored")
+	}
+	// a write to another table does not matter
+	_, p = LookupGetItem(getItem("t", "a"))
+	Invalidate(put.PUTITEM_ENDPOINT, []byte(`{"TableName":"u","Item":`+item("a")+`}`))
+	p.Store([]byte(`{"Item":` + item("a") + `}`))
+	if !cached("t", "a") {
+		t.Errorf("read was not stored after a write to another table")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	for _, c := range []struct {
+		target string
+		body   string
+	}{
+		// the key names of t are learned from the lookups, so a whole Item finds its key
+		{put.PUTITEM_ENDPOINT, `{"TableName":"t","Item":` + item("a") + `}`},
+		{update_item.UPDATEITEM_ENDPOINT, `{"TableName":"t","Key":{"id":{"S":"a"}},"UpdateExpression":"SET v = :v"}`},
+		{delete_item.DELETEITEM_ENDPOINT, `{"TableName":"t","Key":{"id":{"S":"a"}}}`},
+		{bbpd_endpoints.TRANSACTWRITEITEMS_ENDPOINT, `{"TransactItems":[{"Put":{"TableName":"t","Item":` + item("a") + `}}]}`},
+		{bbpd_endpoints.TRANSACTWRITEITEMS_ENDPOINT, `{"TransactItems":[{"Delete":{"TableName":"t","Key":{"id":{"S":"a"}}}}]}`},
+		{bbpd_endpoints.TARGET_PREFIX + bwi.ENDPOINT_NAME, `{"RequestItems":{"t":[{"PutRequest":{"Item":` + item("a") + `}}]}}`},
+		{bbpd_endpoints.EXECUTESTATEMENT_ENDPOINT, `{"Statement":"UPDATE \"t\" SET v = 2 WHERE id = 'a'"}`},
+		{bbpd_endpoints.BATCHEXECUTESTATEMENT_ENDPOINT, `{"Statements":[{"Statement":"DELETE FROM t WHERE id = 'a'"}]}`},
+	} {
+		cache(t, "t", "a")
+		cache(t, "t", "b")
+		cache(t, "u", "a")
+		Invalidate(c.target, []byte(c.body))
+		if cached("t", "a") {
+			t.Errorf("%s %s: Item was not invalidated", c.target, c.body)
+		}
+		if !cached("u", "a") {
+			t.Errorf("%s %s: Item of another table was invalidated", c.target, c.body)
+		}
+		Configure(10, 0)
+	}
+}
+
+func TestInvalidateOnlyItem(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	cache(t, "t", "a")
+	cache(t, "t", "b")
+	Invalidate(delete_item.DELETEITEM_ENDPOINT, []byte(`{"TableName":"t","Key":{"id":{"S":"a"}}}`))
+	if cached("t", "a") || !cached("t", "b") {
+		t.Errorf("DeleteItem of a did not invalidate only a")
+	}
+	// a PartiQL statement invalidates its whole table, and a SELECT nothing
+	Invalidate(bbpd_endpoints.EXECUTESTATEMENT_ENDPOINT, []byte(`{"Statement":"SELECT * FROM t"}`))
+	if !cached("t", "b") {
+		t.Errorf("SELECT invalidated an Item")
+	}
+	Invalidate(bbpd_endpoints.EXECUTESTATEMENT_ENDPOINT, []byte(`{"Statement":"INSERT INTO t VALUE {'id':'c'}"}`))
+	if cached("t", "b") {
+		t.Errorf("INSERT did not invalidate its table")
+	}
+}
+
+func TestInvalidateBatchWrite(t *testing.T) {
+	Configure(10, 0)
+	defer Configure(0, 0)
+	cache(t, "t", "a")
+	cache(t, "t", "b")
+	cache(t, "t", "c")
+	InvalidateBatchWrite([]byte(`{"RequestItems":{"t":[
+		{"PutRequest":{"Item":` + item("a") + `}},
+		{"DeleteRequest":{"Key":{"id":{"S":"b"}}}}]}}`))
+	if cached("t", "a") || cached("t", "b") {
+		t.Errorf("written Items were not invalidated")
+	}
+	if !cached("t", "c") {
+		t.Errorf("unwritten Item was invalidated")
+	}
+}
@@ -0,0 +1,294 @@
+// Accounting of the capacity consumed by requests made through bbpd. If configured,
+// ReturnConsumedCapacity is added to requests that do not already ask for it, and the
+// ConsumedCapacity is removed from the response before it is returned to the caller.
+// Read and write capacity units are totalled per table and per index, both since bbpd
+// started and over a rolling window.
+package bbpd_capacity
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENDPOINT_NAME                  = "Capacity"
+	RETURN_CONSUMED_CAPACITY       = "ReturnConsumedCapacity"
+	CONSUMED_CAPACITY              = "ConsumedCapacity"
+	RETURN_CONSUMED_CAPACITY_NONE  = "NONE"
+	RETURN_CONSUMED_CAPACITY_TOTAL = "TOTAL"
+	// also reports the capacity consumed by each index
+	RETURN_CONSUMED_CAPACITY_INDEXES = "INDEXES"
+	// the rolling window, in seconds
+	WINDOW_SECONDS = 60
+)
+
+// operations that accept ReturnConsumedCapacity, and whether they consume write capacity
+var operations = map[string]bool{
+	"GetItem":            false,
+	"BatchGetItem":       false,
+	"Query":              false,
+	"Scan":               false,
+	"TransactGetItems":   false,
+	"PutItem":            true,
+	"UpdateItem":         true,
+	"DeleteItem":         true,
+	"BatchWriteItem":     true,
+	"TransactWriteItems": true,
+}
+
+// Units are capacity units consumed.
+type Units struct {
+	Read  float64
+	Write float64
+}
+
+// Usage reports the capacity consumed by a table or index.
+type Usage struct {
+	Total Units
+	// consumed within the last WINDOW_SECONDS
+	LastMinute Units
+}
+
+// TableUsage reports the capacity consumed by a table, including its indexes, and by each index.
+type TableUsage struct {
+	Usage
+	Indexes map[string]Usage `json:",omitempty"`
+}
+
+// a running total, and a ring of per-second totals for the rolling window
+type counter struct {
+	total   Units
+	seconds [WINDOW_SECONDS]Units
+	stamps  [WINDOW_SECONDS]int64
+}
+
+func (c *counter) add(u Units, now int64) {
+	c.total.Read += u.Read
+	c.total.Write += u.Write
+	i := now % WINDOW_SECONDS
+	if c.stamps[i] != now {
+		c.stamps[i] = now
+		c.seconds[i] = Units{}
+	}
+	c.seconds[i].Read += u.Read
+	c.seconds[i].Write += u.Write
+}
+
+func (c *counter) usage(now int64) Usage {
+	u := Usage{Total: c.total}
+	for i := range c.seconds {
+		if now-c.stamps[i] < WINDOW_SECONDS {
+			u.LastMinute.Read += c.seconds[i].Read
+			u.LastMinute.Write += c.seconds[i].Write
+		}
+	}
+	return u
+}
+
+type table struct {
+	counter
+	indexes map[string]*counter
+}
+
+var (
+	// the ReturnConsumedCapacity value added to requests. empty if none is added.
+	inject        string
+	tables        map[string]*table
+	capacity_lock sync.RWMutex
+)
+
+func init() {
+	tables = make(map[string]*table)
+}
+
+// Configure sets the ReturnConsumedCapacity value to add to requests that do not set one:
+// TOTAL, INDEXES, or empty to add none. Capacity is still recorded for requests that ask for it.
+func Configure(return_consumed_capacity string) {
+	capacity_lock.Lock()
+	inject = return_consumed_capacity
+	capacity_lock.Unlock()
+}
+
+// operation returns true if the operation named in amzTarget is a write. ok is false
+// if the operation does not report consumed capacity.
+func operation(amzTarget string) (write bool, ok bool) {
+	write, ok = operations[amzTarget[strings.LastIndex(amzTarget, ".")+1:]]
+	return write, ok
+}
+
+// requested returns the ReturnConsumedCapacity value set in reqmap, if any.
+func requested(reqmap map[string]json.RawMessage) string {
+	var rcc string
+	if v, ok := reqmap[RETURN_CONSUMED_CAPACITY]; ok {
+		json.Unmarshal(v, &rcc)
+	}
+	if rcc == RETURN_CONSUMED_CAPACITY_NONE {
+		return ""
+	}
+	return rcc
+}
+
+// Do makes the request bodybytes to amzTarget with fn, adding ReturnConsumedCapacity if
+// configured and not already set. The ConsumedCapacity of a successful response is recorded,
+// and removed from the response if the caller did not ask for it.
+func Do(bodybytes []byte, amzTarget string, fn func([]byte) ([]byte, int, error)) ([]byte, int, error) {
+	write, ok := operation(amzTarget)
+	if !ok {
+		return fn(bodybytes)
+	}
+	capacity_lock.RLock()
+	injecting := inject
+	capacity_lock.RUnlock()
+
+	reqbytes := bodybytes
+	strip := false
+	if injecting != "" {
+		var reqmap map[string]json.RawMessage
+		if um_err := json.Unmarshal(bodybytes, &reqmap); um_err == nil && requested(reqmap) == "" {
+			reqmap[RETURN_CONSUMED_CAPACITY], _ = json.Marshal(injecting)
+			if b, m_err := json.Marshal(reqmap); m_err == nil {
+				reqbytes = b
+				strip = true
+			}
+		}
+	}
+
+	resp_body, code, resp_err := fn(reqbytes)
+	if resp_err != nil || code < 200 || code > 299 {
+		return resp_body, code, resp_err
+	}
+	var respmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+		return resp_body, code, resp_err
+	}
+	cc, found := respmap[CONSUMED_CAPACITY]
+	if !found {
+		return resp_body, code, resp_err
+	}
+	record(cc, write)
+	if strip {
+		delete(respmap, CONSUMED_CAPACITY)
+		if b, m_err := json.Marshal(respmap); m_err == nil {
+			resp_body = b
+		}
+	}
+	return resp_body, code, resp_err
+}
+
+// the units reported in a ConsumedCapacity. ReadCapacityUnits and WriteCapacityUnits
+// are only reported by some operations; otherwise CapacityUnits is attributed according
+// to the operation.
+type reported struct {
+	CapacityUnits      float64
+	ReadCapacityUnits  float64
+	WriteCapacityUnits float64
+}
+
+func (u reported) split(write bool) Units {
+	if u.ReadCapacityUnits != 0 || u.WriteCapacityUnits != 0 {
+		return Units{Read: u.ReadCapacityUnits, Write: u.WriteCapacityUnits}
+	}
+	if write {
+		return Units{Write: u.CapacityUnits}
+	}
+	return Units{Read: u.CapacityUnits}
+}
+
+type consumedCapacity struct {
+	TableName string
+	reported
+	LocalSecondaryIndexes  map[string]reported
+	GlobalSecondaryIndexes map[string]reported
+}
+
+// record adds the ConsumedCapacity cc, which is an object or, for batch operations, an array.
+func record(cc json.RawMessage, write bool) {
+	var ccs []consumedCapacity
+	if um_err := json.Unmarshal(cc, &ccs); um_err != nil {
+		var c consumedCapacity
+		if um_err := json.Unmarshal(cc, &c); um_err != nil {
+			return
+		}
+		ccs = []consumedCapacity{c}
+	}
+	now := time.Now().Unix()
+	capacity_lock.Lock()
+	defer capacity_lock.Unlock()
+	for _, c := range ccs {
+		if c.TableName == "" {
+			continue
+		}
+		t, ok := tables[c.TableName]
+		if !ok {
+			t = &table{indexes: make(map[string]*counter)}
+			tables[c.TableName] = t
+		}
+		t.add(c.split(write), now)
+		for _, indexes := range []map[string]reported{c.LocalSecondaryIndexes, c.GlobalSecondaryIndexes} {
+			for name, u := range indexes {
+				ic, ok := t.indexes[name]
+				if !ok {
+					ic = new(counter)
+					t.indexes[name] = ic
+				}
+				ic.add(u.split(write), now)
+			}
+		}
+	}
+}
+
+// GetUsage returns the capacity consumed by each table.
+func GetUsage() map[string]TableUsage {
+	now := time.Now().Unix()
+	capacity_lock.RLock()
+	defer capacity_lock.RUnlock()
+	usage := make(map[string]TableUsage, len(tables))
+	for name, t := range tables {
+		tu := TableUsage{Usage: t.usage(now)}
+		if len(t.indexes) != 0 {
+			tu.Indexes = make(map[string]Usage, len(t.indexes))
+			for index_name, ic := range t.indexes {
+				tu.Indexes[index_name] = ic.usage(now)
+			}
+		}
+		usage[name] = tu
+	}
+	return usage
+}
+
+// CapacityHandler displays the capacity consumed by each table.
+func CapacityHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	if req.Method != "GET" {
+		e := "method only supports GET"
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	cj, cj_err := json.Marshal(GetUsage())
+	if cj_err != nil {
+		e := fmt.Sprintf("bbpd_capacity.CapacityHandler:marshal err %s", cj_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		cj,
+		http.StatusOK,
+		time.Now(),
+		ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("bbpd_capacity.CapacityHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
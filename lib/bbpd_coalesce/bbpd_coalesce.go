@@ -0,0 +1,61 @@
+// Coalescing of identical concurrent requests. While a request is in flight, identical
+// requests wait for it and share its response rather than each going to Dynamo.
+package bbpd_coalesce
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"sync"
+)
+
+// an in-flight request and, once complete, its result
+type call struct {
+	wg        sync.WaitGroup
+	resp_body []byte
+	code      int
+	err       error
+}
+
+var (
+	calls     map[string]*call
+	calls_mut sync.Mutex
+)
+
+func init() {
+	calls = make(map[string]*call)
+}
+
+// Do calls fn unless a call with the same key is already in flight, in which case it waits
+// for that call and returns its result. The final return value is true if the result
+// was shared with another caller. The response body is shared and must not be modified.
+// If fn panics, the panic is logged and returned as an error to every caller.
+func Do(key string, fn func() ([]byte, int, error)) (resp_body []byte, code int, err error, shared bool) {
+	calls_mut.Lock()
+	if c, ok := calls[key]; ok {
+		calls_mut.Unlock()
+		c.wg.Wait()
+		return c.resp_body, c.code, c.err, true
+	}
+	c := new(call)
+	c.wg.Add(1)
+	calls[key] = c
+	calls_mut.Unlock()
+
+	// the call must be completed even if fn panics, or its waiters would block forever
+	defer func() {
+		if r := recover(); r != nil {
+			e := fmt.Sprintf("bbpd_coalesce.Do:panic calling %s: %v", key, r)
+			bbpd_log.Errorf(e)
+			c.resp_body, c.code, c.err = nil, 0, errors.New(e)
+		}
+		calls_mut.Lock()
+		delete(calls, key)
+		calls_mut.Unlock()
+		c.wg.Done()
+		resp_body, code, err, shared = c.resp_body, c.code, c.err, false
+	}()
+
+	c.resp_body, c.code, c.err = fn()
+	return c.resp_body, c.code, c.err, false
+}
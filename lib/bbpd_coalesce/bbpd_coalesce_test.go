@@ -0,0 +1,100 @@
+package bbpd_coalesce
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitInFlight waits until a call for key is in flight.
+func waitInFlight(t *testing.T, key string) {
+	for i := 0; i < 100; i++ {
+		calls_mut.Lock()
+		_, ok := calls[key]
+		calls_mut.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no call for %s in flight", key)
+}
+
+func TestDoShares(t *testing.T) {
+	release := make(chan bool)
+	n := 0
+	fn := func() ([]byte, int, error) {
+		n++
+		<-release
+		return []byte("{}"), 200, nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, _, _, shared := Do("k", fn); shared {
+			t.Errorf("leader reported a shared result")
+		}
+	}()
+	waitInFlight(t, "k")
+
+	done := make(chan bool)
+	go func() {
+		body, code, err, shared := Do("k", fn)
+		if string(body) != "{}" || code != 200 || err != nil || !shared {
+			t.Errorf("waiter got %s %d %v %v", body, code, err, shared)
+		}
+		done <- true
+	}()
+	// give the waiter time to find the call in flight
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	<-done
+	wg.Wait()
+	if n != 1 {
+		t.Fatalf("fn called %d times, want 1", n)
+	}
+	if _, ok := calls["k"]; ok {
+		t.Fatalf("completed call left in flight")
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	release := make(chan bool)
+	leader := make(chan error)
+	go func() {
+		_, _, err, _ := Do("p", func() ([]byte, int, error) {
+			<-release
+			panic("boom")
+		})
+		leader <- err
+	}()
+	waitInFlight(t, "p")
+
+	waiter := make(chan error)
+	go func() {
+		_, _, err, _ := Do("p", func() ([]byte, int, error) {
+			return []byte("{}"), 200, nil
+		})
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if err := <-leader; err == nil {
+		t.Fatalf("leader got no error from the panic")
+	}
+	select {
+	case <-waiter:
+	case <-time.After(time.Second):
+		t.Fatalf("waiter still blocked after the leader panicked")
+	}
+
+	// later calls are not blocked by the panicked one
+	body, _, err, shared := Do("p", func() ([]byte, int, error) {
+		return []byte("{}"), 200, nil
+	})
+	if err != nil || shared || string(body) != "{}" {
+		t.Fatalf("later call got %s %v %v", body, err, shared)
+	}
+}
@@ -0,0 +1,263 @@
+// Configuration for bbpd itself, as distinct from the GoDynamo configuration read
+// by conf_file. The bbpd configuration is optional; if no file is found, every
+// optional feature is left disabled.
+package bbpd_conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	CONF_FILE_NAME = "bbpd-config.json"
+	ETC_CONF_FILE  = "/etc/" + CONF_FILE_NAME
+)
+
+// Cache_Conf configures the GetItem/BatchGetItem read-through cache.
+type Cache_Conf struct {
+	// the maximum number of items held. 0 disables the cache.
+	Size int
+	// how long an item may be served from the cache. 0 is bbpd_cache.DEFAULT_TTL.
+	TTLSeconds int
+}
+
+// Batch_Conf configures the batching of GetItem requests into BatchGetItem requests.
+type Batch_Conf struct {
+	// how long to collect GetItem requests before sending them. 0 disables batching.
+	WindowMillis int
+}
+
+// WriteBehind_Conf configures asynchronous PutItem requests.
+type WriteBehind_Conf struct {
+	// the maximum number of queued Items. 0 disables write-behind.
+	QueueSize int
+	// how often a partial batch is written. defaults to 100ms.
+	FlushMillis int
+}
+
+// Spool_Conf configures the store-and-forward spool for writes.
+type Spool_Conf struct {
+	// the directory holding the spool log. empty disables the spool.
+	Dir string
+	// how long startup waits for spooled writes to be replayed. defaults to 30s.
+	ReplayTimeoutSeconds int
+}
+
+// Capacity_Conf configures consumed capacity accounting.
+type Capacity_Conf struct {
+	// TOTAL or INDEXES to add ReturnConsumedCapacity to requests that do not set it.
+	// empty adds none.
+	ReturnConsumedCapacity string
+}
+
+// TableLimit_Conf sets the token-bucket limits for a table. A rate of 0 is unlimited.
+type TableLimit_Conf struct {
+	ReadsPerSecond  float64
+	ReadBurst       float64
+	WritesPerSecond float64
+	WriteBurst      float64
+	// when callers are limited separately, the limits of all callers together. 0 is the
+	// limit of one caller.
+	TotalReadsPerSecond  float64
+	TotalReadBurst       float64
+	TotalWritesPerSecond float64
+	TotalWriteBurst      float64
+}
+
+// RateLimit_Conf configures rate limiting of reads and writes.
+type RateLimit_Conf struct {
+	// if set, callers are limited separately, each known by the value of this request header,
+	// or by its client name if authentication is enabled
+	IdentityHeader string
+	// how long a request may wait for tokens before it is rejected. 0 rejects at once.
+	MaxWaitMillis int
+	// limits by table name. "*" applies to tables without their own entry.
+	Tables map[string]TableLimit_Conf
+}
+
+// Adaptive_Conf configures the adaptive limit on concurrent requests to each table.
+type Adaptive_Conf struct {
+	// the most concurrent requests to a table. 0 disables the limit.
+	MaxConcurrency int
+	// the fewest concurrent requests to a table. defaults to 1.
+	MinConcurrency int
+	// the limit of a table before any requests are made. defaults to MaxConcurrency.
+	InitialConcurrency int
+	// what the limit is multiplied by when a request is throttled. defaults to 0.5.
+	Backoff float64
+	// how long a request may wait to start before it is throttled. defaults to 1s.
+	MaxWaitMillis int
+}
+
+// TypeHints_Conf configures the lossless coercion of basic JSON.
+type TypeHints_Conf struct {
+	// use the lossless coercion in the JSON endpoints.
+	Enabled bool
+	// learn the types of key attributes from DescribeTable.
+	LearnKeySchema bool
+	// the AttributeValue type of attributes, by table and attribute name or dotted path.
+	Tables map[string]map[string]string
+}
+
+// Listen_Conf configures where bbpd listens. If neither Addresses nor Socket is set, bbpd
+// listens on the first free default port on all interfaces.
+type Listen_Conf struct {
+	// host:port TCP addresses to listen on. an address already in use is skipped.
+	Addresses []string
+	// the path of a Unix domain socket to listen on. empty disables it.
+	Socket string
+	// the octal permissions of the socket file. defaults to 0660.
+	SocketMode string
+}
+
+// TLS_Conf configures HTTPS on the TCP listeners.
+type TLS_Conf struct {
+	// the PEM certificate (chain) and key files. an empty CertFile disables TLS.
+	CertFile string
+	KeyFile  string
+	// a PEM bundle of the CAs that client certificates must be signed by. if set, clients
+	// must present a certificate.
+	ClientCAFile string
+}
+
+// Auth_Conf configures the authentication and authorization of clients.
+type Auth_Conf struct {
+	// the policy file mapping clients to the operations and tables they may use. empty
+	// disables authentication.
+	PolicyFile string
+}
+
+// DeleteTable_Conf configures which tables DeleteTable may delete.
+type DeleteTable_Conf struct {
+	// patterns, as matched by path.Match, of the tables that may be deleted. empty disables
+	// DeleteTable.
+	Tables []string
+	// require a dry run of each deletion, returning DescribeTable output, shortly before it.
+	RequireDryRun bool
+	// how long a dry run allows the deletion. defaults to 300s.
+	DryRunWindowSeconds int
+}
+
+// Admin_Conf configures where the admin endpoints are served. If neither Address nor Socket
+// is set, they are not served.
+type Admin_Conf struct {
+	// a host:port TCP address. it should not be reachable by untrusted clients.
+	Address string
+	// the path of a Unix domain socket.
+	Socket string
+	// the octal permissions of the socket file. defaults to 0660.
+	SocketMode string
+}
+
+type BBPD_Conf struct {
+	Initialized bool
+	// the file the configuration was read from, if any
+	Path  string
+	Cache Cache_Conf
+	// share one upstream call among identical concurrent reads
+	CoalesceReads   bool
+	GetItemBatching Batch_Conf
+	WriteBehind     WriteBehind_Conf
+	Spool           Spool_Conf
+	Capacity        Capacity_Conf
+	RateLimit       RateLimit_Conf
+	Adaptive        Adaptive_Conf
+	TypeHints       TypeHints_Conf
+	Listen          Listen_Conf
+	TLS             TLS_Conf
+	Auth            Auth_Conf
+	DeleteTable     DeleteTable_Conf
+	// refuse writes and table changes
+	ReadOnly bool
+	// one of debug, info, error or off. defaults to info.
+	LogLevel string
+	Admin    Admin_Conf
+	ConfLock sync.RWMutex
+}
+
+// Vals is the global bbpd configuration.
+var Vals BBPD_Conf
+
+// the subset of BBPD_Conf that is read from the file
+type conf_file struct {
+	Cache           Cache_Conf
+	CoalesceReads   bool
+	GetItemBatching Batch_Conf
+	WriteBehind     WriteBehind_Conf
+	Spool           Spool_Conf
+	Capacity        Capacity_Conf
+	RateLimit       RateLimit_Conf
+	Adaptive        Adaptive_Conf
+	TypeHints       TypeHints_Conf
+	Listen          Listen_Conf
+	TLS             TLS_Conf
+	Auth            Auth_Conf
+	DeleteTable     DeleteTable_Conf
+	ReadOnly        bool
+	LogLevel        string
+	Admin           Admin_Conf
+}
+
+// Read loads the configuration. If path is empty, $HOME/.bbpd-config.json and
+// /etc/bbpd-config.json are tried in that order, and it is not an error if neither
+// exists. If path is set, it must exist.
+func Read(path string) error {
+	if path == "" {
+		home := os.Getenv("HOME")
+		for _, p := range []string{filepath.Join(home, "."+CONF_FILE_NAME), ETC_CONF_FILE} {
+			if _, stat_err := os.Stat(p); stat_err == nil {
+				path = p
+				break
+			}
+		}
+	}
+	var cf conf_file
+	if path == "" {
+		bbpd_log.Infof("bbpd_conf.Read:no %s found, using defaults", CONF_FILE_NAME)
+	} else {
+		conf_bytes, read_err := ioutil.ReadFile(path)
+		if read_err != nil {
+			e := fmt.Sprintf("bbpd_conf.Read:cannot read %s: %s", path, read_err.Error())
+			return errors.New(e)
+		}
+		um_err := json.Unmarshal(conf_bytes, &cf)
+		if um_err != nil {
+			e := fmt.Sprintf("bbpd_conf.Read:cannot parse %s: %s", path, um_err.Error())
+			return errors.New(e)
+		}
+		switch cf.Capacity.ReturnConsumedCapacity {
+		case "", "NONE", "TOTAL", "INDEXES":
+		default:
+			e := fmt.Sprintf("bbpd_conf.Read:%s: Capacity.ReturnConsumedCapacity must be TOTAL or INDEXES", path)
+			return errors.New(e)
+		}
+		bbpd_log.Infof("bbpd_conf.Read:read %s", path)
+	}
+	Vals.ConfLock.Lock()
+	Vals.Path = path
+	Vals.Cache = cf.Cache
+	Vals.CoalesceReads = cf.CoalesceReads
+	Vals.GetItemBatching = cf.GetItemBatching
+	Vals.WriteBehind = cf.WriteBehind
+	Vals.Spool = cf.Spool
+	Vals.Capacity = cf.Capacity
+	Vals.RateLimit = cf.RateLimit
+	Vals.Adaptive = cf.Adaptive
+	Vals.TypeHints = cf.TypeHints
+	Vals.Listen = cf.Listen
+	Vals.TLS = cf.TLS
+	Vals.Auth = cf.Auth
+	Vals.DeleteTable = cf.DeleteTable
+	Vals.ReadOnly = cf.ReadOnly
+	Vals.LogLevel = cf.LogLevel
+	Vals.Admin = cf.Admin
+	Vals.Initialized = true
+	Vals.ConfLock.Unlock()
+	return nil
+}
@@ -9,6 +9,9 @@ const (
 	CONTENTTYPE   = "Content-Type"
 	CONTENTLENGTH = "Content-Length"
 	JSONMIME      = "application/json"
+	AMZJSONMIME   = "application/x-amz-json-1.0"
+	NDJSONMIME    = "application/x-ndjson"
+	TRAILER       = "Trailer"
 	PORT          = 12333 // primary port
 	PORT2         = 12334 // secondary
 	LOCALHOST     = "localhost"
@@ -16,4 +19,32 @@ const (
 	// request headers specific to bbpd
 	X_BBPD_VERBOSE = "X-Bbpd-Verbose"
 	X_BBPD_INDENT  = "X-Bbpd-Indent"
+
+	// request headers that enable server-side pagination of Query and Scan
+	X_BBPD_PAGINATE  = "X-Bbpd-Paginate"
+	X_BBPD_MAX_ITEMS = "X-Bbpd-Max-Items"
+	X_BBPD_MAX_PAGES = "X-Bbpd-Max-Pages"
+
+	// request header that streams Query and Scan results as newline-delimited JSON
+	X_BBPD_STREAM = "X-Bbpd-Stream"
+
+	// request header that bounds the number of segments scanned at once by ParallelScan
+	X_BBPD_CONCURRENCY = "X-Bbpd-Concurrency"
+
+	// request header that queues a PutItem for write-behind
+	X_BBPD_ASYNC = "X-Bbpd-Async"
+
+	// request header that carries the API key of the client, if a policy file is configured
+	X_BBPD_API_KEY = "X-Bbpd-Api-Key"
+
+	// request headers that confirm a DeleteTable by naming the table, or ask for a dry run
+	X_BBPD_CONFIRM_DELETE = "X-Bbpd-Confirm-Delete"
+	X_BBPD_DRY_RUN        = "X-Bbpd-Dry-Run"
+
+	// trailers set at the end of a streamed response
+	X_BBPD_COUNT              = "X-Bbpd-Count"
+	X_BBPD_SCANNED_COUNT      = "X-Bbpd-Scanned-Count"
+	X_BBPD_LAST_EVALUATED_KEY = "X-Bbpd-Last-Evaluated-Key"
+	X_BBPD_STREAM_ERROR       = "X-Bbpd-Stream-Error"
+	X_BBPD_SEGMENTS           = "X-Bbpd-Segments"
 )
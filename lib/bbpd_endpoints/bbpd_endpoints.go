@@ -0,0 +1,40 @@
+// Names of the DynamoDB operations added since GoDynamo's endpoint packages were written.
+// bbpd relays requests for these operations to DynamoDB without validating them, so only
+// their names and targets are needed.
+package bbpd_endpoints
+
+import (
+	"github.com/smugmug/godynamo/aws_const"
+)
+
+const (
+	TRANSACT_WRITE_ITEMS        = "TransactWriteItems"
+	TRANSACT_GET_ITEMS          = "TransactGetItems"
+	EXECUTE_STATEMENT           = "ExecuteStatement"
+	BATCH_EXECUTE_STATEMENT     = "BatchExecuteStatement"
+	DESCRIBE_TIME_TO_LIVE       = "DescribeTimeToLive"
+	UPDATE_TIME_TO_LIVE         = "UpdateTimeToLive"
+	TAG_RESOURCE                = "TagResource"
+	UNTAG_RESOURCE              = "UntagResource"
+	LIST_TAGS_OF_RESOURCE       = "ListTagsOfResource"
+	DESCRIBE_LIMITS             = "DescribeLimits"
+	CREATE_BACKUP               = "CreateBackup"
+	DESCRIBE_BACKUP             = "DescribeBackup"
+	LIST_BACKUPS                = "ListBackups"
+	DELETE_BACKUP               = "DeleteBackup"
+	RESTORE_TABLE_FROM_BACKUP   = "RestoreTableFromBackup"
+	RESTORE_TABLE_TO_POINT      = "RestoreTableToPointInTime"
+	DESCRIBE_CONTINUOUS_BACKUPS = "DescribeContinuousBackups"
+	UPDATE_CONTINUOUS_BACKUPS   = "UpdateContinuousBackups"
+
+	TARGET_PREFIX                  = aws_const.CURRENT_API_VERSION + "."
+	TRANSACTWRITEITEMS_ENDPOINT    = TARGET_PREFIX + TRANSACT_WRITE_ITEMS
+	TRANSACTGETITEMS_ENDPOINT      = TARGET_PREFIX + TRANSACT_GET_ITEMS
+	EXECUTESTATEMENT_ENDPOINT      = TARGET_PREFIX + EXECUTE_STATEMENT
+	BATCHEXECUTESTATEMENT_ENDPOINT = TARGET_PREFIX + BATCH_EXECUTE_STATEMENT
+)
+
+// Target returns the X-Amz-Target of the operation named op.
+func Target(op string) string {
+	return TARGET_PREFIX + op
+}
@@ -0,0 +1,226 @@
+// Per-table type hints for the lossless coercion of basic JSON to AttributeValues.
+// Basic JSON cannot say whether a string is binary, so a hint names the AttributeValue type
+// of an attribute (or of a member of a map attribute, by its dotted path). Hints are
+// configured per table, and may also be learned from the AttributeDefinitions that
+// DescribeTable reports for the key attributes of a table and its indexes. Configured hints
+// take precedence over learned ones.
+package bbpd_hints
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	ep "github.com/smugmug/godynamo/endpoint"
+	desc "github.com/smugmug/godynamo/endpoints/describe_table"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// how long to wait before asking DescribeTable again about a table it failed to describe
+	LEARN_RETRY = time.Minute
+)
+
+// the AttributeValue types a hint may name
+var types = map[string]bool{
+	"S":    true,
+	"N":    true,
+	"B":    true,
+	"BOOL": true,
+	"NULL": true,
+	"SS":   true,
+	"NS":   true,
+	"BS":   true,
+	"L":    true,
+	"M":    true,
+}
+
+// State reports the hints in force for one table.
+type State struct {
+	Table   string
+	Hints   map[string]string
+	Learned bool
+}
+
+var (
+	enabled      bool
+	learn        bool
+	configured   map[string]map[string]string
+	learned      map[string]map[string]string
+	learn_failed map[string]time.Time
+	// the tables being learned, each with a channel closed when it has been
+	learning  map[string]chan bool
+	hints_mut sync.RWMutex
+)
+
+func init() {
+	Configure(false, false, nil)
+}
+
+// Configure enables lossless coercion, and sets the hints for each table. If learn_keys is
+// set, hints for key attributes are learned from DescribeTable. Hints naming an unknown
+// type are logged and ignored. Any learned hints are discarded.
+func Configure(lossless bool, learn_keys bool, tables map[string]map[string]string) {
+	c := make(map[string]map[string]string)
+	for table, hints := range tables {
+		c[table] = make(map[string]string)
+		for path, t := range hints {
+			if !types[t] {
+				bbpd_log.Errorf("bbpd_hints.Configure:ignoring hint %s for %s.%s: not an AttributeValue type", t, table, path)
+				continue
+			}
+			c[table][path] = t
+		}
+	}
+	hints_mut.Lock()
+	enabled = lossless
+	learn = learn_keys
+	configured = c
+	learned = make(map[string]map[string]string)
+	learn_failed = make(map[string]time.Time)
+	learning = make(map[string]chan bool)
+	hints_mut.Unlock()
+}
+
+// Enabled returns true if lossless coercion is configured.
+func Enabled() bool {
+	hints_mut.RLock()
+	defer hints_mut.RUnlock()
+	return enabled
+}
+
+// Hints returns the type hints for table, keyed by attribute name or dotted path, learning
+// them from DescribeTable first if that is configured and has not been done. Only one request
+// learns a table at a time; others wait for it. It returns nil if lossless coercion is not
+// configured or there are no hints for the table.
+func Hints(table string) map[string]string {
+	if table == "" {
+		return nil
+	}
+	hints_mut.RLock()
+	if !enabled {
+		hints_mut.RUnlock()
+		return nil
+	}
+	must_learn := mustLearn(table)
+	hints_mut.RUnlock()
+
+	if must_learn {
+		hints_mut.Lock()
+		// another request may have learned the table, or begun to, since
+		must_learn = mustLearn(table)
+		done, in_flight := learning[table]
+		if must_learn && !in_flight {
+			done = make(chan bool)
+			learning[table] = done
+		}
+		hints_mut.Unlock()
+		if in_flight {
+			<-done
+		} else if must_learn {
+			l, l_err := describe(table)
+			hints_mut.Lock()
+			if l_err != nil {
+				bbpd_log.Errorf("bbpd_hints.Hints:cannot learn hints for %s: %s", table, l_err.Error())
+				learn_failed[table] = time.Now()
+			} else {
+				learned[table] = l
+				delete(learn_failed, table)
+			}
+			delete(learning, table)
+			close(done)
+			hints_mut.Unlock()
+		}
+	}
+
+	hints_mut.RLock()
+	defer hints_mut.RUnlock()
+	if len(learned[table]) == 0 && len(configured[table]) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(learned[table])+len(configured[table]))
+	for path, t := range learned[table] {
+		merged[path] = t
+	}
+	for path, t := range configured[table] {
+		merged[path] = t
+	}
+	return merged
+}
+
+// mustLearn returns true if the hints for table should be learned from DescribeTable, as they
+// have not been, and it has not failed to describe the table recently. hints_mut must be held.
+func mustLearn(table string) bool {
+	if !learn {
+		return false
+	}
+	if _, learned_ok := learned[table]; learned_ok {
+		return false
+	}
+	failed, failed_ok := learn_failed[table]
+	return !failed_ok || time.Since(failed) > LEARN_RETRY
+}
+
+// the part of a DescribeTable response that names the types of key attributes
+type describeResponse struct {
+	Table struct {
+		AttributeDefinitions []struct {
+			AttributeName string
+			AttributeType string
+		}
+	}
+}
+
+// describe asks DynamoDB for the types of the key attributes of table.
+func describe(table string) (map[string]string, error) {
+	reqbytes, m_err := json.Marshal(map[string]string{"TableName": table})
+	if m_err != nil {
+		return nil, m_err
+	}
+	resp_body, code, resp_err := raw.Req(reqbytes, desc.DESCTABLE_ENDPOINT)
+	if resp_err != nil {
+		return nil, resp_err
+	}
+	if ep.HttpErr(code) {
+		return nil, fmt.Errorf("http err %d %s", code, string(resp_body))
+	}
+	var resp describeResponse
+	if um_err := json.Unmarshal(resp_body, &resp); um_err != nil {
+		return nil, um_err
+	}
+	l := make(map[string]string)
+	for _, def := range resp.Table.AttributeDefinitions {
+		if types[def.AttributeType] {
+			l[def.AttributeName] = def.AttributeType
+		}
+	}
+	return l, nil
+}
+
+// GetState returns the hints for each table that has them, sorted by table, with configured
+// hints before learned ones.
+func GetState() []State {
+	hints_mut.RLock()
+	defer hints_mut.RUnlock()
+	state := make([]State, 0)
+	if !enabled {
+		return state
+	}
+	for table, hints := range configured {
+		state = append(state, State{Table: table, Hints: hints})
+	}
+	for table, hints := range learned {
+		if len(hints) != 0 {
+			state = append(state, State{Table: table, Hints: hints, Learned: true})
+		}
+	}
+	sort.Slice(state, func(i, j int) bool {
+		if state[i].Table != state[j].Table {
+			return state[i].Table < state[j].Table
+		}
+		return !state[i].Learned && state[j].Learned
+	})
+	return state
+}
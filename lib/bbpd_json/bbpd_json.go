@@ -0,0 +1,714 @@
+// Coercion of multi-item responses (Query, Scan) and their Items to basic JSON, and of the
+// Items, Keys and attribute values in requests from basic JSON.
+// By default the coercion is GoDynamo's, which is lossy. If lossless coercion is configured
+// (see bbpd_hints), numbers keep their precision, B and BS are given as base64 strings, NULL
+// is given as null, and the type hints of each table decide the types of its attributes.
+package bbpd_json
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_hints"
+	"github.com/smugmug/godynamo/types/attributevalue"
+	"regexp"
+)
+
+// ItemsResponse is the common shape of a Query or Scan response.
+type ItemsResponse struct {
+	Items            []attributevalue.AttributeValueMap
+	Count            uint64
+	ScannedCount     uint64
+	LastEvaluatedKey attributevalue.AttributeValueMap `json:",omitempty"`
+	ConsumedCapacity json.RawMessage                  `json:",omitempty"`
+}
+
+// ItemsResponseJSON is an ItemsResponse with Items and LastEvaluatedKey
+// coerced to basic JSON.
+type ItemsResponseJSON struct {
+	Items            []interface{}
+	Count            uint64
+	ScannedCount     uint64
+	LastEvaluatedKey interface{}     `json:",omitempty"`
+	ConsumedCapacity json.RawMessage `json:",omitempty"`
+}
+
+func NewItemsResponse() *ItemsResponse {
+	r := new(ItemsResponse)
+	r.Items = make([]attributevalue.AttributeValueMap, 0)
+	return r
+}
+
+func NewItemsResponseJSON() *ItemsResponseJSON {
+	r := new(ItemsResponseJSON)
+	r.Items = make([]interface{}, 0)
+	return r
+}
+
+// ToItemsResponseJSON translates each Item and the LastEvaluatedKey to basic JSON.
+func (resp *ItemsResponse) ToItemsResponseJSON() (*ItemsResponseJSON, error) {
+	resp_json := NewItemsResponseJSON()
+	for _, item := range resp.Items {
+		c, cerr := item.ToInterface()
+		if cerr != nil {
+			return nil, cerr
+		}
+		resp_json.Items = append(resp_json.Items, c)
+	}
+	if len(resp.LastEvaluatedKey) != 0 {
+		c, cerr := resp.LastEvaluatedKey.ToInterface()
+		if cerr != nil {
+			return nil, cerr
+		}
+		resp_json.LastEvaluatedKey = c
+	}
+	resp_json.Count = resp.Count
+	resp_json.ScannedCount = resp.ScannedCount
+	resp_json.ConsumedCapacity = resp.ConsumedCapacity
+	return resp_json, nil
+}
+
+// ItemToJSON coerces a single serialized AttributeValue map to serialized basic JSON.
+// If lossless coercion is configured, it is used instead.
+func ItemToJSON(item_body []byte) ([]byte, error) {
+	if bbpd_hints.Enabled() {
+		var m map[string]map[string]json.RawMessage
+		if um_err := json.Unmarshal(item_body, &m); um_err != nil {
+			return nil, um_err
+		}
+		c, cerr := losslessMapToJSON(m)
+		if cerr != nil {
+			return nil, cerr
+		}
+		return json.Marshal(c)
+	}
+	item := attributevalue.NewAttributeValueMap()
+	um_err := json.Unmarshal(item_body, &item)
+	if um_err != nil {
+		return nil, um_err
+	}
+	c, cerr := item.ToInterface()
+	if cerr != nil {
+		return nil, cerr
+	}
+	return json.Marshal(c)
+}
+
+// ItemsResponseToJSON is a convenience function that unmarshals a Query or Scan
+// response body, coerces it to basic JSON, and returns the serialized result.
+// If lossless coercion is configured, each Item and the LastEvaluatedKey are coerced
+// with ItemToJSON, and the other fields are returned as they are.
+func ItemsResponseToJSON(resp_body []byte) ([]byte, error) {
+	if bbpd_hints.Enabled() {
+		var respmap map[string]json.RawMessage
+		if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+			return nil, um_err
+		}
+		items_body, c_err := itemsToJSON(respmap["Items"])
+		if c_err != nil {
+			return nil, c_err
+		}
+		respmap["Items"] = items_body
+		if !isNull(respmap["LastEvaluatedKey"]) {
+			if c_err := FieldsToJSON(respmap, "LastEvaluatedKey"); c_err != nil {
+				return nil, c_err
+			}
+		}
+		return json.Marshal(respmap)
+	}
+	resp := NewItemsResponse()
+	um_err := json.Unmarshal(resp_body, resp)
+	if um_err != nil {
+		return nil, um_err
+	}
+	resp_json, rerr := resp.ToItemsResponseJSON()
+	if rerr != nil {
+		return nil, rerr
+	}
+	return json.Marshal(resp_json)
+}
+
+// itemsToJSON coerces each of the list of Items items_body with ItemToJSON.
+func itemsToJSON(items_body json.RawMessage) (json.RawMessage, error) {
+	items := make([]json.RawMessage, 0)
+	if !isNull(items_body) {
+		if um_err := json.Unmarshal(items_body, &items); um_err != nil {
+			return nil, um_err
+		}
+	}
+	for i, item := range items {
+		c, c_err := ItemToJSON(item)
+		if c_err != nil {
+			return nil, c_err
+		}
+		items[i] = c
+	}
+	return json.Marshal(items)
+}
+
+// BatchGetResponseToJSON is a convenience function that unmarshals a BatchGetItem response
+// body, coerces the Items of each table in its Responses to basic JSON, and returns the
+// serialized result.
+func BatchGetResponseToJSON(resp_body []byte) ([]byte, error) {
+	var respmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+		return nil, um_err
+	}
+	var responses map[string]json.RawMessage
+	if !isNull(respmap["Responses"]) {
+		if um_err := json.Unmarshal(respmap["Responses"], &responses); um_err != nil {
+			return nil, um_err
+		}
+	}
+	for table, items_body := range responses {
+		c, c_err := itemsToJSON(items_body)
+		if c_err != nil {
+			return nil, fmt.Errorf("%s: %s", table, c_err.Error())
+		}
+		responses[table] = c
+	}
+	if responses != nil {
+		b, m_err := json.Marshal(responses)
+		if m_err != nil {
+			return nil, m_err
+		}
+		respmap["Responses"] = b
+	}
+	return json.Marshal(respmap)
+}
+
+// FieldsToJSON coerces each of the named fields of the response respmap that is present from
+// an AttributeValue map to a basic JSON object.
+func FieldsToJSON(respmap map[string]json.RawMessage, fields ...string) error {
+	for _, field := range fields {
+		v, ok := respmap[field]
+		if !ok {
+			continue
+		}
+		c, c_err := ItemToJSON(v)
+		if c_err != nil {
+			return fmt.Errorf("%s: %s", field, c_err.Error())
+		}
+		respmap[field] = c
+	}
+	return nil
+}
+
+// ResponseToJSON is a convenience function that unmarshals a response body, coerces each of
+// the named fields that is present with FieldsToJSON, and returns the serialized result.
+func ResponseToJSON(resp_body []byte, fields ...string) ([]byte, error) {
+	var respmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+		return nil, um_err
+	}
+	if c_err := FieldsToJSON(respmap, fields...); c_err != nil {
+		return nil, c_err
+	}
+	return json.Marshal(respmap)
+}
+
+// RequestFromJSON is a convenience function that unmarshals a request body, coerces it with
+// RequestMapFromJSON, and returns the serialized result.
+func RequestFromJSON(bodybytes []byte) ([]byte, error) {
+	var reqmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(bodybytes, &reqmap); um_err != nil {
+		return nil, um_err
+	}
+	if c_err := RequestMapFromJSON(reqmap); c_err != nil {
+		return nil, c_err
+	}
+	return json.Marshal(reqmap)
+}
+
+// RequestMapFromJSON coerces every AttributeValue-bearing field of the request reqmap from
+// basic JSON: Item, Key, Keys, ExclusiveStartKey, ExpressionAttributeValues, the Value and
+// AttributeValueList of the conditions in Expected, KeyConditions, QueryFilter and ScanFilter,
+// the Value of each of the AttributeUpdates, and these fields within RequestItems and
+// TransactItems.
+// An Item is always taken to be basic JSON. Any other attribute value that is already an
+// AttributeValue is left as it is, as those fields were once only accepted in that form.
+// If lossless coercion is configured, the type hints of the table are applied.
+func RequestMapFromJSON(reqmap map[string]json.RawMessage) error {
+	return requestMapFromJSON(reqmap, "")
+}
+
+// requestMapFromJSON coerces reqmap as RequestMapFromJSON, taking its table to be the one
+// named by its TableName, or table if it has none.
+func requestMapFromJSON(reqmap map[string]json.RawMessage, table string) error {
+	if v, ok := reqmap["TableName"]; ok {
+		json.Unmarshal(v, &table)
+	}
+	hints := bbpd_hints.Hints(table)
+	for field, v := range reqmap {
+		if isNull(v) {
+			continue
+		}
+		var c json.RawMessage
+		var c_err error
+		switch field {
+		case "Item":
+			c, c_err = itemFromJSON(v, hints)
+		case "Key", "ExclusiveStartKey":
+			c, c_err = valuesFromJSON(v, hints)
+		case "ExpressionAttributeValues":
+			// placeholders do not name attributes, so no hints apply
+			c, c_err = valuesFromJSON(v, nil)
+		case "Keys":
+			c, c_err = keysFromJSON(v, hints)
+		case "Expected", "KeyConditions", "QueryFilter", "ScanFilter", "AttributeUpdates":
+			c, c_err = conditionsFromJSON(v, hints)
+		case "RequestItems":
+			c, c_err = requestItemsFromJSON(v)
+		case "TransactItems":
+			c, c_err = transactItemsFromJSON(v)
+		default:
+			continue
+		}
+		if c_err != nil {
+			return fmt.Errorf("%s: %s", field, c_err.Error())
+		}
+		reqmap[field] = c
+	}
+	return nil
+}
+
+// the members an AttributeValue may have, with the JSON kind of their values
+var attribute_value_kinds = map[string]byte{
+	"S":    '"',
+	"N":    '"',
+	"B":    '"',
+	"BOOL": 'b',
+	"NULL": 'b',
+	"SS":   '[',
+	"NS":   '[',
+	"BS":   '[',
+	"L":    '[',
+	"M":    '{',
+}
+
+func isNull(v json.RawMessage) bool {
+	return len(v) == 0 || string(v) == "null"
+}
+
+// isAttributeValue reports whether v is already an AttributeValue: an object with a single
+// member named for an AttributeValue type, holding a value of the kind that type takes.
+func isAttributeValue(v json.RawMessage) bool {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(v, &m) != nil || len(m) != 1 {
+		return false
+	}
+	for k, mv := range m {
+		kind, ok := attribute_value_kinds[k]
+		if !ok || len(mv) == 0 {
+			return false
+		}
+		if kind == 'b' {
+			return string(mv) == "true" || string(mv) == "false"
+		}
+		return mv[0] == kind
+	}
+	return false
+}
+
+// decode unmarshals v, keeping numbers as json.Number so that no precision is lost.
+func decode(v json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(v))
+	d.UseNumber()
+	var i interface{}
+	if d_err := d.Decode(&i); d_err != nil {
+		return nil, d_err
+	}
+	return i, nil
+}
+
+// valueFromJSON coerces v, the value of the attribute at path, from a basic JSON value to an
+// AttributeValue, unless it is one already.
+func valueFromJSON(v json.RawMessage, hints map[string]string, path string) (json.RawMessage, error) {
+	if isAttributeValue(v) {
+		return v, nil
+	}
+	if bbpd_hints.Enabled() {
+		i, d_err := decode(v)
+		if d_err != nil {
+			return nil, d_err
+		}
+		av, cerr := losslessFromJSON(i, hints[path], hints, path)
+		if cerr != nil {
+			return nil, cerr
+		}
+		return json.Marshal(av)
+	}
+	var i interface{}
+	if um_err := json.Unmarshal(v, &i); um_err != nil {
+		return nil, um_err
+	}
+	av, cerr := attributevalue.InterfaceToAttributeValue(i)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return json.Marshal(av)
+}
+
+// valuesFromJSON coerces each member of the object v with valueFromJSON.
+func valuesFromJSON(v json.RawMessage, hints map[string]string) (json.RawMessage, error) {
+	var m map[string]json.RawMessage
+	if um_err := json.Unmarshal(v, &m); um_err != nil {
+		return nil, um_err
+	}
+	for k, mv := range m {
+		c, c_err := valueFromJSON(mv, hints, k)
+		if c_err != nil {
+			return nil, fmt.Errorf("%s: %s", k, c_err.Error())
+		}
+		m[k] = c
+	}
+	return json.Marshal(m)
+}
+
+// itemFromJSON coerces the basic JSON object v to an AttributeValue map.
+func itemFromJSON(v json.RawMessage, hints map[string]string) (json.RawMessage, error) {
+	if bbpd_hints.Enabled() {
+		i, d_err := decode(v)
+		if d_err != nil {
+			return nil, d_err
+		}
+		m, ok := i.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("not an object: %s", string(v))
+		}
+		av := make(map[string]interface{}, len(m))
+		for k, mv := range m {
+			c, cerr := losslessFromJSON(mv, hints[k], hints, k)
+			if cerr != nil {
+				return nil, cerr
+			}
+			av[k] = c
+		}
+		return json.Marshal(av)
+	}
+	var i interface{}
+	if um_err := json.Unmarshal(v, &i); um_err != nil {
+		return nil, um_err
+	}
+	av, cerr := attributevalue.InterfaceToAttributeValueMap(i)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return json.Marshal(av)
+}
+
+// keysFromJSON coerces each of the list of Keys v with valuesFromJSON.
+func keysFromJSON(v json.RawMessage, hints map[string]string) (json.RawMessage, error) {
+	var keys []json.RawMessage
+	if um_err := json.Unmarshal(v, &keys); um_err != nil {
+		return nil, um_err
+	}
+	for i, key := range keys {
+		c, c_err := valuesFromJSON(key, hints)
+		if c_err != nil {
+			return nil, c_err
+		}
+		keys[i] = c
+	}
+	return json.Marshal(keys)
+}
+
+// conditionsFromJSON coerces the Value and each of the AttributeValueList of every condition
+// (or attribute update) in the object v.
+func conditionsFromJSON(v json.RawMessage, hints map[string]string) (json.RawMessage, error) {
+	var conditions map[string]map[string]json.RawMessage
+	if um_err := json.Unmarshal(v, &conditions); um_err != nil {
+		return nil, um_err
+	}
+	for name, condition := range conditions {
+		if value, ok := condition["Value"]; ok && !isNull(value) {
+			c, c_err := valueFromJSON(value, hints, name)
+			if c_err != nil {
+				return nil, fmt.Errorf("%s: %s", name, c_err.Error())
+			}
+			condition["Value"] = c
+		}
+		if list, ok := condition["AttributeValueList"]; ok && !isNull(list) {
+			var values []json.RawMessage
+			if um_err := json.Unmarshal(list, &values); um_err != nil {
+				return nil, fmt.Errorf("%s: %s", name, um_err.Error())
+			}
+			for i, value := range values {
+				c, c_err := valueFromJSON(value, hints, name)
+				if c_err != nil {
+					return nil, fmt.Errorf("%s: %s", name, c_err.Error())
+				}
+				values[i] = c
+			}
+			b, m_err := json.Marshal(values)
+			if m_err != nil {
+				return nil, m_err
+			}
+			condition["AttributeValueList"] = b
+		}
+	}
+	return json.Marshal(conditions)
+}
+
+// requestItemsFromJSON coerces the RequestItems of a BatchGetItem request, which map each
+// table to its Keys, or of a BatchWriteItem request, which map each table to a list of
+// PutRequests and DeleteRequests.
+func requestItemsFromJSON(v json.RawMessage) (json.RawMessage, error) {
+	var tables map[string]json.RawMessage
+	if um_err := json.Unmarshal(v, &tables); um_err != nil {
+		return nil, um_err
+	}
+	for table, table_v := range tables {
+		var c json.RawMessage
+		var c_err error
+		if len(table_v) != 0 && table_v[0] == '[' {
+			c, c_err = writeRequestsFromJSON(table_v, table)
+		} else {
+			var table_req map[string]json.RawMessage
+			if c_err = json.Unmarshal(table_v, &table_req); c_err == nil {
+				if c_err = requestMapFromJSON(table_req, table); c_err == nil {
+					c, c_err = json.Marshal(table_req)
+				}
+			}
+		}
+		if c_err != nil {
+			return nil, fmt.Errorf("%s: %s", table, c_err.Error())
+		}
+		tables[table] = c
+	}
+	return json.Marshal(tables)
+}
+
+// writeRequestsFromJSON coerces the Item of each PutRequest and the Key of each
+// DeleteRequest in the list v of writes to table.
+func writeRequestsFromJSON(v json.RawMessage, table string) (json.RawMessage, error) {
+	var write_requests []map[string]map[string]json.RawMessage
+	if um_err := json.Unmarshal(v, &write_requests); um_err != nil {
+		return nil, um_err
+	}
+	for _, write_request := range write_requests {
+		for kind, fields := range write_request {
+			if c_err := requestMapFromJSON(fields, table); c_err != nil {
+				return nil, fmt.Errorf("%s %s", kind, c_err.Error())
+			}
+		}
+	}
+	return json.Marshal(write_requests)
+}
+
+// transactItemsFromJSON coerces the fields of each action in the TransactItems v.
+func transactItemsFromJSON(v json.RawMessage) (json.RawMessage, error) {
+	var transact_items []map[string]map[string]json.RawMessage
+	if um_err := json.Unmarshal(v, &transact_items); um_err != nil {
+		return nil, um_err
+	}
+	for _, item := range transact_items {
+		for action, fields := range item {
+			if c_err := requestMapFromJSON(fields, ""); c_err != nil {
+				return nil, fmt.Errorf("%s %s", action, c_err.Error())
+			}
+		}
+	}
+	return json.Marshal(transact_items)
+}
+
+// the form of a number in JSON, which is also the form DynamoDB accepts for an N
+var number_regexp = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// kindOf returns the AttributeValue type suggested by the JSON kind of i. As in the lossy
+// coercion, a list of distinct strings is taken to be an SS and one of distinct numbers an NS.
+func kindOf(i interface{}) string {
+	switch t := i.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return "BOOL"
+	case json.Number:
+		return "N"
+	case string:
+		return "S"
+	case map[string]interface{}:
+		return "M"
+	case []interface{}:
+		if len(t) == 0 {
+			return "L"
+		}
+		set_type := kindOf(t[0])
+		if set_type != "S" && set_type != "N" {
+			return "L"
+		}
+		seen := make(map[interface{}]bool, len(t))
+		for _, e := range t {
+			if kindOf(e) != set_type || seen[e] {
+				return "L"
+			}
+			seen[e] = true
+		}
+		return set_type + "S"
+	}
+	return ""
+}
+
+// losslessFromJSON coerces the basic JSON value i, decoded with UseNumber, to an AttributeValue
+// of type hint, or of the type its JSON kind suggests if there is no hint. The members of a map
+// are hinted by their dotted path from the top-level attribute. A scalar hinted with a set type,
+// as when it is compared to a set with CONTAINS, takes the type of the set's members.
+func losslessFromJSON(i interface{}, hint string, hints map[string]string, path string) (map[string]interface{}, error) {
+	if hint == "" {
+		hint = kindOf(i)
+	}
+	l, is_list := i.([]interface{})
+	if !is_list && (hint == "SS" || hint == "NS" || hint == "BS") {
+		hint = hint[:1]
+	}
+	switch hint {
+	case "S", "B":
+		s, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a string", path, hint)
+		}
+		if hint == "B" {
+			if _, b_err := base64.StdEncoding.DecodeString(s); b_err != nil {
+				return nil, fmt.Errorf("%s: B must be base64: %s", path, b_err.Error())
+			}
+		}
+		return map[string]interface{}{hint: s}, nil
+	case "N":
+		var n string
+		switch t := i.(type) {
+		case json.Number:
+			n = t.String()
+		case string:
+			n = t
+		}
+		if !number_regexp.MatchString(n) {
+			return nil, fmt.Errorf("%s: N must be a number", path)
+		}
+		return map[string]interface{}{hint: n}, nil
+	case "BOOL":
+		b, ok := i.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s: BOOL must be true or false", path)
+		}
+		return map[string]interface{}{hint: b}, nil
+	case "NULL":
+		if i != nil {
+			return nil, fmt.Errorf("%s: NULL must be null", path)
+		}
+		return map[string]interface{}{hint: true}, nil
+	case "SS", "NS", "BS":
+		members := make([]string, len(l))
+		for j, e := range l {
+			c, cerr := losslessFromJSON(e, hint[:1], nil, path)
+			if cerr != nil {
+				return nil, cerr
+			}
+			members[j] = c[hint[:1]].(string)
+		}
+		return map[string]interface{}{hint: members}, nil
+	case "L":
+		if !is_list {
+			return nil, fmt.Errorf("%s: L must be a list", path)
+		}
+		elements := make([]interface{}, len(l))
+		for j, e := range l {
+			c, cerr := losslessFromJSON(e, "", nil, path)
+			if cerr != nil {
+				return nil, cerr
+			}
+			elements[j] = c
+		}
+		return map[string]interface{}{hint: elements}, nil
+	case "M":
+		m, ok := i.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: M must be an object", path)
+		}
+		members := make(map[string]interface{}, len(m))
+		for k, mv := range m {
+			member_path := path + "." + k
+			c, cerr := losslessFromJSON(mv, hints[member_path], hints, member_path)
+			if cerr != nil {
+				return nil, cerr
+			}
+			members[k] = c
+		}
+		return map[string]interface{}{hint: members}, nil
+	}
+	return nil, fmt.Errorf("%s: cannot coerce to %s", path, hint)
+}
+
+// losslessToJSON coerces the AttributeValue av to basic JSON without loss: an N is kept as a
+// json.Number, a B or the members of a BS as their base64 strings, and a NULL as null.
+func losslessToJSON(av map[string]json.RawMessage) (interface{}, error) {
+	if len(av) != 1 {
+		return nil, fmt.Errorf("not an AttributeValue: %v", av)
+	}
+	for t, v := range av {
+		switch t {
+		case "S", "B":
+			var s string
+			um_err := json.Unmarshal(v, &s)
+			return s, um_err
+		case "N":
+			var s string
+			um_err := json.Unmarshal(v, &s)
+			return json.Number(s), um_err
+		case "BOOL":
+			var b bool
+			um_err := json.Unmarshal(v, &b)
+			return b, um_err
+		case "NULL":
+			return nil, nil
+		case "SS", "BS":
+			var ss []string
+			um_err := json.Unmarshal(v, &ss)
+			return ss, um_err
+		case "NS":
+			var ss []string
+			if um_err := json.Unmarshal(v, &ss); um_err != nil {
+				return nil, um_err
+			}
+			ns := make([]json.Number, len(ss))
+			for j, s := range ss {
+				ns[j] = json.Number(s)
+			}
+			return ns, nil
+		case "L":
+			var l []map[string]json.RawMessage
+			if um_err := json.Unmarshal(v, &l); um_err != nil {
+				return nil, um_err
+			}
+			elements := make([]interface{}, len(l))
+			for j, e := range l {
+				c, cerr := losslessToJSON(e)
+				if cerr != nil {
+					return nil, cerr
+				}
+				elements[j] = c
+			}
+			return elements, nil
+		case "M":
+			var m map[string]map[string]json.RawMessage
+			if um_err := json.Unmarshal(v, &m); um_err != nil {
+				return nil, um_err
+			}
+			return losslessMapToJSON(m)
+		}
+	}
+	return nil, fmt.Errorf("unknown AttributeValue type in %v", av)
+}
+
+// losslessMapToJSON coerces each of the AttributeValues of the map m with losslessToJSON.
+func losslessMapToJSON(m map[string]map[string]json.RawMessage) (map[string]interface{}, error) {
+	c := make(map[string]interface{}, len(m))
+	for k, av := range m {
+		v, cerr := losslessToJSON(av)
+		if cerr != nil {
+			return nil, fmt.Errorf("%s: %s", k, cerr.Error())
+		}
+		c[k] = v
+	}
+	return c, nil
+}
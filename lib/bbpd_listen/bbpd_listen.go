@@ -0,0 +1,103 @@
+// Listeners for bbpd: TCP addresses and Unix domain sockets. As bbpd exits quietly when
+// another instance already holds its ports, an address or socket that is in use is
+// reported as such rather than as an error.
+package bbpd_listen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// the permissions of a socket file if none are configured
+	DEFAULT_SOCKET_MODE = 0660
+)
+
+var (
+	// the socket files created by Unix, removed by Cleanup
+	sockets     []string
+	sockets_mut sync.Mutex
+)
+
+// CanAssign returns true if nothing answers at the TCP address addr (host:port). An empty or
+// unspecified host is tried as localhost.
+func CanAssign(addr string) bool {
+	host, port, split_err := net.SplitHostPort(addr)
+	if split_err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = bbpd_const.LOCALHOST
+	}
+	_, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	return err != nil
+}
+
+// TCP listens on addr. It returns a nil Listener if addr is already in use.
+func TCP(addr string) (net.Listener, error) {
+	if !CanAssign(addr) {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ParseMode parses the octal file permissions s, such as "0660". An empty s gives
+// DEFAULT_SOCKET_MODE.
+func ParseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return DEFAULT_SOCKET_MODE, nil
+	}
+	m, parse_err := strconv.ParseUint(s, 8, 32)
+	if parse_err != nil || m > 0777 {
+		e := fmt.Sprintf("bbpd_listen.ParseMode:bad socket mode '%s'", s)
+		return 0, errors.New(e)
+	}
+	return os.FileMode(m), nil
+}
+
+// Unix listens on a Unix domain socket at path, with the file permissions mode. It returns a
+// nil Listener if another process is listening there. A socket file that nothing answers on
+// is left over from an earlier run and is replaced; any other file at path is an error.
+func Unix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, stat_err := os.Lstat(path); stat_err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			e := fmt.Sprintf("bbpd_listen.Unix:%s exists and is not a socket", path)
+			return nil, errors.New(e)
+		}
+		if c, dial_err := net.Dial("unix", path); dial_err == nil {
+			c.Close()
+			return nil, nil
+		}
+		if rm_err := os.Remove(path); rm_err != nil {
+			return nil, rm_err
+		}
+	}
+	l, listen_err := net.Listen("unix", path)
+	if listen_err != nil {
+		return nil, listen_err
+	}
+	if chmod_err := os.Chmod(path, mode); chmod_err != nil {
+		l.Close()
+		return nil, chmod_err
+	}
+	sockets_mut.Lock()
+	sockets = append(sockets, path)
+	sockets_mut.Unlock()
+	return l, nil
+}
+
+// Cleanup removes the socket files created by Unix. It is called on shutdown, as bbpd may
+// exit without closing its listeners.
+func Cleanup() {
+	sockets_mut.Lock()
+	for _, path := range sockets {
+		os.Remove(path)
+	}
+	sockets = nil
+	sockets_mut.Unlock()
+}
@@ -0,0 +1,135 @@
+// Log levels for bbpd. bbpd logs errors and refused requests with Errorf, and everything else
+// with Infof: at ERROR only the lines of Errorf are written, at INFO (the default) the lines of
+// both, and at DEBUG every request as well.
+//
+// Lines written with the standard log package, such as those of godynamo, have no level. Install
+// makes the standard logger drop them at OFF, and write them at every other level.
+package bbpd_log
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smugmug/godynamo/aws_const"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEBUG = "debug"
+	INFO  = "info"
+	ERROR = "error"
+	OFF   = "off"
+)
+
+// the rank of each level; a line is written if its level ranks at least the current level
+var ranks = map[string]int{
+	DEBUG: 0,
+	INFO:  1,
+	ERROR: 2,
+	OFF:   3,
+}
+
+var (
+	level     string
+	level_mut sync.RWMutex
+	// writes the lines of bbpd, which are filtered by level before they get here, and
+	// changes of level whatever the level
+	logger = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// filter drops the lines of the standard logger at OFF, and writes them to out otherwise.
+type filter struct {
+	out io.Writer
+}
+
+func (f *filter) Write(p []byte) (int, error) {
+	if Level() == OFF {
+		return len(p), nil
+	}
+	return f.out.Write(p)
+}
+
+func init() {
+	level = INFO
+}
+
+// Install makes the standard logger drop its lines at OFF. It should be called once, before
+// anything is logged that OFF should apply to.
+func Install() {
+	log.SetOutput(&filter{out: os.Stderr})
+}
+
+// SetLevel sets the log level to one of DEBUG, INFO, ERROR or OFF. An empty l is INFO.
+func SetLevel(l string) error {
+	l = strings.ToLower(l)
+	if l == "" {
+		l = INFO
+	}
+	if _, ok := ranks[l]; !ok {
+		e := fmt.Sprintf("bbpd_log.SetLevel:unknown log level '%s'", l)
+		return errors.New(e)
+	}
+	level_mut.Lock()
+	changed := level != l
+	level = l
+	level_mut.Unlock()
+	if changed {
+		logger.Printf("bbpd_log.SetLevel:log level %s", l)
+	}
+	return nil
+}
+
+// Level returns the log level.
+func Level() string {
+	level_mut.RLock()
+	defer level_mut.RUnlock()
+	return level
+}
+
+// enabled returns true if lines at level l are written.
+func enabled(l string) bool {
+	return ranks[l] >= ranks[Level()]
+}
+
+// Errorf logs an error or a refused request, at the ERROR level.
+func Errorf(format string, v ...interface{}) {
+	if !enabled(ERROR) {
+		return
+	}
+	logger.Output(2, fmt.Sprintf(format, v...))
+}
+
+// Infof logs at the INFO level.
+func Infof(format string, v ...interface{}) {
+	if !enabled(INFO) {
+		return
+	}
+	logger.Output(2, fmt.Sprintf(format, v...))
+}
+
+// Debugf logs at the DEBUG level.
+func Debugf(format string, v ...interface{}) {
+	if !enabled(DEBUG) {
+		return
+	}
+	logger.Output(2, fmt.Sprintf(format, v...))
+}
+
+// Requests returns a handler that logs each request to h at the DEBUG level.
+func Requests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if Level() != DEBUG {
+			h.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		h.ServeHTTP(w, req)
+		Debugf("%s %s %s from %s in %v", req.Method, req.URL.Path,
+			req.Header.Get(aws_const.AMZ_TARGET_HDR), req.RemoteAddr, time.Since(start))
+	})
+}
@@ -0,0 +1,298 @@
+// bbpd_metrics collects counters and latency histograms for the running bbpd process and
+// exposes them in the Prometheus text format on /metrics.
+package bbpd_metrics
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_endpoints"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"github.com/smugmug/godynamo/aws_const"
+	ep "github.com/smugmug/godynamo/endpoint"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENDPOINT_NAME = "metrics"
+	// the content type of the Prometheus text format
+	METRICS_MIME = "text/plain; version=0.0.4; charset=utf-8"
+	// the error type counted for upstream requests that fail without a response
+	REQUEST_ERROR = "RequestError"
+	// the patterns of the routes that relay any operation, which is added to their label
+	COMPAT_PATTERN  = "/"
+	RAWPOST_PATTERN = "/RawPost/"
+	// the most operations labelled separately, as clients choose them. requests for others
+	// are labelled with the pattern alone
+	MAX_OPERATIONS = 100
+)
+
+// upper bounds, in seconds, of the request latency histogram buckets. the largest matches the
+// server timeout.
+var LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range LATENCY_BUCKETS {
+		if v <= le {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type request_key struct {
+	endpoint string
+	status   string
+}
+
+var (
+	requests        map[request_key]uint64
+	latencies       map[string]*histogram
+	upstream_errors map[string]uint64
+	retries         map[string]uint64
+	in_flight       int64
+	// the operations labelled separately
+	operations   map[string]bool
+	metrics_lock sync.Mutex
+)
+
+func init() {
+	requests = make(map[request_key]uint64)
+	latencies = make(map[string]*histogram)
+	upstream_errors = make(map[string]uint64)
+	retries = make(map[string]uint64)
+	operations = make(map[string]bool)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter, which
+// streaming handlers use to flush and extend write deadlines.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// target returns the X-Amz-Target of the operation a request to pattern relays, with the API
+// version, or "" if it has none.
+func target(pattern string, req *http.Request) string {
+	var t string
+	switch pattern {
+	case COMPAT_PATTERN:
+		t = req.Header.Get(aws_const.AMZ_TARGET_HDR)
+	case RAWPOST_PATTERN:
+		t = strings.TrimPrefix(req.URL.Path, RAWPOST_PATTERN)
+	default:
+		return ""
+	}
+	op := t[strings.LastIndex(t, ".")+1:]
+	if op == "" || strings.IndexFunc(op, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z')
+	}) != -1 {
+		return ""
+	}
+	return bbpd_endpoints.Target(op)
+}
+
+// endpoint returns the label of a request to pattern: the pattern, and for the routes that
+// relay any operation, the operation, unless MAX_OPERATIONS others are already labelled.
+// metrics_lock must be held.
+func endpoint(pattern, t string) string {
+	if t == "" {
+		return pattern
+	}
+	if !operations[t] {
+		if len(operations) >= MAX_OPERATIONS {
+			return pattern
+		}
+		operations[t] = true
+	}
+	return pattern + t
+}
+
+// Instrument wraps mux so that every request is counted and timed. Requests are labelled with
+// the mux pattern that handles them, rather than the raw path, to bound the number of series;
+// requests to / and /RawPost/ are labelled with their operation as well, as
+// /RawPost/DynamoDB_20120810.GetItem.
+func Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, pattern := mux.Handler(req)
+		t := target(pattern, req)
+		start := time.Now()
+		metrics_lock.Lock()
+		in_flight++
+		metrics_lock.Unlock()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, req)
+
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		elapsed := time.Since(start).Seconds()
+		metrics_lock.Lock()
+		in_flight--
+		label := endpoint(pattern, t)
+		requests[request_key{endpoint: label, status: strconv.Itoa(rec.code)}]++
+		h, ok := latencies[label]
+		if !ok {
+			h = &histogram{buckets: make([]uint64, len(LATENCY_BUCKETS))}
+			latencies[label] = h
+		}
+		h.observe(elapsed)
+		metrics_lock.Unlock()
+	})
+}
+
+// AddUpstream counts the result of a request to Dynamo if it failed, by AWS error type.
+func AddUpstream(resp_body []byte, code int, resp_err error) {
+	var t string
+	switch {
+	case resp_err != nil:
+		t = REQUEST_ERROR
+	case ep.HttpErr(code):
+		t = aws_error.Type(resp_body)
+		if t == "" {
+			t = "Http" + strconv.Itoa(code)
+		}
+	default:
+		return
+	}
+	metrics_lock.Lock()
+	upstream_errors[t]++
+	metrics_lock.Unlock()
+}
+
+// AddRetry counts a request to Dynamo that bbpd repeats, by the component retrying it.
+func AddRetry(component string) {
+	metrics_lock.Lock()
+	retries[component]++
+	metrics_lock.Unlock()
+}
+
+// escape a label value for the text format
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + label_escaper.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func header(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counters writes a counter family with one label, in label order.
+func counters(buf *bytes.Buffer, name, help, label_name string, vals map[string]uint64) {
+	header(buf, name, help, "counter")
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s{%s} %d\n", name, label(label_name, k), vals[k])
+	}
+}
+
+// Write writes every metric in the Prometheus text format.
+func Write(out io.Writer) error {
+	var buf bytes.Buffer
+	metrics_lock.Lock()
+
+	header(&buf, "bbpd_requests_total", "Requests handled, by endpoint and HTTP status.", "counter")
+	request_keys := make([]request_key, 0, len(requests))
+	for k := range requests {
+		request_keys = append(request_keys, k)
+	}
+	sort.Slice(request_keys, func(i, j int) bool {
+		if request_keys[i].endpoint != request_keys[j].endpoint {
+			return request_keys[i].endpoint < request_keys[j].endpoint
+		}
+		return request_keys[i].status < request_keys[j].status
+	})
+	for _, k := range request_keys {
+		fmt.Fprintf(&buf, "bbpd_requests_total{%s,%s} %d\n",
+			label("endpoint", k.endpoint), label("status", k.status), requests[k])
+	}
+
+	header(&buf, "bbpd_request_duration_seconds", "Request latency, by endpoint.", "histogram")
+	endpoints := make([]string, 0, len(latencies))
+	for k := range latencies {
+		endpoints = append(endpoints, k)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		h := latencies[endpoint]
+		l := label("endpoint", endpoint)
+		for i, le := range LATENCY_BUCKETS {
+			fmt.Fprintf(&buf, "bbpd_request_duration_seconds_bucket{%s,%s} %d\n",
+				l, label("le", formatFloat(le)), h.buckets[i])
+		}
+		fmt.Fprintf(&buf, "bbpd_request_duration_seconds_bucket{%s,%s} %d\n", l, label("le", "+Inf"), h.count)
+		fmt.Fprintf(&buf, "bbpd_request_duration_seconds_sum{%s} %s\n", l, formatFloat(h.sum))
+		fmt.Fprintf(&buf, "bbpd_request_duration_seconds_count{%s} %d\n", l, h.count)
+	}
+
+	counters(&buf, "bbpd_upstream_errors_total",
+		"Failed requests to DynamoDB, by AWS error type.", "type", upstream_errors)
+	counters(&buf, "bbpd_retries_total",
+		"Requests to DynamoDB repeated by bbpd, by component.", "component", retries)
+
+	header(&buf, "bbpd_in_flight_requests", "Requests currently being handled.", "gauge")
+	fmt.Fprintf(&buf, "bbpd_in_flight_requests %d\n", in_flight)
+	metrics_lock.Unlock()
+
+	header(&buf, "bbpd_open_connections", "Open client connections.", "gauge")
+	fmt.Fprintf(&buf, "bbpd_open_connections %d\n", bbpd_runinfo.OpenConns())
+
+	_, w_err := out.Write(buf.Bytes())
+	return w_err
+}
+
+// MetricsHandler serves the metrics. Unlike other routes it remains available while bbpd is
+// closed, so that a drain can be observed.
+func MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		e := "method only supports GET"
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(bbpd_const.CONTENTTYPE, METRICS_MIME)
+	Write(w)
+}
@@ -0,0 +1,380 @@
+// Server-side pagination of Query and Scan requests. When requested, bbpd follows
+// LastEvaluatedKey on behalf of the caller and either merges the pages into one
+// response or streams the Items back as newline-delimited JSON.
+package bbpd_paginate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_stats"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	"github.com/smugmug/bbpd/lib/route_response"
+	ep "github.com/smugmug/godynamo/endpoint"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	EXCLUSIVE_START_KEY = "ExclusiveStartKey"
+	LAST_EVALUATED_KEY  = "LastEvaluatedKey"
+	LIMIT               = "Limit"
+
+	// each streamed page must be written within this duration. this supersedes
+	// the server WriteTimeout, which would otherwise limit the entire stream.
+	STREAM_PAGE_TIMEOUT = 20 * time.Second
+)
+
+var newline = []byte("\n")
+
+// Caps bound the work done by a paginated request. Zero values mean no bound.
+type Caps struct {
+	MaxItems uint64
+	MaxPages uint64
+}
+
+// ConsumedCapacity is the summable portion of a ConsumedCapacity response.
+type ConsumedCapacity struct {
+	TableName     string
+	CapacityUnits float64
+}
+
+// Page is a single Query or Scan response. Items are left as raw AttributeValue maps.
+type Page struct {
+	Items            []json.RawMessage
+	Count            uint64
+	ScannedCount     uint64
+	LastEvaluatedKey json.RawMessage   `json:",omitempty"`
+	ConsumedCapacity *ConsumedCapacity `json:",omitempty"`
+}
+
+func NewPage() *Page {
+	p := new(Page)
+	p.Items = make([]json.RawMessage, 0)
+	return p
+}
+
+// HasMore is true if the page indicates there are further results.
+func (p *Page) HasMore() bool {
+	return len(p.LastEvaluatedKey) != 0 && string(p.LastEvaluatedKey) != "null"
+}
+
+// Requested returns true if the caller asked for pagination.
+func Requested(req *http.Request) bool {
+	_, paginate := req.Header[bbpd_const.X_BBPD_PAGINATE]
+	return paginate
+}
+
+// StreamRequested returns true if the caller asked for a streamed response.
+func StreamRequested(req *http.Request) bool {
+	_, stream := req.Header[bbpd_const.X_BBPD_STREAM]
+	return stream
+}
+
+// CapsFromRequest reads the optional X-Bbpd-Max-Items and X-Bbpd-Max-Pages headers.
+func CapsFromRequest(req *http.Request) (Caps, error) {
+	var caps Caps
+	if v := req.Header.Get(bbpd_const.X_BBPD_MAX_ITEMS); v != "" {
+		max_items, conv_err := strconv.ParseUint(v, 10, 64)
+		if conv_err != nil {
+			e := fmt.Sprintf("bad %s value '%s'", bbpd_const.X_BBPD_MAX_ITEMS, v)
+			return caps, errors.New(e)
+		}
+		caps.MaxItems = max_items
+	}
+	if v := req.Header.Get(bbpd_const.X_BBPD_MAX_PAGES); v != "" {
+		max_pages, conv_err := strconv.ParseUint(v, 10, 64)
+		if conv_err != nil {
+			e := fmt.Sprintf("bad %s value '%s'", bbpd_const.X_BBPD_MAX_PAGES, v)
+			return caps, errors.New(e)
+		}
+		caps.MaxPages = max_pages
+	}
+	return caps, nil
+}
+
+// Paginate issues the request in bodybytes to amzTarget, following LastEvaluatedKey until
+// the results are exhausted or the caps are reached. fn is called once for each page.
+// If AWS responds with an http error, the response body and code are returned so the caller
+// can relay them. The returned code is http.StatusOK if every page succeeded.
+func Paginate(bodybytes []byte, amzTarget string, caps Caps, fn func(*Page) error) ([]byte, int, error) {
+	var reqmap map[string]json.RawMessage
+	um_err := json.Unmarshal(bodybytes, &reqmap)
+	if um_err != nil {
+		return nil, 0, um_err
+	}
+	// a client-supplied Limit remains the page size
+	page_limit := uint64(0)
+	if l, l_ok := reqmap[LIMIT]; l_ok && string(l) != "null" {
+		if l_err := json.Unmarshal(l, &page_limit); l_err != nil {
+			return nil, 0, l_err
+		}
+	}
+
+	items := uint64(0)
+	pages := uint64(0)
+	for {
+		// never ask for more than the remaining items under the cap
+		if caps.MaxItems != 0 {
+			remaining := caps.MaxItems - items
+			if page_limit == 0 || remaining < page_limit {
+				reqmap[LIMIT] = json.RawMessage(strconv.FormatUint(remaining, 10))
+			}
+		}
+		reqbytes, m_err := json.Marshal(reqmap)
+		if m_err != nil {
+			return nil, 0, m_err
+		}
+		resp_body, code, resp_err := raw.Req(reqbytes, amzTarget)
+		if resp_err != nil {
+			return nil, 0, resp_err
+		}
+		if ep.HttpErr(code) {
+			return resp_body, code, nil
+		}
+		page := NewPage()
+		p_err := json.Unmarshal(resp_body, page)
+		if p_err != nil {
+			return nil, 0, p_err
+		}
+		pages++
+		items += page.Count
+		if fn_err := fn(page); fn_err != nil {
+			return nil, 0, fn_err
+		}
+		if !page.HasMore() ||
+			(caps.MaxPages != 0 && pages >= caps.MaxPages) ||
+			(caps.MaxItems != 0 && items >= caps.MaxItems) {
+			return nil, http.StatusOK, nil
+		}
+		reqmap[EXCLUSIVE_START_KEY] = page.LastEvaluatedKey
+	}
+}
+
+// Collect paginates the request and merges all pages into a single response body
+// with the same shape as a Query or Scan response. If the caps stopped pagination
+// early, the LastEvaluatedKey of the final page is retained so the caller may resume.
+func Collect(bodybytes []byte, amzTarget string, caps Caps) ([]byte, int, error) {
+	merged := NewPage()
+	resp_body, code, err := Paginate(bodybytes, amzTarget, caps,
+		func(page *Page) error {
+			merged.Items = append(merged.Items, page.Items...)
+			merged.Count += page.Count
+			merged.ScannedCount += page.ScannedCount
+			merged.LastEvaluatedKey = page.LastEvaluatedKey
+			if page.ConsumedCapacity != nil {
+				if merged.ConsumedCapacity == nil {
+					merged.ConsumedCapacity = &ConsumedCapacity{TableName: page.ConsumedCapacity.TableName}
+				}
+				merged.ConsumedCapacity.CapacityUnits += page.ConsumedCapacity.CapacityUnits
+			}
+			return nil
+		})
+	if err != nil || code != http.StatusOK {
+		return resp_body, code, err
+	}
+	if !merged.HasMore() {
+		merged.LastEvaluatedKey = nil
+	}
+	merged_body, m_err := json.Marshal(merged)
+	if m_err != nil {
+		return nil, 0, m_err
+	}
+	return merged_body, http.StatusOK, nil
+}
+
+// PaginateHandler reads a Query or Scan request, paginates it and relays the merged response.
+func PaginateHandler(w http.ResponseWriter, req *http.Request, amzTarget string) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	caps, caps_err := CapsFromRequest(req)
+	if caps_err != nil {
+		e := fmt.Sprintf("bbpd_paginate.PaginateHandler:%s", caps_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("bbpd_paginate.PaginateHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, amzTarget) {
+		return
+	}
+
+	resp_body, code, resp_err := Collect(bodybytes, amzTarget, caps)
+
+	if resp_err != nil {
+		e := fmt.Sprintf("bbpd_paginate.PaginateHandler: resp err calling %s err %s (input json: %s)",
+			amzTarget, resp_err.Error(), string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("bbpd_paginate.PaginateHandler: http err %d calling %s (input json: %s)",
+			code, amzTarget, string(bodybytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		resp_body,
+		code,
+		start,
+		amzTarget)
+	if mr_err != nil {
+		e := fmt.Sprintf("bbpd_paginate.PaginateHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
+// StreamHandler reads a Query or Scan request, paginates it and writes each Item to the
+// response as it arrives, one JSON document per line, flushing after every page. Nothing
+// is buffered beyond the current page. If from is non-nil, it is applied to the request
+// before it is sent. If coerce is non-nil, it is applied to each Item before it is written,
+// and to the LastEvaluatedKey.
+// As the status code has been sent by the time later pages are read, the outcome of the
+// stream is reported in trailers: X-Bbpd-Count, X-Bbpd-Scanned-Count, X-Bbpd-Last-Evaluated-Key
+// (if a cap stopped the stream early) and X-Bbpd-Stream-Error (if a later page failed).
+func StreamHandler(w http.ResponseWriter, req *http.Request, amzTarget string,
+	from func([]byte) ([]byte, error), coerce func([]byte) ([]byte, error)) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	caps, caps_err := CapsFromRequest(req)
+	if caps_err != nil {
+		e := fmt.Sprintf("bbpd_paginate.StreamHandler:%s", caps_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("bbpd_paginate.StreamHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, amzTarget) {
+		return
+	}
+
+	if from != nil {
+		reqbytes, c_err := from(bodybytes)
+		if c_err != nil {
+			e := fmt.Sprintf("bbpd_paginate.StreamHandler cannot convert %s: %s", string(bodybytes), c_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
+			return
+		}
+		bodybytes = reqbytes
+	}
+
+	rc := http.NewResponseController(w)
+	streaming := false
+	count := uint64(0)
+	scanned_count := uint64(0)
+	var last_evaluated_key json.RawMessage
+
+	resp_body, code, resp_err := Paginate(bodybytes, amzTarget, caps,
+		func(page *Page) error {
+			if !streaming {
+				w.Header().Set(bbpd_const.CONTENTTYPE, bbpd_const.NDJSONMIME)
+				w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_COUNT)
+				w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_SCANNED_COUNT)
+				w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_LAST_EVALUATED_KEY)
+				w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_STREAM_ERROR)
+				w.WriteHeader(http.StatusOK)
+				streaming = true
+			}
+			dl_err := rc.SetWriteDeadline(time.Now().Add(STREAM_PAGE_TIMEOUT))
+			if dl_err != nil && dl_err != http.ErrNotSupported {
+				return dl_err
+			}
+			for _, item := range page.Items {
+				line := []byte(item)
+				if coerce != nil {
+					c, c_err := coerce(item)
+					if c_err != nil {
+						return c_err
+					}
+					line = c
+				}
+				if _, w_err := w.Write(line); w_err != nil {
+					return w_err
+				}
+				if _, w_err := w.Write(newline); w_err != nil {
+					return w_err
+				}
+			}
+			count += page.Count
+			scanned_count += page.ScannedCount
+			last_evaluated_key = page.LastEvaluatedKey
+			if f_err := rc.Flush(); f_err != nil && f_err != http.ErrNotSupported {
+				return f_err
+			}
+			return nil
+		})
+
+	if !streaming {
+		// nothing has been written, so errors can be reported normally
+		if resp_err != nil {
+			e := fmt.Sprintf("bbpd_paginate.StreamHandler: resp err calling %s err %s (input json: %s)",
+				amzTarget, resp_err.Error(), string(bodybytes))
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusInternalServerError)
+			return
+		}
+		if ep.HttpErr(code) {
+			e := fmt.Sprintf("bbpd_paginate.StreamHandler: http err %d calling %s (input json: %s)",
+				code, amzTarget, string(bodybytes))
+			route_response.WriteError(w, code, e, resp_body)
+			return
+		}
+	}
+
+	w.Header().Set(bbpd_const.X_BBPD_COUNT, strconv.FormatUint(count, 10))
+	w.Header().Set(bbpd_const.X_BBPD_SCANNED_COUNT, strconv.FormatUint(scanned_count, 10))
+	if len(last_evaluated_key) != 0 && string(last_evaluated_key) != "null" {
+		if coerce != nil {
+			if c, c_err := coerce(last_evaluated_key); c_err == nil {
+				last_evaluated_key = c
+			}
+		}
+		w.Header().Set(bbpd_const.X_BBPD_LAST_EVALUATED_KEY, string(last_evaluated_key))
+	}
+	if resp_err != nil {
+		e := fmt.Sprintf("bbpd_paginate.StreamHandler: stream to %s aborted: %s", amzTarget, resp_err.Error())
+		bbpd_log.Errorf(e)
+		w.Header().Set(bbpd_const.X_BBPD_STREAM_ERROR, e)
+		return
+	}
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("bbpd_paginate.StreamHandler: stream to %s aborted: http err %d %s", amzTarget, code, string(resp_body))
+		bbpd_log.Errorf(e)
+		w.Header().Set(bbpd_const.X_BBPD_STREAM_ERROR, e)
+		return
+	}
+	bbpd_stats.AddResponse(start)
+}
@@ -0,0 +1,359 @@
+// Token-bucket rate limiting of reads and writes per table, and optionally per caller.
+// Each request takes one token from its table's read or write bucket for each item it
+// reads or writes (a Query or Scan counts as one read). If callers are limited separately,
+// it also takes them from its caller's bucket for the table; the table's bucket then limits
+// all callers together, so that a caller cannot escape the limit by changing its identity. A request that finds too few tokens
+// waits for them, up to a configured limit, or is rejected with 429 Too Many Requests and
+// a Retry-After header.
+package bbpd_ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_auth"
+	"github.com/smugmug/bbpd/lib/bbpd_conf"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the Tables entry that applies to tables without their own
+	DEFAULT_TABLE = "*"
+	RETRY_AFTER   = "Retry-After"
+	READ          = "Read"
+	WRITE         = "Write"
+	// a caller's bucket that has not been used for this long is discarded
+	IDLE_BUCKET_TIMEOUT = 10 * time.Minute
+)
+
+// operations that are limited, and whether they are writes
+var operations = map[string]bool{
+	"GetItem":            false,
+	"BatchGetItem":       false,
+	"Query":              false,
+	"Scan":               false,
+	"TransactGetItems":   false,
+	"PutItem":            true,
+	"UpdateItem":         true,
+	"DeleteItem":         true,
+	"BatchWriteItem":     true,
+	"TransactWriteItems": true,
+}
+
+// State reports the state of one bucket.
+type State struct {
+	Table    string
+	Identity string `json:",omitempty"`
+	Kind     string
+	Rate     float64
+	Burst    float64
+	Tokens   float64
+	Allowed  uint64
+	Delayed  uint64
+	Rejected uint64
+}
+
+type bucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	allowed  uint64
+	delayed  uint64
+	rejected uint64
+}
+
+// reserve takes n tokens, returning how long the caller must wait for them. If that is longer
+// than max_wait, no tokens are taken and false is returned. A request for more tokens than
+// the burst takes them all, leaving the bucket in debt, and waits for the rest to accrue.
+func (b *bucket) reserve(n float64, now time.Time, max_wait time.Duration) (time.Duration, bool) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	if wait > max_wait {
+		b.tokens += n
+		return wait, false
+	}
+	return wait, true
+}
+
+type bucket_key struct {
+	table    string
+	identity string
+	write    bool
+}
+
+var (
+	identity_header string
+	max_wait        time.Duration
+	limits          map[string]bbpd_conf.TableLimit_Conf
+	buckets         map[bucket_key]*bucket
+	// when idle buckets were last discarded
+	last_evict time.Time
+	limit_lock sync.Mutex
+)
+
+func init() {
+	buckets = make(map[bucket_key]*bucket)
+}
+
+// Configure sets the per-table limits, the header identifying callers (if callers are limited
+// separately), and how long a request may wait for tokens. Existing buckets are discarded.
+func Configure(header string, wait time.Duration, table_limits map[string]bbpd_conf.TableLimit_Conf) {
+	limit_lock.Lock()
+	identity_header = header
+	max_wait = wait
+	limits = table_limits
+	buckets = make(map[bucket_key]*bucket)
+	limit_lock.Unlock()
+}
+
+// Enabled returns true if any limits are configured.
+func Enabled() bool {
+	limit_lock.Lock()
+	defer limit_lock.Unlock()
+	return len(limits) != 0
+}
+
+// costs returns the number of items the request bodybytes reads or writes in each table.
+func costs(bodybytes []byte, op string) map[string]float64 {
+	c := make(map[string]float64)
+	var r struct {
+		TableName     string
+		RequestItems  map[string]json.RawMessage
+		TransactItems []map[string]struct {
+			TableName string
+		}
+	}
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil {
+		return c
+	}
+	switch op {
+	case "BatchGetItem":
+		for table, v := range r.RequestItems {
+			var keys struct {
+				Keys []json.RawMessage
+			}
+			json.Unmarshal(v, &keys)
+			c[table] += float64(len(keys.Keys))
+		}
+	case "BatchWriteItem":
+		for table, v := range r.RequestItems {
+			var writes []json.RawMessage
+			json.Unmarshal(v, &writes)
+			c[table] += float64(len(writes))
+		}
+	case "TransactGetItems", "TransactWriteItems":
+		for _, item := range r.TransactItems {
+			for _, action := range item {
+				c[action.TableName]++
+			}
+		}
+	default:
+		c[r.TableName] = 1
+	}
+	delete(c, "")
+	return c
+}
+
+// getBucket returns the bucket for the key, or nil if it is not limited. A new bucket is full
+// as of now. The bucket of a table, without an identity, has the table's total limits when
+// callers are limited separately. limit_lock must be held.
+func getBucket(k bucket_key, now time.Time) *bucket {
+	if b, ok := buckets[k]; ok {
+		return b
+	}
+	l, ok := limits[k.table]
+	if !ok {
+		l, ok = limits[DEFAULT_TABLE]
+	}
+	if !ok {
+		return nil
+	}
+	rate, burst := l.ReadsPerSecond, l.ReadBurst
+	total_rate, total_burst := l.TotalReadsPerSecond, l.TotalReadBurst
+	if k.write {
+		rate, burst = l.WritesPerSecond, l.WriteBurst
+		total_rate, total_burst = l.TotalWritesPerSecond, l.TotalWriteBurst
+	}
+	if rate <= 0 {
+		return nil
+	}
+	if k.identity == "" && identity_header != "" && total_rate > 0 {
+		rate, burst = total_rate, total_burst
+	}
+	if burst < 1 {
+		burst = math.Max(rate, 1)
+	}
+	b := &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+	buckets[k] = b
+	return b
+}
+
+// evictIdle discards the callers' buckets that have not been used for IDLE_BUCKET_TIMEOUT,
+// at most once every IDLE_BUCKET_TIMEOUT. Such a bucket is full, as a new one would be.
+// limit_lock must be held.
+func evictIdle(now time.Time) {
+	if now.Sub(last_evict) < IDLE_BUCKET_TIMEOUT {
+		return
+	}
+	last_evict = now
+	for k, b := range buckets {
+		if k.identity != "" && now.Sub(b.last) >= IDLE_BUCKET_TIMEOUT {
+			delete(buckets, k)
+		}
+	}
+}
+
+// identify returns the identity of the caller that made req, or "" if callers are not limited
+// separately. With authentication, it is the name of the client, and otherwise the value of
+// the identity header.
+func identify(req *http.Request) string {
+	if identity_header == "" {
+		return ""
+	}
+	if bbpd_auth.Enabled() {
+		return bbpd_auth.ClientName(req)
+	}
+	return req.Header.Get(identity_header)
+}
+
+// Wait blocks until the request bodybytes to amzTarget may proceed. If it could not proceed
+// within the configured wait, Wait returns false at once, with how long the caller should
+// wait before retrying. If the client goes away while Wait blocks, the tokens reserved for
+// the request are returned and Wait returns false.
+func Wait(req *http.Request, bodybytes []byte, amzTarget string) (bool, time.Duration) {
+	op := amzTarget[strings.LastIndex(amzTarget, ".")+1:]
+	write, limited := operations[op]
+	if !limited || !Enabled() {
+		return true, 0
+	}
+	table_costs := costs(bodybytes, op)
+
+	limit_lock.Lock()
+	identity := identify(req)
+	now := time.Now()
+	evictIdle(now)
+	var wait time.Duration
+	type reservation struct {
+		b *bucket
+		n float64
+	}
+	reserved := make([]reservation, 0, 2*len(table_costs))
+	for table, n := range table_costs {
+		keys := []bucket_key{{table: table, write: write}}
+		if identity != "" {
+			keys = append(keys, bucket_key{table: table, identity: identity, write: write})
+		}
+		for _, k := range keys {
+			b := getBucket(k, now)
+			if b == nil {
+				continue
+			}
+			w, ok := b.reserve(n, now, max_wait)
+			if !ok {
+				// return the tokens taken from the other buckets
+				for _, r := range reserved {
+					r.b.tokens += r.n
+				}
+				b.rejected++
+				limit_lock.Unlock()
+				return false, w
+			}
+			reserved = append(reserved, reservation{b: b, n: n})
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	for _, r := range reserved {
+		if wait > 0 {
+			r.b.delayed++
+		} else {
+			r.b.allowed++
+		}
+	}
+	limit_lock.Unlock()
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			limit_lock.Lock()
+			for _, r := range reserved {
+				r.b.tokens += r.n
+			}
+			limit_lock.Unlock()
+			return false, 0
+		}
+	}
+	return true, 0
+}
+
+// Limited calls Wait, and if the request may not proceed, responds with 429 Too Many Requests
+// and returns true. If the client went away while waiting, it returns true without responding.
+func Limited(w http.ResponseWriter, req *http.Request, bodybytes []byte, amzTarget string) bool {
+	ok, retry_after := Wait(req, bodybytes, amzTarget)
+	if ok {
+		return false
+	}
+	if ctx_err := req.Context().Err(); ctx_err != nil {
+		bbpd_log.Infof("bbpd_ratelimit.Limited:%s calling %s went away while rate limited: %s",
+			req.RemoteAddr, amzTarget, ctx_err.Error())
+		return true
+	}
+	secs := int(math.Ceil(retry_after.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	e := fmt.Sprintf("bbpd_ratelimit.Limited:rate limit exceeded calling %s, retry after %ds", amzTarget, secs)
+	bbpd_log.Errorf(e)
+	w.Header().Set(RETRY_AFTER, strconv.Itoa(secs))
+	route_response.Error(w, e, http.StatusTooManyRequests)
+	return true
+}
+
+// GetState returns the state of every bucket in use.
+func GetState() []State {
+	now := time.Now()
+	limit_lock.Lock()
+	defer limit_lock.Unlock()
+	states := make([]State, 0, len(buckets))
+	for k, b := range buckets {
+		kind := READ
+		if k.write {
+			kind = WRITE
+		}
+		states = append(states, State{
+			Table:    k.table,
+			Identity: k.identity,
+			Kind:     kind,
+			Rate:     b.rate,
+			Burst:    b.burst,
+			Tokens:   math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate),
+			Allowed:  b.allowed,
+			Delayed:  b.delayed,
+			Rejected: b.rejected})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Table != states[j].Table {
+			return states[i].Table < states[j].Table
+		}
+		if states[i].Identity != states[j].Identity {
+			return states[i].Identity < states[j].Identity
+		}
+		return states[i].Kind < states[j].Kind
+	})
+	return states
+}
@@ -0,0 +1,166 @@
+// Read-only mode, in which bbpd serves reads and refuses with 403 Forbidden every request that
+// could change data or tables. Only the operations known to be reads are allowed, so an
+// operation that bbpd does not know of is refused; PartiQL requests are allowed if all of
+// their statements are SELECTs.
+package bbpd_readonly
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// operations that are allowed in read-only mode
+var reads = map[string]bool{
+	"GetItem":                   true,
+	"BatchGetItem":              true,
+	"Query":                     true,
+	"Scan":                      true,
+	"TransactGetItems":          true,
+	"DescribeTable":             true,
+	"ListTables":                true,
+	"DescribeTimeToLive":        true,
+	"ListTagsOfResource":        true,
+	"DescribeLimits":            true,
+	"DescribeBackup":            true,
+	"ListBackups":               true,
+	"DescribeContinuousBackups": true,
+	"Status":                    true,
+	"metrics":                   true,
+	"Capacity":                  true,
+}
+
+// PartiQL operations, which are reads if all of their statements are
+var statement_operations = map[string]bool{
+	"ExecuteStatement":      true,
+	"BatchExecuteStatement": true,
+	"ExecuteTransaction":    true,
+}
+
+var (
+	read_only bool
+	// set once read-only mode is turned on or off at runtime, which overrides the configuration
+	runtime_set   bool
+	read_only_mut sync.RWMutex
+)
+
+// Configure sets read-only mode as configured. If it has been turned on or off at runtime
+// with Set, that is kept instead, and a difference from the configuration is logged.
+func Configure(on bool) {
+	read_only_mut.Lock()
+	if runtime_set {
+		current := read_only
+		read_only_mut.Unlock()
+		if current != on {
+			bbpd_log.Infof("bbpd_readonly.Configure:keeping read-only mode %v, set at runtime, "+
+				"over the configured %v; restart bbpd to apply the configuration", current, on)
+		}
+		return
+	}
+	changed := read_only != on
+	read_only = on
+	read_only_mut.Unlock()
+	if changed {
+		bbpd_log.Infof("bbpd_readonly.Configure:read-only mode %v", on)
+	}
+}
+
+// Set turns read-only mode on or off at runtime. The setting is kept when the configuration
+// is reloaded.
+func Set(on bool) {
+	read_only_mut.Lock()
+	changed := read_only != on
+	read_only = on
+	runtime_set = true
+	read_only_mut.Unlock()
+	if changed {
+		bbpd_log.Infof("bbpd_readonly.Set:read-only mode %v", on)
+	}
+}
+
+// Enabled returns true if bbpd is in read-only mode.
+func Enabled() bool {
+	read_only_mut.RLock()
+	defer read_only_mut.RUnlock()
+	return read_only
+}
+
+// selects returns true if every PartiQL statement in the request bodybytes is a SELECT.
+func selects(bodybytes []byte) bool {
+	var r struct {
+		Statement  string
+		Statements []struct {
+			Statement string
+		}
+		TransactStatements []struct {
+			Statement string
+		}
+	}
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil {
+		return false
+	}
+	statements := make([]string, 0)
+	if r.Statement != "" {
+		statements = append(statements, r.Statement)
+	}
+	for _, st := range r.Statements {
+		statements = append(statements, st.Statement)
+	}
+	for _, st := range r.TransactStatements {
+		statements = append(statements, st.Statement)
+	}
+	if len(statements) == 0 {
+		return false
+	}
+	for _, st := range statements {
+		if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(st)), "SELECT") {
+			return false
+		}
+	}
+	return true
+}
+
+// Refused returns false if the request req for the operation op may proceed. In read-only
+// mode, a request that is not a read is logged, a 403 Forbidden response is written, and
+// true is returned. The body of a PartiQL request is read and replaced, so that it may be
+// read again by the handler.
+func Refused(w http.ResponseWriter, req *http.Request, op string) bool {
+	if !Enabled() || reads[op] {
+		return false
+	}
+	if statement_operations[op] && req.Body != nil {
+		bodybytes, read_err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if read_err != nil && read_err != io.EOF {
+			e := fmt.Sprintf("bbpd_readonly.Refused err reading req body: %s", read_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusInternalServerError)
+			return true
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(bodybytes))
+		if selects(bodybytes) {
+			return false
+		}
+	}
+	e := fmt.Sprintf("bbpd_readonly.Refused:bbpd is in read-only mode, %s from %s is not allowed", op, req.RemoteAddr)
+	bbpd_log.Errorf(e)
+	route_response.Error(w, e, http.StatusForbidden)
+	return true
+}
+
+// Handler returns a handler that calls h with requests for the operation op that are not
+// refused.
+func Handler(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !Refused(w, req, op) {
+			h(w, req)
+		}
+	}
+}
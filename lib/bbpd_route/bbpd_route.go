@@ -4,28 +4,52 @@ package bbpd_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
 	"github.com/smugmug/bbpd/lib/batch_get_item_route"
 	"github.com/smugmug/bbpd/lib/batch_write_item_route"
+	"github.com/smugmug/bbpd/lib/bbpd_adaptive"
+	"github.com/smugmug/bbpd/lib/bbpd_admin"
+	"github.com/smugmug/bbpd/lib/bbpd_auth"
+	"github.com/smugmug/bbpd/lib/bbpd_cache"
+	"github.com/smugmug/bbpd/lib/bbpd_capacity"
+	"github.com/smugmug/bbpd/lib/bbpd_conf"
 	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_endpoints"
+	"github.com/smugmug/bbpd/lib/bbpd_hints"
+	"github.com/smugmug/bbpd/lib/bbpd_listen"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
+	"github.com/smugmug/bbpd/lib/bbpd_paginate"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
+	"github.com/smugmug/bbpd/lib/bbpd_readonly"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_spool"
 	"github.com/smugmug/bbpd/lib/bbpd_stats"
+	"github.com/smugmug/bbpd/lib/bbpd_tls"
+	"github.com/smugmug/bbpd/lib/bbpd_wire"
 	"github.com/smugmug/bbpd/lib/create_table_route"
 	"github.com/smugmug/bbpd/lib/delete_item_route"
+	"github.com/smugmug/bbpd/lib/delete_table_route"
 	"github.com/smugmug/bbpd/lib/describe_table_route"
+	"github.com/smugmug/bbpd/lib/get_item_batcher"
 	"github.com/smugmug/bbpd/lib/get_item_route"
 	"github.com/smugmug/bbpd/lib/list_tables_route"
+	"github.com/smugmug/bbpd/lib/parallel_scan_route"
 	"github.com/smugmug/bbpd/lib/put_item_route"
 	"github.com/smugmug/bbpd/lib/query_route"
 	"github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
 	"github.com/smugmug/bbpd/lib/scan_route"
+	"github.com/smugmug/bbpd/lib/transact_route"
 	"github.com/smugmug/bbpd/lib/update_item_route"
 	"github.com/smugmug/bbpd/lib/update_table_route"
+	"github.com/smugmug/bbpd/lib/write_behind"
 	"github.com/smugmug/godynamo/aws_const"
 	bgi "github.com/smugmug/godynamo/endpoints/batch_get_item"
 	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
 	create "github.com/smugmug/godynamo/endpoints/create_table"
 	delete_item "github.com/smugmug/godynamo/endpoints/delete_item"
+	delete_table "github.com/smugmug/godynamo/endpoints/delete_table"
 	desc "github.com/smugmug/godynamo/endpoints/describe_table"
 	get "github.com/smugmug/godynamo/endpoints/get_item"
 	list "github.com/smugmug/godynamo/endpoints/list_tables"
@@ -34,45 +58,95 @@ import (
 	scan "github.com/smugmug/godynamo/endpoints/scan"
 	update_item "github.com/smugmug/godynamo/endpoints/update_item"
 	update_table "github.com/smugmug/godynamo/endpoints/update_table"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
-
-	delete_table "github.com/smugmug/godynamo/endpoints/delete_table"
-	// undelete to enable table deletions (dangerous!)
-	// "github.com/smugmug/bbpd/lib/delete_table_route"
 )
 
 const (
-	URI_PATH_SEP           = "/"
-	STATUSPATH             = URI_PATH_SEP + "Status"
-	STATUSTABLEPATH        = URI_PATH_SEP + "StatusTable" + URI_PATH_SEP
-	RAWPOSTPATH            = URI_PATH_SEP + "RawPost" + URI_PATH_SEP
-	DESCRIBETABLEPATH      = URI_PATH_SEP + desc.ENDPOINT_NAME
-	DESCRIBETABLEGETPATH   = URI_PATH_SEP + desc.ENDPOINT_NAME + URI_PATH_SEP
-	DELETETABLEPATH        = URI_PATH_SEP + delete_table.ENDPOINT_NAME
-	DELETETABLEGETPATH     = URI_PATH_SEP + delete_table.ENDPOINT_NAME + URI_PATH_SEP
-	LISTTABLESPATH         = URI_PATH_SEP + list.ENDPOINT_NAME
-	CREATETABLEPATH        = URI_PATH_SEP + create.ENDPOINT_NAME
-	UPDATETABLEPATH        = URI_PATH_SEP + update_table.ENDPOINT_NAME
-	PUTITEMPATH            = URI_PATH_SEP + put.ENDPOINT_NAME
-	PUTITEMJSONPATH        = URI_PATH_SEP + put.JSON_ENDPOINT_NAME
-	GETITEMPATH            = URI_PATH_SEP + get.ENDPOINT_NAME
-	GETITEMJSONPATH        = URI_PATH_SEP + get.JSON_ENDPOINT_NAME
-	BATCHGETITEMPATH       = URI_PATH_SEP + bgi.ENDPOINT_NAME
-	BATCHGETITEMJSONPATH   = URI_PATH_SEP + bgi.JSON_ENDPOINT_NAME
-	BATCHWRITEITEMPATH     = URI_PATH_SEP + bwi.ENDPOINT_NAME
-	BATCHWRITEITEMJSONPATH = URI_PATH_SEP + bwi.JSON_ENDPOINT_NAME
-	DELETEITEMPATH         = URI_PATH_SEP + delete_item.ENDPOINT_NAME
-	UPDATEITEMPATH         = URI_PATH_SEP + update_item.ENDPOINT_NAME
-	QUERYPATH              = URI_PATH_SEP + query.ENDPOINT_NAME
-	SCANPATH               = URI_PATH_SEP + scan.ENDPOINT_NAME
-	COMPATPATH             = URI_PATH_SEP
+	URI_PATH_SEP                  = "/"
+	STATUSPATH                    = URI_PATH_SEP + "Status"
+	METRICSPATH                   = URI_PATH_SEP + bbpd_metrics.ENDPOINT_NAME
+	CAPACITYPATH                  = URI_PATH_SEP + bbpd_capacity.ENDPOINT_NAME
+	STATUSTABLEPATH               = URI_PATH_SEP + "StatusTable" + URI_PATH_SEP
+	RAWPOSTPATH                   = URI_PATH_SEP + "RawPost" + URI_PATH_SEP
+	DESCRIBETABLEPATH             = URI_PATH_SEP + desc.ENDPOINT_NAME
+	DESCRIBETABLEGETPATH          = URI_PATH_SEP + desc.ENDPOINT_NAME + URI_PATH_SEP
+	DELETETABLEPATH               = URI_PATH_SEP + delete_table.ENDPOINT_NAME
+	LISTTABLESPATH                = URI_PATH_SEP + list.ENDPOINT_NAME
+	CREATETABLEPATH               = URI_PATH_SEP + create.ENDPOINT_NAME
+	UPDATETABLEPATH               = URI_PATH_SEP + update_table.ENDPOINT_NAME
+	PUTITEMPATH                   = URI_PATH_SEP + put.ENDPOINT_NAME
+	PUTITEMJSONPATH               = URI_PATH_SEP + put.JSON_ENDPOINT_NAME
+	PUTITEMASYNCPATH              = URI_PATH_SEP + put_item_route.ASYNC_ENDPOINT_NAME
+	GETITEMPATH                   = URI_PATH_SEP + get.ENDPOINT_NAME
+	GETITEMJSONPATH               = URI_PATH_SEP + get.JSON_ENDPOINT_NAME
+	BATCHGETITEMPATH              = URI_PATH_SEP + bgi.ENDPOINT_NAME
+	BATCHGETITEMJSONPATH          = URI_PATH_SEP + bgi.JSON_ENDPOINT_NAME
+	BATCHWRITEITEMPATH            = URI_PATH_SEP + bwi.ENDPOINT_NAME
+	BATCHWRITEITEMJSONPATH        = URI_PATH_SEP + bwi.JSON_ENDPOINT_NAME
+	DELETEITEMPATH                = URI_PATH_SEP + delete_item.ENDPOINT_NAME
+	DELETEITEMJSONPATH            = URI_PATH_SEP + delete_item_route.JSON_ENDPOINT_NAME
+	UPDATEITEMPATH                = URI_PATH_SEP + update_item.ENDPOINT_NAME
+	UPDATEITEMJSONPATH            = URI_PATH_SEP + update_item_route.JSON_ENDPOINT_NAME
+	QUERYPATH                     = URI_PATH_SEP + query.ENDPOINT_NAME
+	QUERYJSONPATH                 = URI_PATH_SEP + query_route.JSON_ENDPOINT_NAME
+	SCANPATH                      = URI_PATH_SEP + scan.ENDPOINT_NAME
+	SCANJSONPATH                  = URI_PATH_SEP + scan_route.JSON_ENDPOINT_NAME
+	PARALLELSCANPATH              = URI_PATH_SEP + parallel_scan_route.ENDPOINT_NAME
+	PARALLELSCANJSONPATH          = URI_PATH_SEP + parallel_scan_route.JSON_ENDPOINT_NAME
+	COMPATPATH                    = URI_PATH_SEP
+	TRANSACTWRITEITEMSPATH        = URI_PATH_SEP + bbpd_endpoints.TRANSACT_WRITE_ITEMS
+	TRANSACTGETITEMSPATH          = URI_PATH_SEP + bbpd_endpoints.TRANSACT_GET_ITEMS
+	TRANSACTWRITEITEMSJSONPATH    = URI_PATH_SEP + transact_route.WRITE_JSON_ENDPOINT_NAME
+	TRANSACTGETITEMSJSONPATH      = URI_PATH_SEP + transact_route.GET_JSON_ENDPOINT_NAME
+	EXECUTESTATEMENTPATH          = URI_PATH_SEP + bbpd_endpoints.EXECUTE_STATEMENT
+	BATCHEXECUTESTATEMENTPATH     = URI_PATH_SEP + bbpd_endpoints.BATCH_EXECUTE_STATEMENT
+	DESCRIBETIMETOLIVEPATH        = URI_PATH_SEP + bbpd_endpoints.DESCRIBE_TIME_TO_LIVE
+	UPDATETIMETOLIVEPATH          = URI_PATH_SEP + bbpd_endpoints.UPDATE_TIME_TO_LIVE
+	TAGRESOURCEPATH               = URI_PATH_SEP + bbpd_endpoints.TAG_RESOURCE
+	UNTAGRESOURCEPATH             = URI_PATH_SEP + bbpd_endpoints.UNTAG_RESOURCE
+	LISTTAGSOFRESOURCEPATH        = URI_PATH_SEP + bbpd_endpoints.LIST_TAGS_OF_RESOURCE
+	DESCRIBELIMITSPATH            = URI_PATH_SEP + bbpd_endpoints.DESCRIBE_LIMITS
+	CREATEBACKUPPATH              = URI_PATH_SEP + bbpd_endpoints.CREATE_BACKUP
+	DESCRIBEBACKUPPATH            = URI_PATH_SEP + bbpd_endpoints.DESCRIBE_BACKUP
+	LISTBACKUPSPATH               = URI_PATH_SEP + bbpd_endpoints.LIST_BACKUPS
+	DELETEBACKUPPATH              = URI_PATH_SEP + bbpd_endpoints.DELETE_BACKUP
+	RESTORETABLEFROMBACKUPPATH    = URI_PATH_SEP + bbpd_endpoints.RESTORE_TABLE_FROM_BACKUP
+	RESTORETABLETOPOINTINTIMEPATH = URI_PATH_SEP + bbpd_endpoints.RESTORE_TABLE_TO_POINT
+	DESCRIBECONTINUOUSBACKUPSPATH = URI_PATH_SEP + bbpd_endpoints.DESCRIBE_CONTINUOUS_BACKUPS
+	UPDATECONTINUOUSBACKUPSPATH   = URI_PATH_SEP + bbpd_endpoints.UPDATE_CONTINUOUS_BACKUPS
 )
 
+// the operation a client must be allowed by the authentication policy to use the admin
+// endpoints
+const ADMIN_OPERATION = "Admin"
+
+// operations that bbpd relays to Dynamo as they are, by route
+var rawPostOperations = map[string]string{
+	TRANSACTWRITEITEMSPATH:        bbpd_endpoints.Target(bbpd_endpoints.TRANSACT_WRITE_ITEMS),
+	TRANSACTGETITEMSPATH:          bbpd_endpoints.Target(bbpd_endpoints.TRANSACT_GET_ITEMS),
+	EXECUTESTATEMENTPATH:          bbpd_endpoints.Target(bbpd_endpoints.EXECUTE_STATEMENT),
+	BATCHEXECUTESTATEMENTPATH:     bbpd_endpoints.Target(bbpd_endpoints.BATCH_EXECUTE_STATEMENT),
+	DESCRIBETIMETOLIVEPATH:        bbpd_endpoints.Target(bbpd_endpoints.DESCRIBE_TIME_TO_LIVE),
+	UPDATETIMETOLIVEPATH:          bbpd_endpoints.Target(bbpd_endpoints.UPDATE_TIME_TO_LIVE),
+	TAGRESOURCEPATH:               bbpd_endpoints.Target(bbpd_endpoints.TAG_RESOURCE),
+	UNTAGRESOURCEPATH:             bbpd_endpoints.Target(bbpd_endpoints.UNTAG_RESOURCE),
+	LISTTAGSOFRESOURCEPATH:        bbpd_endpoints.Target(bbpd_endpoints.LIST_TAGS_OF_RESOURCE),
+	DESCRIBELIMITSPATH:            bbpd_endpoints.Target(bbpd_endpoints.DESCRIBE_LIMITS),
+	CREATEBACKUPPATH:              bbpd_endpoints.Target(bbpd_endpoints.CREATE_BACKUP),
+	DESCRIBEBACKUPPATH:            bbpd_endpoints.Target(bbpd_endpoints.DESCRIBE_BACKUP),
+	LISTBACKUPSPATH:               bbpd_endpoints.Target(bbpd_endpoints.LIST_BACKUPS),
+	DELETEBACKUPPATH:              bbpd_endpoints.Target(bbpd_endpoints.DELETE_BACKUP),
+	RESTORETABLEFROMBACKUPPATH:    bbpd_endpoints.Target(bbpd_endpoints.RESTORE_TABLE_FROM_BACKUP),
+	RESTORETABLETOPOINTINTIMEPATH: bbpd_endpoints.Target(bbpd_endpoints.RESTORE_TABLE_TO_POINT),
+	DESCRIBECONTINUOUSBACKUPSPATH: bbpd_endpoints.Target(bbpd_endpoints.DESCRIBE_CONTINUOUS_BACKUPS),
+	UPDATECONTINUOUSBACKUPSPATH:   bbpd_endpoints.Target(bbpd_endpoints.UPDATE_CONTINUOUS_BACKUPS),
+}
+
 var (
 	availableGetHandlers  []string
 	availablePostHandlers []string
@@ -86,6 +160,13 @@ type Status_Struct struct {
 	AvailableHandlers []string
 	Args              map[string]string
 	Summary           bbpd_stats.Summary
+	WriteBehind       write_behind.Summary
+	Spool             bbpd_spool.Summary
+	Capacity          map[string]bbpd_capacity.TableUsage
+	RateLimits        []bbpd_ratelimit.State
+	Concurrency       []bbpd_adaptive.State
+	TypeHints         []bbpd_hints.State
+	ReadOnly          bool
 }
 
 func init() {
@@ -94,15 +175,20 @@ func init() {
 	// available handlers
 	availableGetHandlers = []string{
 		DESCRIBETABLEGETPATH,
+		METRICSPATH,
+		CAPACITYPATH,
 	}
 	availablePostHandlers = []string{
 		DELETEITEMPATH,
+		DELETEITEMJSONPATH,
+		DELETETABLEPATH,
 		LISTTABLESPATH,
 		CREATETABLEPATH,
 		UPDATETABLEPATH,
 		STATUSTABLEPATH,
 		PUTITEMPATH,
 		PUTITEMJSONPATH,
+		PUTITEMASYNCPATH,
 		GETITEMPATH,
 		GETITEMJSONPATH,
 		BATCHGETITEMPATH,
@@ -110,10 +196,35 @@ func init() {
 		BATCHWRITEITEMPATH,
 		BATCHWRITEITEMJSONPATH,
 		UPDATEITEMPATH,
+		UPDATEITEMJSONPATH,
 		QUERYPATH,
+		QUERYJSONPATH,
 		SCANPATH,
+		SCANJSONPATH,
+		PARALLELSCANPATH,
+		PARALLELSCANJSONPATH,
 		RAWPOSTPATH,
 		COMPATPATH,
+		TRANSACTWRITEITEMSPATH,
+		TRANSACTGETITEMSPATH,
+		TRANSACTWRITEITEMSJSONPATH,
+		TRANSACTGETITEMSJSONPATH,
+		EXECUTESTATEMENTPATH,
+		BATCHEXECUTESTATEMENTPATH,
+		DESCRIBETIMETOLIVEPATH,
+		UPDATETIMETOLIVEPATH,
+		TAGRESOURCEPATH,
+		UNTAGRESOURCEPATH,
+		LISTTAGSOFRESOURCEPATH,
+		DESCRIBELIMITSPATH,
+		CREATEBACKUPPATH,
+		DESCRIBEBACKUPPATH,
+		LISTBACKUPSPATH,
+		DELETEBACKUPPATH,
+		RESTORETABLEFROMBACKUPPATH,
+		RESTORETABLETOPOINTINTIMEPATH,
+		DESCRIBECONTINUOUSBACKUPSPATH,
+		UPDATECONTINUOUSBACKUPSPATH,
 	}
 	availableHandlers = append(availableHandlers, availableGetHandlers...)
 	availableHandlers = append(availableHandlers, availablePostHandlers...)
@@ -135,7 +246,7 @@ func statusHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	if req.Method != "GET" {
 		e := "method only supports GET"
-		http.Error(w, e, http.StatusBadRequest)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	var ss Status_Struct
@@ -144,13 +255,26 @@ func statusHandler(w http.ResponseWriter, req *http.Request) {
 
 	ss.Args[bbpd_const.X_BBPD_VERBOSE] = "set '-H \"X-Bbpd-Verbose: True\" ' to get verbose output"
 	ss.Args[bbpd_const.X_BBPD_INDENT] = "set '-H \"X-Bbpd-Indent: True\" ' to indent the top-level json"
+	ss.Args[bbpd_const.X_BBPD_PAGINATE] = "set '-H \"X-Bbpd-Paginate: True\" ' to have Query and Scan follow LastEvaluatedKey"
+	ss.Args[bbpd_const.X_BBPD_MAX_ITEMS] = "set '-H \"X-Bbpd-Max-Items: N\" ' to stop pagination after N items"
+	ss.Args[bbpd_const.X_BBPD_MAX_PAGES] = "set '-H \"X-Bbpd-Max-Pages: N\" ' to stop pagination after N pages"
+	ss.Args[bbpd_const.X_BBPD_STREAM] = "set '-H \"X-Bbpd-Stream: True\" ' to stream all Query and Scan pages as newline-delimited json"
+	ss.Args[bbpd_const.X_BBPD_ASYNC] = "set '-H \"X-Bbpd-Async: True\" ' to queue a PutItem for write-behind"
+	ss.Args[bbpd_const.X_BBPD_CONCURRENCY] = "set '-H \"X-Bbpd-Concurrency: N\" ' to scan at most N segments at once with ParallelScan"
 	ss.AvailableHandlers = availableHandlers
 	ss.Summary = bbpd_stats.GetSummary()
+	ss.WriteBehind = write_behind.GetSummary()
+	ss.Spool = bbpd_spool.GetSummary()
+	ss.Capacity = bbpd_capacity.GetUsage()
+	ss.RateLimits = bbpd_ratelimit.GetState()
+	ss.Concurrency = bbpd_adaptive.GetState()
+	ss.TypeHints = bbpd_hints.GetState()
+	ss.ReadOnly = bbpd_readonly.Enabled()
 	sj, sj_err := json.Marshal(ss)
 	if sj_err != nil {
 		e := fmt.Sprintf("bbpd_route.statusHandler:status marshal err %s", sj_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -163,24 +287,160 @@ func statusHandler(w http.ResponseWriter, req *http.Request) {
 		"Status")
 	if mr_err != nil {
 		e := fmt.Sprintf("bbpd_route.StatusHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// Configure applies the bbpd conf to the optional features. bbpd_conf.Read must be called first.
+func Configure() {
+	bbpd_conf.Vals.ConfLock.RLock()
+	cache_conf := bbpd_conf.Vals.Cache
+	batch_conf := bbpd_conf.Vals.GetItemBatching
+	write_behind_conf := bbpd_conf.Vals.WriteBehind
+	capacity_conf := bbpd_conf.Vals.Capacity
+	rate_limit_conf := bbpd_conf.Vals.RateLimit
+	adaptive_conf := bbpd_conf.Vals.Adaptive
+	type_hints_conf := bbpd_conf.Vals.TypeHints
+	auth_conf := bbpd_conf.Vals.Auth
+	delete_table_conf := bbpd_conf.Vals.DeleteTable
+	read_only := bbpd_conf.Vals.ReadOnly
+	log_level := bbpd_conf.Vals.LogLevel
+	bbpd_conf.Vals.ConfLock.RUnlock()
+
+	level_err := bbpd_log.SetLevel(log_level)
+	if level_err != nil {
+		e := fmt.Sprintf("bbpd_route.Configure:%s", level_err.Error())
+		bbpd_log.Errorf(e)
+	}
+
+	bbpd_cache.Configure(cache_conf.Size, time.Duration(cache_conf.TTLSeconds)*time.Second)
+	if cache_conf.Size > 0 {
+		e := fmt.Sprintf("item cache enabled, size %d ttl %v", cache_conf.Size, bbpd_cache.TTL())
+		bbpd_log.Infof(e)
+	}
+
+	if batch_conf.WindowMillis > 0 {
+		e := fmt.Sprintf("GetItem batching enabled, window %dms", batch_conf.WindowMillis)
+		bbpd_log.Infof(e)
+	}
+	get_item_batcher.Configure(time.Duration(batch_conf.WindowMillis) * time.Millisecond)
+
+	if write_behind_conf.QueueSize > 0 {
+		e := fmt.Sprintf("PutItem write-behind enabled, queue size %d", write_behind_conf.QueueSize)
+		bbpd_log.Infof(e)
+	}
+	write_behind.Configure(write_behind_conf.QueueSize,
+		time.Duration(write_behind_conf.FlushMillis)*time.Millisecond)
+
+	return_consumed_capacity := capacity_conf.ReturnConsumedCapacity
+	if return_consumed_capacity == bbpd_capacity.RETURN_CONSUMED_CAPACITY_NONE {
+		return_consumed_capacity = ""
+	}
+	if return_consumed_capacity != "" {
+		e := fmt.Sprintf("consumed capacity accounting enabled, ReturnConsumedCapacity %s", return_consumed_capacity)
+		bbpd_log.Infof(e)
+	}
+	bbpd_capacity.Configure(return_consumed_capacity)
+
+	if len(rate_limit_conf.Tables) != 0 {
+		e := fmt.Sprintf("rate limiting enabled for %d table entries", len(rate_limit_conf.Tables))
+		bbpd_log.Infof(e)
+	}
+	bbpd_ratelimit.Configure(rate_limit_conf.IdentityHeader,
+		time.Duration(rate_limit_conf.MaxWaitMillis)*time.Millisecond,
+		rate_limit_conf.Tables)
+
+	if adaptive_conf.MaxConcurrency > 0 {
+		e := fmt.Sprintf("adaptive concurrency limit enabled, max %d per table", adaptive_conf.MaxConcurrency)
+		bbpd_log.Infof(e)
+	}
+	bbpd_adaptive.Configure(adaptive_conf.InitialConcurrency,
+		adaptive_conf.MinConcurrency,
+		adaptive_conf.MaxConcurrency,
+		adaptive_conf.Backoff,
+		time.Duration(adaptive_conf.MaxWaitMillis)*time.Millisecond)
+
+	if type_hints_conf.Enabled {
+		e := fmt.Sprintf("lossless JSON coercion enabled, type hints for %d tables", len(type_hints_conf.Tables))
+		if type_hints_conf.LearnKeySchema {
+			e += ", learning key schemas"
+		}
+		bbpd_log.Infof(e)
+	}
+	bbpd_hints.Configure(type_hints_conf.Enabled,
+		type_hints_conf.LearnKeySchema,
+		type_hints_conf.Tables)
+
+	if auth_conf.PolicyFile != "" {
+		e := fmt.Sprintf("client authentication enabled, policy %s", auth_conf.PolicyFile)
+		bbpd_log.Infof(e)
 	}
+	auth_err := bbpd_auth.Configure(auth_conf.PolicyFile)
+	if auth_err != nil {
+		e := fmt.Sprintf("bbpd_route.Configure:%s", auth_err.Error())
+		bbpd_log.Errorf(e)
+	}
+
+	if len(delete_table_conf.Tables) != 0 {
+		e := fmt.Sprintf("DeleteTable enabled for tables matching %s", strings.Join(delete_table_conf.Tables, ","))
+		if delete_table_conf.RequireDryRun {
+			e += ", dry run required"
+		}
+		bbpd_log.Infof(e)
+	}
+	delete_table_route.Configure(delete_table_conf.Tables,
+		delete_table_conf.RequireDryRun,
+		time.Duration(delete_table_conf.DryRunWindowSeconds)*time.Second)
+
+	bbpd_readonly.Configure(read_only)
+}
+
+// openSpool opens the write spool, if configured, and replays any writes spooled by a
+// previous run. It is called once a port has been found, so that an instance that exits
+// because another is running does not replay that instance's spool.
+func openSpool() error {
+	bbpd_conf.Vals.ConfLock.RLock()
+	spool_conf := bbpd_conf.Vals.Spool
+	bbpd_conf.Vals.ConfLock.RUnlock()
+	if spool_conf.Dir == "" {
+		return nil
+	}
+	e := fmt.Sprintf("write spool enabled in %s", spool_conf.Dir)
+	bbpd_log.Infof(e)
+	open_err := bbpd_spool.Open(spool_conf.Dir)
+	if open_err != nil {
+		return open_err
+	}
+	bbpd_spool.Replay(time.Duration(spool_conf.ReplayTimeoutSeconds) * time.Second)
+	return nil
 }
 
 // can we use this port?
 func canAssignPort(requestedPort int) bool {
-	_, err := net.Dial("tcp", bbpd_const.LOCALHOST+":"+strconv.Itoa(requestedPort))
-	return err != nil
+	return bbpd_listen.CanAssign(":" + strconv.Itoa(requestedPort))
 }
 
-// CompatHandler allows bbpd to act as a partial pass-through proxy. Users can provide
-// their own body and endpoint target header, but other headers are ignored.
+// CompatHandler allows bbpd to act as a pass-through proxy that speaks the DynamoDB wire
+// protocol, so an AWS SDK may use bbpd as its endpoint. Users can provide their own body
+// and endpoint target header; a SigV4 Authorization header is accepted but not checked,
+// as bbpd signs the request itself. Responses, including errors, carry the status code and
+// body DynamoDB returned, with the x-amzn-RequestId and x-amz-crc32 headers.
 // To use this, set headers with your http client. For example, with curl:
 // curl -H "X-Amz-Target: DynamoDB_20120810.DescribeTable" -X POST -d '{"TableName":"mytable"}' http://localhost:12333/
 // or alternately
 // curl -H "X-Amz-Target: DescribeTable" -X POST -d '{"TableName":"mytable"}' http://localhost:12333/
 // if you wish to just use the default API version string.
 func CompatHandler(w http.ResponseWriter, req *http.Request) {
+	// a streamed response is written as it is read, so it cannot be checksummed
+	if bbpd_paginate.StreamRequested(req) {
+		compatHandler(w, req)
+		return
+	}
+	bbpd_wire.Serve(w, req, compatHandler)
+}
+
+// compatHandler calls the handler named by the X-Amz-Target header.
+func compatHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
 	}
@@ -188,8 +448,8 @@ func CompatHandler(w http.ResponseWriter, req *http.Request) {
 	target_, target_ok := req.Header[aws_const.AMZ_TARGET_HDR]
 	if !target_ok {
 		e := fmt.Sprintf("bbpd_route.CompatHandler:missing %s", aws_const.AMZ_TARGET_HDR)
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	target := target_[0]
@@ -200,8 +460,8 @@ func CompatHandler(w http.ResponseWriter, req *http.Request) {
 		vers_target := strings.SplitN(target, target_version_delim, 2)
 		if vers_target[0] != aws_const.CURRENT_API_VERSION {
 			e := fmt.Sprintf("bbpd_route.CompatHandler:unsupported API version '%s'", vers_target[0])
-			log.Printf(e)
-			http.Error(w, e, http.StatusBadRequest)
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
 			return
 		}
 		normalized_target = vers_target[1]
@@ -209,8 +469,15 @@ func CompatHandler(w http.ResponseWriter, req *http.Request) {
 	endpoint_path := "/" + normalized_target
 	if endpoint_path == COMPATPATH || normalized_target == "" {
 		e := fmt.Sprintf("bbpd_route.CompatHandler:must call named endpoint")
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	if !bbpd_auth.Authorized(w, req, normalized_target) {
+		return
+	}
+	if bbpd_readonly.Refused(w, req, normalized_target) {
 		return
 	}
 
@@ -228,6 +495,9 @@ func CompatHandler(w http.ResponseWriter, req *http.Request) {
 	case UPDATETABLEPATH:
 		update_table_route.RawPostHandler(w, req)
 		return
+	case DELETETABLEPATH:
+		delete_table_route.RawPostHandler(w, req)
+		return
 	case STATUSTABLEPATH:
 		describe_table_route.StatusTableHandler(w, req)
 		return
@@ -256,83 +526,314 @@ func CompatHandler(w http.ResponseWriter, req *http.Request) {
 		scan_route.RawPostHandler(w, req)
 		return
 	default:
+		if amzTarget, ok := rawPostOperations[endpoint_path]; ok {
+			raw_post_route.RawPostReq(w, req, amzTarget)
+			return
+		}
 		e := fmt.Sprintf("bbpd_route.CompatHandler:unknown endpoint '%s'", endpoint_path)
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.TypedError(w, aws_error.SERVICE_PREFIX+aws_error.UNKNOWN_OPERATION, e, http.StatusBadRequest)
 		return
 	}
 }
 
+// handle registers the handler h for path, for clients that may call the operation op, if
+// bbpd is not in read-only mode or op is a read.
+func handle(path, op string, h http.HandlerFunc) {
+	http.HandleFunc(path, bbpd_auth.Handler(op, bbpd_readonly.Handler(op, h)))
+}
+
+// operation returns the name of the operation amzTarget, without the API version.
+func operation(amzTarget string) string {
+	return amzTarget[strings.LastIndex(amzTarget, ".")+1:]
+}
+
+// rawPostPathHandler relays requests to the endpoint named in the path, as
+// /RawPost/DynamoDB_20120810.GetItem, for clients that may call it.
+func rawPostPathHandler(w http.ResponseWriter, req *http.Request) {
+	amzTarget, ue_err := url.QueryUnescape(req.URL.Path[len(RAWPOSTPATH):])
+	if ue_err != nil {
+		amzTarget = ""
+	}
+	if !bbpd_auth.Authorized(w, req, operation(amzTarget)) {
+		return
+	}
+	if bbpd_readonly.Refused(w, req, operation(amzTarget)) {
+		return
+	}
+	// table deletions are only relayed if they pass the checks of delete_table_route
+	if operation(amzTarget) == delete_table.ENDPOINT_NAME {
+		delete_table_route.RawPostHandler(w, req)
+		return
+	}
+	raw_post_route.RawPostHandler(w, req)
+}
+
+// rawPostHandler returns a handler that relays requests to the endpoint amzTarget directly.
+func rawPostHandler(amzTarget string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		raw_post_route.RawPostReq(w, req, amzTarget)
+	}
+}
+
 // StartBBPD is where the proxy http server is started.
-// The requestedPort is a *int so it can be nil'able. passing 0 as an implied
-// null value could result in a dial that takes any available port, as is
-// implied by the go docs.
+// It listens on each configured TCP address and Unix domain socket that is not already in
+// use. If none are configured, it listens on the first of requestedPorts that is free, on all
+// interfaces. If nothing can be listened on, it returns nil, as another bbpd is presumed to
+// be running. If TLS is configured, the TCP listeners serve HTTPS.
 func StartBBPD(requestedPorts []int) error {
-	// try to get a port to listen to
-	for _, p := range requestedPorts {
-		e := fmt.Sprintf("trying to bind to port:%d", p)
-		log.Printf(e)
-		if canAssignPort(p) {
+	bbpd_conf.Vals.ConfLock.RLock()
+	listen_conf := bbpd_conf.Vals.Listen
+	tls_conf := bbpd_conf.Vals.TLS
+	bbpd_conf.Vals.ConfLock.RUnlock()
+
+	// load the certificates before taking any port, so a bad configuration does not leave
+	// a running instance's ports held
+	tls_err := bbpd_tls.Configure(tls_conf.CertFile, tls_conf.KeyFile, tls_conf.ClientCAFile)
+	if tls_err != nil {
+		return tls_err
+	}
+
+	listeners := make([]net.Listener, 0)
+	var socket_listener net.Listener
+	if len(listen_conf.Addresses) == 0 && listen_conf.Socket == "" {
+		// try to get a port to listen to
+		for _, p := range requestedPorts {
+			e := fmt.Sprintf("trying to bind to port:%d", p)
+			bbpd_log.Infof(e)
+			if canAssignPort(p) {
+				l, listen_err := net.Listen("tcp", ":"+strconv.Itoa(p))
+				if listen_err != nil {
+					return listen_err
+				}
+				listeners = append(listeners, l)
+				port = &p
+				break
+			} else {
+				e := fmt.Sprintf("port %d already in use", p)
+				bbpd_log.Infof(e)
+			}
+		}
+	}
+	for _, addr := range listen_conf.Addresses {
+		e := fmt.Sprintf("trying to bind to address:%s", addr)
+		bbpd_log.Infof(e)
+		l, listen_err := bbpd_listen.TCP(addr)
+		if listen_err != nil {
+			return listen_err
+		}
+		if l == nil {
+			e := fmt.Sprintf("address %s already in use", addr)
+			bbpd_log.Infof(e)
+			continue
+		}
+		listeners = append(listeners, l)
+		if port == nil {
+			p := l.Addr().(*net.TCPAddr).Port
 			port = &p
-			break
+		}
+	}
+	if listen_conf.Socket != "" {
+		mode, mode_err := bbpd_listen.ParseMode(listen_conf.SocketMode)
+		if mode_err != nil {
+			return mode_err
+		}
+		e := fmt.Sprintf("trying to bind to socket:%s", listen_conf.Socket)
+		bbpd_log.Infof(e)
+		l, listen_err := bbpd_listen.Unix(listen_conf.Socket, mode)
+		if listen_err != nil {
+			return listen_err
+		}
+		if l == nil {
+			e := fmt.Sprintf("socket %s already in use", listen_conf.Socket)
+			bbpd_log.Infof(e)
 		} else {
-			e := fmt.Sprintf("port %d already in use", p)
-			log.Printf(e)
+			socket_listener = l
 		}
 	}
-	if port == nil {
+	if len(listeners) == 0 && socket_listener == nil {
 		// if all ports are in use, we may assume that other bbpd invocations are
 		// running correctly. in which case, return nil here and the caller will
 		// exit with code 0, which is important to prevent rc managers etc from
 		// automatically respawning the program
-		log.Printf("bbpd_route.StartBBPD:no listen port")
+		bbpd_log.Errorf("bbpd_route.StartBBPD:no listen port")
 		return nil
 	}
-	e := fmt.Sprintf("init routing on port %d", *port)
-	log.Printf(e)
-	http.HandleFunc(STATUSPATH, statusHandler)
-	http.HandleFunc(DESCRIBETABLEPATH, describe_table_route.RawPostHandler)
-	http.HandleFunc(DESCRIBETABLEGETPATH, describe_table_route.DescribeTableHandler)
-	http.HandleFunc(LISTTABLESPATH, list_tables_route.ListTablesHandler)
-	http.HandleFunc(CREATETABLEPATH, create_table_route.RawPostHandler)
-	http.HandleFunc(UPDATETABLEPATH, update_table_route.RawPostHandler)
-	http.HandleFunc(STATUSTABLEPATH, describe_table_route.StatusTableHandler)
-	http.HandleFunc(PUTITEMPATH, put_item_route.RawPostHandler)
-	http.HandleFunc(PUTITEMJSONPATH, put_item_route.PutItemJSONHandler)
-	http.HandleFunc(GETITEMPATH, get_item_route.RawPostHandler)
-	http.HandleFunc(GETITEMJSONPATH, get_item_route.GetItemJSONHandler)
-	http.HandleFunc(BATCHGETITEMPATH, batch_get_item_route.BatchGetItemHandler)
-	http.HandleFunc(BATCHGETITEMJSONPATH, batch_get_item_route.BatchGetItemJSONHandler)
-	http.HandleFunc(BATCHWRITEITEMPATH, batch_write_item_route.BatchWriteItemHandler)
-	http.HandleFunc(BATCHWRITEITEMJSONPATH, batch_write_item_route.BatchWriteItemJSONHandler)
-	http.HandleFunc(DELETEITEMPATH, delete_item_route.RawPostHandler)
-	http.HandleFunc(UPDATEITEMPATH, update_item_route.RawPostHandler)
-	http.HandleFunc(QUERYPATH, query_route.RawPostHandler)
-	http.HandleFunc(SCANPATH, scan_route.RawPostHandler)
-	http.HandleFunc(RAWPOSTPATH, raw_post_route.RawPostHandler)
+	for _, l := range listeners {
+		scheme := "http"
+		if bbpd_tls.Enabled() {
+			scheme = "https"
+		}
+		e := fmt.Sprintf("init routing on %s %s %s", l.Addr().Network(), l.Addr().String(), scheme)
+		bbpd_log.Infof(e)
+	}
+	if socket_listener != nil {
+		e := fmt.Sprintf("init routing on unix %s", socket_listener.Addr().String())
+		bbpd_log.Infof(e)
+	}
+	handle(STATUSPATH, "Status", statusHandler)
+	handle(METRICSPATH, bbpd_metrics.ENDPOINT_NAME, bbpd_metrics.MetricsHandler)
+	handle(CAPACITYPATH, bbpd_capacity.ENDPOINT_NAME, bbpd_capacity.CapacityHandler)
+	handle(DESCRIBETABLEPATH, desc.ENDPOINT_NAME, describe_table_route.RawPostHandler)
+	http.HandleFunc(DESCRIBETABLEGETPATH, bbpd_auth.PathHandler(desc.ENDPOINT_NAME, describe_table_route.DescribeTableHandler))
+	handle(LISTTABLESPATH, list.ENDPOINT_NAME, list_tables_route.ListTablesHandler)
+	handle(CREATETABLEPATH, create.ENDPOINT_NAME, create_table_route.RawPostHandler)
+	handle(UPDATETABLEPATH, update_table.ENDPOINT_NAME, update_table_route.RawPostHandler)
+	http.HandleFunc(STATUSTABLEPATH, bbpd_auth.PathHandler(desc.ENDPOINT_NAME, describe_table_route.StatusTableHandler))
+	handle(PUTITEMPATH, put.ENDPOINT_NAME, put_item_route.RawPostHandler)
+	handle(PUTITEMJSONPATH, put.ENDPOINT_NAME, put_item_route.PutItemJSONHandler)
+	handle(PUTITEMASYNCPATH, put.ENDPOINT_NAME, put_item_route.PutItemAsyncHandler)
+	handle(GETITEMPATH, get.ENDPOINT_NAME, get_item_route.RawPostHandler)
+	handle(GETITEMJSONPATH, get.ENDPOINT_NAME, get_item_route.GetItemJSONHandler)
+	handle(BATCHGETITEMPATH, bgi.ENDPOINT_NAME, batch_get_item_route.BatchGetItemHandler)
+	handle(BATCHGETITEMJSONPATH, bgi.ENDPOINT_NAME, batch_get_item_route.BatchGetItemJSONHandler)
+	handle(BATCHWRITEITEMPATH, bwi.ENDPOINT_NAME, batch_write_item_route.BatchWriteItemHandler)
+	handle(BATCHWRITEITEMJSONPATH, bwi.ENDPOINT_NAME, batch_write_item_route.BatchWriteItemJSONHandler)
+	handle(DELETEITEMPATH, delete_item.ENDPOINT_NAME, delete_item_route.RawPostHandler)
+	handle(DELETEITEMJSONPATH, delete_item.ENDPOINT_NAME, delete_item_route.DeleteItemJSONHandler)
+	handle(UPDATEITEMPATH, update_item.ENDPOINT_NAME, update_item_route.RawPostHandler)
+	handle(UPDATEITEMJSONPATH, update_item.ENDPOINT_NAME, update_item_route.UpdateItemJSONHandler)
+	handle(QUERYPATH, query.ENDPOINT_NAME, query_route.RawPostHandler)
+	handle(QUERYJSONPATH, query.ENDPOINT_NAME, query_route.QueryJSONHandler)
+	handle(SCANPATH, scan.ENDPOINT_NAME, scan_route.RawPostHandler)
+	handle(SCANJSONPATH, scan.ENDPOINT_NAME, scan_route.ScanJSONHandler)
+	handle(PARALLELSCANPATH, scan.ENDPOINT_NAME, parallel_scan_route.ParallelScanHandler)
+	handle(PARALLELSCANJSONPATH, scan.ENDPOINT_NAME, parallel_scan_route.ParallelScanJSONHandler)
+	http.HandleFunc(RAWPOSTPATH, rawPostPathHandler)
 	http.HandleFunc(COMPATPATH, CompatHandler)
+	handle(TRANSACTWRITEITEMSJSONPATH, bbpd_endpoints.TRANSACT_WRITE_ITEMS, transact_route.TransactWriteItemsJSONHandler)
+	handle(TRANSACTGETITEMSJSONPATH, bbpd_endpoints.TRANSACT_GET_ITEMS, transact_route.TransactGetItemsJSONHandler)
+	for path, amzTarget := range rawPostOperations {
+		handle(path, operation(amzTarget), rawPostHandler(amzTarget))
+	}
 
-	// undelete these to enable table deletions, a little dangerous!
-	// http.HandleFunc(DELETETABLEPATH,     delete_table_route.RawPostHandler)
-	// http.HandleFunc(DELETETABLEGETPATH,  delete_table_route.DeleteTableHandler)
+	// table deletions are refused unless configured, see delete_table_route
+	handle(DELETETABLEPATH, delete_table.ENDPOINT_NAME, delete_table_route.DeleteTableHandler)
 
 	const SERV_TIMEOUT = 20
 	srv = &http.Server{
-		Addr: ":" + strconv.Itoa(*port),
 		// The timeouts seems too-long, but they accomodates the exponential decay retry loop.
 		// Programs using this can either change these directly or use goroutine timeouts
 		// to impose a local minimum.
+		Handler:      bbpd_log.Requests(bbpd_metrics.Instrument(http.DefaultServeMux)),
 		ReadTimeout:  SERV_TIMEOUT * time.Second,
 		WriteTimeout: SERV_TIMEOUT * time.Second,
 		ConnState: func(conn net.Conn, new_state http.ConnState) {
-			bbpd_runinfo.RecordConnState(new_state)
+			bbpd_runinfo.RecordConnState(conn, new_state)
 			return
 		},
 	}
+	// writes spooled by a previous run are replayed before any new ones are accepted
+	spool_err := openSpool()
+	if spool_err != nil {
+		return spool_err
+	}
+
+	if bbpd_tls.Enabled() {
+		srv.TLSConfig = bbpd_tls.Config()
+	}
+
+	admin_err := startAdmin()
+	if admin_err != nil {
+		return admin_err
+	}
+
 	bbpd_runinfo.SetBBPDAccept()
-	return srv.ListenAndServe()
+	return serve(srv, listeners, socket_listener)
 }
 
+// startAdmin serves the admin endpoints on the configured address and socket, if any, in the
+// background. An address or socket that is in use is skipped. The admin server has its own
+// connections, so draining and shutting down do not wait for them.
+func startAdmin() error {
+	bbpd_conf.Vals.ConfLock.RLock()
+	admin_conf := bbpd_conf.Vals.Admin
+	bbpd_conf.Vals.ConfLock.RUnlock()
+
+	listeners := make([]net.Listener, 0)
+	if admin_conf.Address != "" {
+		l, listen_err := bbpd_listen.TCP(admin_conf.Address)
+		if listen_err != nil {
+			return listen_err
+		}
+		if l == nil {
+			e := fmt.Sprintf("admin address %s already in use", admin_conf.Address)
+			bbpd_log.Errorf(e)
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	if admin_conf.Socket != "" {
+		mode, mode_err := bbpd_listen.ParseMode(admin_conf.SocketMode)
+		if mode_err != nil {
+			return mode_err
+		}
+		l, listen_err := bbpd_listen.Unix(admin_conf.Socket, mode)
+		if listen_err != nil {
+			return listen_err
+		}
+		if l == nil {
+			e := fmt.Sprintf("admin socket %s already in use", admin_conf.Socket)
+			bbpd_log.Errorf(e)
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	if len(listeners) == 0 {
+		return nil
+	}
+
+	const ADMIN_SERV_TIMEOUT = 20
+	admin_srv := &http.Server{
+		Handler:      bbpd_auth.Handler(ADMIN_OPERATION, bbpd_admin.Handler().ServeHTTP),
+		ReadTimeout:  ADMIN_SERV_TIMEOUT * time.Second,
+		WriteTimeout: ADMIN_SERV_TIMEOUT * time.Second,
+	}
+	for _, l := range listeners {
+		e := fmt.Sprintf("init admin routing on %s %s", l.Addr().Network(), l.Addr().String())
+		bbpd_log.Infof(e)
+		go func(l net.Listener) {
+			serve_err := admin_srv.Serve(l)
+			e := fmt.Sprintf("bbpd_route.startAdmin:admin server err %s", serve_err.Error())
+			bbpd_log.Errorf(e)
+		}(l)
+	}
+	return nil
+}
+
+// serve serves s on each of the TCP listeners, with TLS if s has a TLS configuration, and
+// on the socket listener, if any, without. It returns the first error from any of them.
+func serve(s *http.Server, listeners []net.Listener, socket_listener net.Listener) error {
+	serve_errs := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if s.TLSConfig != nil {
+				serve_errs <- s.ServeTLS(l, "", "")
+			} else {
+				serve_errs <- s.Serve(l)
+			}
+		}(l)
+	}
+	if socket_listener != nil {
+		go func() {
+			serve_errs <- s.Serve(socket_listener)
+		}()
+	}
+	return <-serve_errs
+}
+
+// StopBBPD stops accepting requests, waits for open connections, removes any socket files,
+// and then writes any queued write-behind Items, which callers have already been told were
+// accepted.
 func StopBBPD() error {
-	return bbpd_runinfo.StopBBPD()
+	stop_err := bbpd_runinfo.StopBBPD()
+	bbpd_listen.Cleanup()
+	flush_err := write_behind.Flush()
+	if flush_err != nil {
+		bbpd_log.Errorf(flush_err.Error())
+		if stop_err == nil {
+			return flush_err
+		}
+	}
+	return stop_err
 }
@@ -3,22 +3,38 @@ package bbpd_runinfo
 
 import (
 	"errors"
-	"log"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/route_response"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Conn reports the state of one open connection, and when it entered that state.
+type Conn struct {
+	Remote string
+	Local  string
+	State  string
+	Since  time.Time
+}
+
 var (
 	accepting  bool
 	accept_mut *sync.RWMutex
 	conns_wg   *sync.WaitGroup
+	open_conns int64
+	conns      map[net.Conn]*Conn
+	conns_mut  sync.Mutex
 )
 
 func init() {
 	accepting = false
 	accept_mut = new(sync.RWMutex)
 	conns_wg = new(sync.WaitGroup)
+	conns = make(map[net.Conn]*Conn)
 }
 
 // SetBBPDAccept should be called when the server is started.
@@ -28,6 +44,14 @@ func SetBBPDAccept() {
 	accept_mut.Unlock()
 }
 
+// Drain stops accepting requests, without waiting for open connections. SetBBPDAccept
+// resumes.
+func Drain() {
+	accept_mut.Lock()
+	accepting = false
+	accept_mut.Unlock()
+}
+
 // StopBBPD executes any shutdown tasks.
 func StopBBPD() error {
 	accept_mut.Lock()
@@ -40,7 +64,7 @@ func StopBBPD() error {
 	}()
 	select {
 	case <-wait_chan:
-		log.Printf("conns completed, graceful exit possible")
+		bbpd_log.Infof("conns completed, graceful exit possible")
 		return nil
 	case <-time.After(1000 * time.Millisecond):
 		return errors.New("shutdown timed out")
@@ -62,18 +86,61 @@ func BBPDAbortIfClosed(w http.ResponseWriter) bool {
 	closed := !IsAccepting()
 	if closed {
 		e := "bbpd is in a closed state and is no longer accepting connections"
-		http.Error(w, e, http.StatusServiceUnavailable)
+		route_response.Error(w, e, http.StatusServiceUnavailable)
 	}
 	return closed
 }
 
-// RecordConnState keeps track of the current connection count via a waitgroup.
-func RecordConnState(new_state http.ConnState) {
+// OpenConns returns the number of open connections.
+func OpenConns() int64 {
+	return atomic.LoadInt64(&open_conns)
+}
+
+// RecordConnState keeps track of the current connection count via a waitgroup, and of the
+// state of each connection.
+func RecordConnState(conn net.Conn, new_state http.ConnState) {
 	switch new_state {
 	case http.StateNew:
 		conns_wg.Add(1)
+		atomic.AddInt64(&open_conns, 1)
 	case http.StateClosed, http.StateHijacked:
 		conns_wg.Done()
+		atomic.AddInt64(&open_conns, -1)
 	}
+	conns_mut.Lock()
+	switch new_state {
+	case http.StateClosed, http.StateHijacked:
+		delete(conns, conn)
+	default:
+		conns[conn] = &Conn{
+			Remote: addrString(conn.RemoteAddr()),
+			Local:  addrString(conn.LocalAddr()),
+			State:  new_state.String(),
+			Since:  time.Now()}
+	}
+	conns_mut.Unlock()
 	return
 }
+
+// addrString returns the address a as a string. The peer of a Unix domain socket may have
+// no address.
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// GetConns returns the state of each open connection, oldest first.
+func GetConns() []Conn {
+	conns_mut.Lock()
+	c := make([]Conn, 0, len(conns))
+	for _, v := range conns {
+		c = append(c, *v)
+	}
+	conns_mut.Unlock()
+	sort.Slice(c, func(i, j int) bool {
+		return c[i].Since.Before(c[j].Since)
+	})
+	return c
+}
@@ -0,0 +1,687 @@
+// A durable store-and-forward spool for writes. When DynamoDB is unreachable or persistently
+// throttling, PutItem, UpdateItem and BatchWriteItem requests are appended to a write-ahead log
+// on local disk, fsynced, and acknowledged with 202 Accepted. A background drainer replays the
+// log in order, and the log is compacted once its entries are confirmed written. While a table
+// has pending entries, its later writes are spooled behind them, so that they are written in
+// order; writes to other tables are sent as usual.
+//
+// The log is a file of newline-delimited JSON records. A record with a Target and Body adds an
+// entry; a later record with the same Seq and a Body replaces the entry's Body (used when only
+// part of a BatchWriteItem was processed); a record with Done set confirms the entry.
+package bbpd_spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	"github.com/smugmug/bbpd/lib/route_response"
+	ep "github.com/smugmug/godynamo/endpoint"
+	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
+	put "github.com/smugmug/godynamo/endpoints/put_item"
+	update_item "github.com/smugmug/godynamo/endpoints/update_item"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	LOG_FILE_NAME  = "bbpd-spool.log"
+	LOCK_FILE_NAME = "bbpd-spool.lock"
+	// the log is rewritten once this many of its entries are confirmed
+	COMPACT_THRESHOLD = 1000
+	MIN_BACKOFF       = 100 * time.Millisecond
+	MAX_BACKOFF       = 30 * time.Second
+	// how long startup waits for pending entries to be replayed, by default
+	DEFAULT_REPLAY_TIMEOUT = 30 * time.Second
+)
+
+// the targets that may be spooled
+var spool_targets = map[string]bool{
+	put.PUTITEM_ENDPOINT:            true,
+	update_item.UPDATEITEM_ENDPOINT: true,
+	raw.BATCHWRITEITEM_ENDPOINT:     true,
+}
+
+// Summary reports the state of the spool.
+type Summary struct {
+	Enabled  bool
+	Dir      string
+	Pending  int
+	Spooled  uint64
+	Replayed uint64
+	Failed   uint64
+}
+
+// a line in the log
+type record struct {
+	Seq    uint64
+	Target string          `json:",omitempty"`
+	Body   json.RawMessage `json:",omitempty"`
+	Done   bool            `json:",omitempty"`
+}
+
+// a spooled request that has not been confirmed
+type entry struct {
+	seq    uint64
+	target string
+	body   []byte
+	// the tables the request writes
+	tables []string
+}
+
+var (
+	dir      string
+	log_file *os.File
+	// held open, and locked, for as long as bbpd runs
+	lock_file *os.File
+	// the size of the log, so a failed append can be rolled back
+	log_size int64
+	pending  []*entry
+	next_seq uint64
+	// confirmed entries still present in the log
+	confirmed uint64
+	spooled   uint64
+	replayed  uint64
+	failed    uint64
+	spool_mut sync.Mutex
+	// wakes the drainer when an entry is spooled
+	wake chan bool
+)
+
+func init() {
+	wake = make(chan bool, 1)
+}
+
+// Open loads the log in spool_dir, creating it if needed, and starts the drainer. Entries
+// left pending by a previous run are replayed in order. Open may only be called once;
+// the spool directory cannot be changed while bbpd is running.
+func Open(spool_dir string) error {
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	if log_file != nil {
+		if spool_dir != dir {
+			e := fmt.Sprintf("bbpd_spool.Open:spool is open in %s, restart bbpd to use %s", dir, spool_dir)
+			return errors.New(e)
+		}
+		return nil
+	}
+	mk_err := os.MkdirAll(spool_dir, 0700)
+	if mk_err != nil {
+		e := fmt.Sprintf("bbpd_spool.Open:cannot create %s: %s", spool_dir, mk_err.Error())
+		return errors.New(e)
+	}
+	// two bbpd instances must not share a spool. the lock is held on a separate file, as
+	// compaction replaces the log
+	lock_path := filepath.Join(spool_dir, LOCK_FILE_NAME)
+	lf, lock_open_err := os.OpenFile(lock_path, os.O_RDWR|os.O_CREATE, 0600)
+	if lock_open_err != nil {
+		e := fmt.Sprintf("bbpd_spool.Open:cannot open %s: %s", lock_path, lock_open_err.Error())
+		return errors.New(e)
+	}
+	lock_err := syscall.Flock(int(lf.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if lock_err != nil {
+		lf.Close()
+		e := fmt.Sprintf("bbpd_spool.Open:cannot lock %s, is another bbpd using it? %s", lock_path, lock_err.Error())
+		return errors.New(e)
+	}
+	path := filepath.Join(spool_dir, LOG_FILE_NAME)
+	f, open_err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if open_err != nil {
+		lf.Close()
+		e := fmt.Sprintf("bbpd_spool.Open:cannot open %s: %s", path, open_err.Error())
+		return errors.New(e)
+	}
+	entries, size, load_err := load(f)
+	if load_err != nil {
+		f.Close()
+		lf.Close()
+		e := fmt.Sprintf("bbpd_spool.Open:cannot load %s: %s", path, load_err.Error())
+		return errors.New(e)
+	}
+	dir = spool_dir
+	lock_file = lf
+	log_file = f
+	log_size = size
+	pending = entries
+	next_seq = 1
+	if len(entries) > 0 {
+		next_seq = entries[len(entries)-1].seq + 1
+		e := fmt.Sprintf("bbpd_spool.Open:%d pending entries in %s", len(entries), path)
+		bbpd_log.Infof(e)
+	}
+	// start from a compact log
+	if c_err := compact(); c_err != nil {
+		bbpd_log.Errorf(c_err.Error())
+	}
+	go drainer()
+	return nil
+}
+
+// load reads the log in f and returns the unconfirmed entries in order, and the length of
+// the valid log. A partial record at the end of the log, left by a crash during an append,
+// is truncated; the caller was never told it was spooled.
+func load(f *os.File) ([]*entry, int64, error) {
+	if _, seek_err := f.Seek(0, io.SeekStart); seek_err != nil {
+		return nil, 0, seek_err
+	}
+	by_seq := make(map[uint64]*entry)
+	order := make([]uint64, 0)
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		line, read_err := r.ReadBytes('\n')
+		if read_err == io.EOF {
+			if len(line) != 0 {
+				bbpd_log.Errorf("bbpd_spool.load:truncating partial record at offset %d", size)
+				if t_err := f.Truncate(size); t_err != nil {
+					return nil, 0, t_err
+				}
+			}
+			break
+		}
+		if read_err != nil {
+			return nil, 0, read_err
+		}
+		var rec record
+		if um_err := json.Unmarshal(line, &rec); um_err != nil {
+			e := fmt.Sprintf("corrupt record at offset %d: %s", size, um_err.Error())
+			return nil, 0, errors.New(e)
+		}
+		size += int64(len(line))
+		switch {
+		case rec.Done:
+			delete(by_seq, rec.Seq)
+		case rec.Target != "":
+			by_seq[rec.Seq] = &entry{seq: rec.Seq, target: rec.Target, body: []byte(rec.Body),
+				tables: tables([]byte(rec.Body))}
+			order = append(order, rec.Seq)
+		default:
+			if en, ok := by_seq[rec.Seq]; ok {
+				en.body = []byte(rec.Body)
+			}
+		}
+	}
+	entries := make([]*entry, 0, len(by_seq))
+	for _, seq := range order {
+		if en, ok := by_seq[seq]; ok {
+			entries = append(entries, en)
+		}
+	}
+	return entries, size, nil
+}
+
+// Enabled returns true if the spool has been opened.
+func Enabled() bool {
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	return log_file != nil
+}
+
+// tables returns the tables written by the request bodybytes: its TableName, or the tables
+// of its RequestItems for a BatchWriteItem.
+func tables(bodybytes []byte) []string {
+	var r struct {
+		TableName    string
+		RequestItems map[string]json.RawMessage
+	}
+	if um_err := json.Unmarshal(bodybytes, &r); um_err != nil {
+		return nil
+	}
+	var t []string
+	if r.TableName != "" {
+		t = append(t, r.TableName)
+	}
+	for table := range r.RequestItems {
+		t = append(t, table)
+	}
+	return t
+}
+
+// queued returns true if any of the tables has pending entries.
+func queued(ts []string) bool {
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	for _, en := range pending {
+		for _, pt := range en.tables {
+			for _, t := range ts {
+				if pt == t {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Pending returns the number of spooled entries that have not been confirmed.
+func Pending() int {
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	return len(pending)
+}
+
+// GetSummary returns the current spool statistics.
+func GetSummary() Summary {
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	return Summary{
+		Enabled:  log_file != nil,
+		Dir:      dir,
+		Pending:  len(pending),
+		Spooled:  spooled,
+		Replayed: replayed,
+		Failed:   failed}
+}
+
+// appendRecord writes rec to the log and fsyncs it. spool_mut must be held.
+// On failure the log is truncated to its previous length.
+func appendRecord(rec record) error {
+	line, m_err := json.Marshal(rec)
+	if m_err != nil {
+		return m_err
+	}
+	line = append(line, '\n')
+	_, w_err := log_file.Write(line)
+	if w_err == nil {
+		w_err = log_file.Sync()
+	}
+	if w_err != nil {
+		if t_err := log_file.Truncate(log_size); t_err != nil {
+			bbpd_log.Errorf("bbpd_spool.appendRecord:cannot roll back failed append: %s", t_err.Error())
+		}
+		return w_err
+	}
+	log_size += int64(len(line))
+	return nil
+}
+
+// spool durably appends the request bodybytes for amzTarget to the log.
+func spool(bodybytes []byte, amzTarget string) error {
+	// compact the body, as the log is newline-delimited
+	var body bytes.Buffer
+	if c_err := json.Compact(&body, bodybytes); c_err != nil {
+		return c_err
+	}
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	if log_file == nil {
+		return errors.New("bbpd_spool.spool:spool is not open")
+	}
+	en := &entry{seq: next_seq, target: amzTarget, body: body.Bytes(), tables: tables(bodybytes)}
+	a_err := appendRecord(record{Seq: en.seq, Target: en.target, Body: en.body})
+	if a_err != nil {
+		return a_err
+	}
+	next_seq++
+	spooled++
+	pending = append(pending, en)
+	select {
+	case wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Spool durably appends the write request bodybytes for amzTarget to the log without sending
+// it, for a caller that has already acknowledged the request and could not write it. The
+// request must be one that Req would spool.
+func Spool(bodybytes []byte, amzTarget string) error {
+	if !spoolable(bodybytes, amzTarget) {
+		e := fmt.Sprintf("bbpd_spool.Spool:%s request cannot be spooled", amzTarget)
+		return errors.New(e)
+	}
+	return spool(bodybytes, amzTarget)
+}
+
+// spoolable returns true if the request can be acknowledged without a response from Dynamo,
+// and replayed safely. Requests that ask for ReturnValues need the response, and conditional
+// requests may be rejected on replay, after they were acknowledged. Updates that are not
+// idempotent, such as ADD or SET a = a + :n, may already have been applied by a request that
+// failed, and would be applied twice. BatchWriteItem requests that cannot be parsed could
+// never be replayed. None of these are spooled.
+func spoolable(bodybytes []byte, amzTarget string) bool {
+	if !spool_targets[amzTarget] {
+		return false
+	}
+	if amzTarget == raw.BATCHWRITEITEM_ENDPOINT {
+		if um_err := json.Unmarshal(bodybytes, bwi.NewBatchWriteItem()); um_err != nil {
+			return false
+		}
+	}
+	var r struct {
+		ReturnValues        string
+		ConditionExpression string
+		Expected            map[string]json.RawMessage
+		UpdateExpression    string
+		AttributeUpdates    map[string]struct {
+			Action string
+		}
+	}
+	um_err := json.Unmarshal(bodybytes, &r)
+	if um_err != nil || (r.ReturnValues != "" && r.ReturnValues != "NONE") {
+		return false
+	}
+	if r.ConditionExpression != "" || len(r.Expected) != 0 {
+		return false
+	}
+	for _, u := range r.AttributeUpdates {
+		if strings.ToUpper(u.Action) == "ADD" {
+			return false
+		}
+	}
+	return idempotent(r.UpdateExpression)
+}
+
+// idempotent returns true if the UpdateExpression expr has the same effect however often it
+// is applied. Values and reserved words can only appear in an expression as placeholders, so
+// the ADD clause, arithmetic and list_append are found by their tokens.
+func idempotent(expr string) bool {
+	if strings.ContainsAny(expr, "+-") {
+		return false
+	}
+	for _, token := range strings.FieldsFunc(strings.ToUpper(expr), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '#' && r != ':'
+	}) {
+		if token == "ADD" || token == "LIST_APPEND" {
+			return false
+		}
+	}
+	return true
+}
+
+// unavailable returns true if the result of a request indicates that Dynamo could not be
+// reached, failed, or is persistently throttling, so the request should be tried again later.
+// A request that failed before it was sent, as it could not be parsed, is not.
+func unavailable(resp_body []byte, code int, resp_err error) bool {
+	if resp_err != nil {
+		return !raw.IsRequestErr(resp_err)
+	}
+	if code >= http.StatusInternalServerError {
+		return true
+	}
+	return ep.ReqErr(code) && aws_error.Throttled(resp_body)
+}
+
+// send makes the request to Dynamo.
+func send(bodybytes []byte, amzTarget string) ([]byte, int, error) {
+	if amzTarget == raw.BATCHWRITEITEM_ENDPOINT {
+		return raw.BatchWriteReq(bodybytes)
+	}
+	return raw.Req(bodybytes, amzTarget)
+}
+
+// Req sends the write request bodybytes to amzTarget. If the spool is open and Dynamo is
+// unavailable, the request is spooled and Req returns 202 Accepted with an empty {} body.
+// While a table has pending entries, later requests that write it are spooled without being
+// sent, so that they are written in order.
+func Req(bodybytes []byte, amzTarget string) ([]byte, int, error) {
+	if !Enabled() || !spoolable(bodybytes, amzTarget) {
+		return send(bodybytes, amzTarget)
+	}
+	if !queued(tables(bodybytes)) {
+		resp_body, code, resp_err := send(bodybytes, amzTarget)
+		if !unavailable(resp_body, code, resp_err) {
+			return resp_body, code, resp_err
+		}
+		if resp_err != nil {
+			bbpd_log.Errorf("bbpd_spool.Req:spooling %s after err %s", amzTarget, resp_err.Error())
+		} else {
+			bbpd_log.Errorf("bbpd_spool.Req:spooling %s after http err %d %s", amzTarget, code, string(resp_body))
+		}
+	}
+	s_err := spool(bodybytes, amzTarget)
+	if s_err != nil {
+		e := fmt.Sprintf("bbpd_spool.Req:cannot spool %s: %s", amzTarget, s_err.Error())
+		return nil, 0, errors.New(e)
+	}
+	return []byte("{}"), http.StatusAccepted, nil
+}
+
+// SpoolHandler obtains the POST payload from the request and relays it to amzTarget through Req.
+func SpoolHandler(w http.ResponseWriter, req *http.Request, amzTarget string) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("bbpd_spool.SpoolHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, amzTarget) {
+		return
+	}
+
+	resp_body, code, resp_err := Req(bodybytes, amzTarget)
+
+	if resp_err != nil {
+		e := fmt.Sprintf("bbpd_spool.SpoolHandler: resp err calling %s err %s (input json: %s)",
+			amzTarget, resp_err.Error(), string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("bbpd_spool.SpoolHandler: http err %d calling %s (input json: %s)",
+			code, amzTarget, string(bodybytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		resp_body,
+		code,
+		start,
+		amzTarget)
+	if mr_err != nil {
+		e := fmt.Sprintf("bbpd_spool.SpoolHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
+// drainer replays pending entries in order, backing off while Dynamo is unavailable.
+func drainer() {
+	backoff := MIN_BACKOFF
+	for {
+		spool_mut.Lock()
+		var en *entry
+		if len(pending) > 0 {
+			en = pending[0]
+		}
+		spool_mut.Unlock()
+		if en == nil {
+			<-wake
+			continue
+		}
+
+		resp_body, code, resp_err := send(en.body, en.target)
+		if unavailable(resp_body, code, resp_err) {
+			bbpd_metrics.AddRetry("spool")
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+			continue
+		}
+		backoff = MIN_BACKOFF
+
+		spool_mut.Lock()
+		if resp_err != nil {
+			// the entry cannot be sent, so retrying it cannot succeed
+			failed++
+			bbpd_log.Errorf("bbpd_spool.drainer:dropping %s that cannot be sent, err %s: %s",
+				en.target, resp_err.Error(), string(en.body))
+		} else if ep.HttpErr(code) {
+			// Dynamo has rejected the request, so retrying it cannot succeed
+			failed++
+			bbpd_log.Errorf("bbpd_spool.drainer:dropping rejected %s (%d) %s: %s",
+				en.target, code, string(resp_body), string(en.body))
+		} else if en.target == raw.BATCHWRITEITEM_ENDPOINT {
+			if remaining := unprocessed(resp_body); remaining != nil {
+				// keep the entry at the head of the log with only the unprocessed items
+				a_err := appendRecord(record{Seq: en.seq, Body: remaining})
+				if a_err != nil {
+					bbpd_log.Errorf("bbpd_spool.drainer:cannot record unprocessed items: %s", a_err.Error())
+				} else {
+					en.body = remaining
+				}
+				spool_mut.Unlock()
+				time.Sleep(MIN_BACKOFF)
+				continue
+			}
+			replayed++
+		} else {
+			replayed++
+		}
+		confirm(en)
+		spool_mut.Unlock()
+	}
+}
+
+// unprocessed returns a BatchWriteItem request body for the UnprocessedItems in resp_body,
+// or nil if every item was processed.
+func unprocessed(resp_body []byte) []byte {
+	var resp struct {
+		UnprocessedItems map[string]json.RawMessage
+	}
+	if um_err := json.Unmarshal(resp_body, &resp); um_err != nil || len(resp.UnprocessedItems) == 0 {
+		return nil
+	}
+	body, m_err := json.Marshal(map[string]interface{}{"RequestItems": resp.UnprocessedItems})
+	if m_err != nil {
+		return nil
+	}
+	return body
+}
+
+// confirm records that the entry at the head of pending has been written. spool_mut must be held.
+func confirm(en *entry) {
+	a_err := appendRecord(record{Seq: en.seq, Done: true})
+	if a_err != nil {
+		// the entry will be replayed again after a restart
+		bbpd_log.Errorf("bbpd_spool.confirm:cannot confirm entry %d: %s", en.seq, a_err.Error())
+	}
+	pending = pending[1:]
+	confirmed++
+	if len(pending) == 0 || confirmed >= COMPACT_THRESHOLD {
+		if c_err := compact(); c_err != nil {
+			bbpd_log.Errorf(c_err.Error())
+		}
+	}
+}
+
+// compact rewrites the log with only the pending entries. spool_mut must be held.
+func compact() error {
+	if len(pending) == 0 {
+		if t_err := log_file.Truncate(0); t_err != nil {
+			e := fmt.Sprintf("bbpd_spool.compact:cannot truncate log: %s", t_err.Error())
+			return errors.New(e)
+		}
+		log_size = 0
+		confirmed = 0
+		return log_file.Sync()
+	}
+	if confirmed == 0 {
+		return nil
+	}
+	path := filepath.Join(dir, LOG_FILE_NAME)
+	tmp_path := path + ".tmp"
+	tmp, create_err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if create_err != nil {
+		e := fmt.Sprintf("bbpd_spool.compact:cannot create %s: %s", tmp_path, create_err.Error())
+		return errors.New(e)
+	}
+	w := bufio.NewWriter(tmp)
+	var size int64
+	for _, en := range pending {
+		line, m_err := json.Marshal(record{Seq: en.seq, Target: en.target, Body: en.body})
+		if m_err != nil {
+			tmp.Close()
+			return m_err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+		size += int64(len(line)) + 1
+	}
+	w_err := w.Flush()
+	if w_err == nil {
+		w_err = tmp.Sync()
+	}
+	tmp.Close()
+	if w_err != nil {
+		e := fmt.Sprintf("bbpd_spool.compact:cannot write %s: %s", tmp_path, w_err.Error())
+		return errors.New(e)
+	}
+	if r_err := os.Rename(tmp_path, path); r_err != nil {
+		e := fmt.Sprintf("bbpd_spool.compact:cannot replace %s: %s", path, r_err.Error())
+		return errors.New(e)
+	}
+	// make the rename durable
+	if d, d_err := os.Open(dir); d_err == nil {
+		d.Sync()
+		d.Close()
+	}
+	f, open_err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if open_err != nil {
+		// without a log, nothing further can be spooled
+		e := fmt.Sprintf("bbpd_spool.compact:cannot reopen %s: %s", path, open_err.Error())
+		log.Fatal(e)
+	}
+	log_file.Close()
+	log_file = f
+	log_size = size
+	confirmed = 0
+	return nil
+}
+
+// Replay waits up to timeout for the entries pending at startup to be written. It should be
+// called before bbpd starts accepting requests. Entries that cannot be written in time are
+// left for the drainer, and later writes are spooled behind them.
+func Replay(timeout time.Duration) {
+	if !Enabled() {
+		return
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_REPLAY_TIMEOUT
+	}
+	n := Pending()
+	if n == 0 {
+		return
+	}
+	e := fmt.Sprintf("bbpd_spool.Replay:replaying %d spooled entries", n)
+	bbpd_log.Infof(e)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if Pending() == 0 {
+			bbpd_log.Infof("bbpd_spool.Replay:spool replayed")
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	e = fmt.Sprintf("bbpd_spool.Replay:timed out with %d entries pending, continuing in the background", Pending())
+	bbpd_log.Infof(e)
+}
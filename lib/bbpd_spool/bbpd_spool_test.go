@@ -0,0 +1,205 @@
+package bbpd_spool
+
+import (
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	put "github.com/smugmug/godynamo/endpoints/put_item"
+	update_item "github.com/smugmug/godynamo/endpoints/update_item"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openLog writes contents to a new log in a temporary directory and returns it open as Open
+// would. The directory is removed when the test ends.
+func openLog(t *testing.T, contents string) *os.File {
+	d, d_err := ioutil.TempDir("", "bbpd_spool")
+	if d_err != nil {
+		t.Fatal(d_err)
+	}
+	t.Cleanup(func() { os.RemoveAll(d) })
+	path := filepath.Join(d, LOG_FILE_NAME)
+	if w_err := ioutil.WriteFile(path, []byte(contents), 0600); w_err != nil {
+		t.Fatal(w_err)
+	}
+	f, open_err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if open_err != nil {
+		t.Fatal(open_err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestLoad(t *testing.T) {
+	contents := `{"Seq":1,"Target":"t1","Body":{"TableName":"a"}}
+{"Seq":2,"Target":"t2","Body":{"TableName":"b"}}
+{"Seq":3,"Target":"t3","Body":{"TableName":"c"}}
+{"Seq":2,"Body":{"TableName":"b2"}}
+{"Seq":1,"Done":true}
+`
+	f := openLog(t, contents)
+	entries, size, load_err := load(f)
+	if load_err != nil {
+		t.Fatal(load_err)
+	}
+	if size != int64(len(contents)) {
+		t.Errorf("size %d, want %d", size, len(contents))
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(entries))
+	}
+	if entries[0].seq != 2 || entries[0].target != "t2" || string(entries[0].body) != `{"TableName":"b2"}` {
+		t.Errorf("first entry %d %s %s, want the replaced body of 2", entries[0].seq, entries[0].target, entries[0].body)
+	}
+	if entries[1].seq != 3 || len(entries[1].tables) != 1 || entries[1].tables[0] != "c" {
+		t.Errorf("second entry %d %v, want 3 writing c", entries[1].seq, entries[1].tables)
+	}
+}
+
+func TestLoadTruncatesPartialRecord(t *testing.T) {
+	whole := `{"Seq":1,"Target":"t1","Body":{"TableName":"a"}}
+`
+	f := openLog(t, whole+`{"Seq":2,"Target":"t2","Bo`)
+	entries, size, load_err := load(f)
+	if load_err != nil {
+		t.Fatal(load_err)
+	}
+	if len(entries) != 1 || entries[0].seq != 1 {
+		t.Fatalf("%d entries, want only 1", len(entries))
+	}
+	if size != int64(len(whole)) {
+		t.Errorf("size %d, want %d", size, len(whole))
+	}
+	fi, stat_err := f.Stat()
+	if stat_err != nil {
+		t.Fatal(stat_err)
+	}
+	if fi.Size() != int64(len(whole)) {
+		t.Errorf("log is %d bytes, want it truncated to %d", fi.Size(), len(whole))
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	f := openLog(t, "not json\n")
+	if _, _, load_err := load(f); load_err == nil {
+		t.Errorf("loaded a corrupt record")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	f := openLog(t, `{"Seq":1,"Target":"t1","Body":{"TableName":"a"}}
+{"Seq":2,"Target":"t2","Body":{"TableName":"b"}}
+{"Seq":1,"Done":true}
+`)
+	entries, _, load_err := load(f)
+	if load_err != nil {
+		t.Fatal(load_err)
+	}
+	spool_mut.Lock()
+	defer spool_mut.Unlock()
+	dir, log_file, pending, confirmed = filepath.Dir(f.Name()), f, entries, 1
+	defer func() {
+		// compact reopened the log
+		log_file.Close()
+		dir, log_file, pending, confirmed, log_size = "", nil, nil, 0, 0
+	}()
+
+	if c_err := compact(); c_err != nil {
+		t.Fatal(c_err)
+	}
+	b, read_err := ioutil.ReadFile(f.Name())
+	if read_err != nil {
+		t.Fatal(read_err)
+	}
+	want := `{"Seq":2,"Target":"t2","Body":{"TableName":"b"}}` + "\n"
+	if string(b) != want {
+		t.Errorf("compacted log %q, want %q", b, want)
+	}
+	if log_size != int64(len(want)) || confirmed != 0 {
+		t.Errorf("log_size %d confirmed %d, want %d 0", log_size, confirmed, len(want))
+	}
+	if _, tmp_err := os.Stat(f.Name() + ".tmp"); !os.IsNotExist(tmp_err) {
+		t.Errorf("temporary log left behind")
+	}
+
+	// with nothing pending, the log is emptied in place
+	pending = nil
+	if c_err := compact(); c_err != nil {
+		t.Fatal(c_err)
+	}
+	fi, stat_err := os.Stat(f.Name())
+	if stat_err != nil {
+		t.Fatal(stat_err)
+	}
+	if fi.Size() != 0 || log_size != 0 {
+		t.Errorf("log is %d bytes, want 0", fi.Size())
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	cases := map[string]bool{
+		"":                              true,
+		"SET #a = :a, #b = :b":          true,
+		"SET a = :a REMOVE b":           true,
+		"set a = :a":                    true,
+		"SET a = if_not_exists(a, :a)":  true,
+		"SET #add = :add":               true,
+		"SET address = :v":              true,
+		"SET a = a + :n":                false,
+		"SET a = :n - a":                false,
+		"ADD a :n":                      false,
+		"SET a = :a add b :n":           false,
+		"SET l = list_append(l, :l)":    false,
+		"SET l = LIST_APPEND(:l, l)":    false,
+		"DELETE s :s":                   true,
+		"SET a = :a ADD #n :n REMOVE b": false,
+		"SET list_append_count = :a":    true,
+		"SET a.b[1] = :a, c = if_not_exists(c, :c)": true,
+	}
+	for expr, want := range cases {
+		if got := idempotent(expr); got != want {
+			t.Errorf("idempotent(%q) = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestSpoolable(t *testing.T) {
+	bwi_body := `{"RequestItems":{"a":[{"PutRequest":{"Item":{"k":{"S":"v"}}}}]}}`
+	cases := []struct {
+		target string
+		body   string
+		want   bool
+	}{
+		{put.PUTITEM_ENDPOINT, `{"TableName":"a","Item":{"k":{"S":"v"}}}`, true},
+		{put.PUTITEM_ENDPOINT, `{"TableName":"a","Item":{"k":{"S":"v"}},"ReturnValues":"NONE"}`, true},
+		{put.PUTITEM_ENDPOINT, `{"TableName":"a","Item":{"k":{"S":"v"}},"ReturnValues":"ALL_OLD"}`, false},
+		{put.PUTITEM_ENDPOINT, `{"TableName":"a","Item":{"k":{"S":"v"}},"ConditionExpression":"attribute_not_exists(k)"}`, false},
+		{put.PUTITEM_ENDPOINT, `{"TableName":"a","Item":{"k":{"S":"v"}},"Expected":{"k":{"Exists":false}}}`, false},
+		{put.PUTITEM_ENDPOINT, `not json`, false},
+		{update_item.UPDATEITEM_ENDPOINT, `{"TableName":"a","Key":{"k":{"S":"v"}},"UpdateExpression":"SET b = :b"}`, true},
+		{update_item.UPDATEITEM_ENDPOINT, `{"TableName":"a","Key":{"k":{"S":"v"}},"UpdateExpression":"SET b = b + :n"}`, false},
+		{update_item.UPDATEITEM_ENDPOINT, `{"TableName":"a","Key":{"k":{"S":"v"}},"AttributeUpdates":{"b":{"Action":"PUT"}}}`, true},
+		{update_item.UPDATEITEM_ENDPOINT, `{"TableName":"a","Key":{"k":{"S":"v"}},"AttributeUpdates":{"b":{"Action":"add"}}}`, false},
+		{raw.BATCHWRITEITEM_ENDPOINT, bwi_body, true},
+		{raw.BATCHWRITEITEM_ENDPOINT, `{"RequestItems":["a"]}`, false},
+		{"DynamoDB_20120810.DeleteItem", `{"TableName":"a","Key":{"k":{"S":"v"}}}`, false},
+	}
+	for _, c := range cases {
+		if got := spoolable([]byte(c.body), c.target); got != c.want {
+			t.Errorf("spoolable(%s, %s) = %v, want %v", c.target, c.body, got, c.want)
+		}
+	}
+}
+
+func TestTables(t *testing.T) {
+	ts := tables([]byte(`{"RequestItems":{"a":[],"b":[]}}`))
+	sort.Strings(ts)
+	if strings.Join(ts, ",") != "a,b" {
+		t.Errorf("tables %v, want a and b", ts)
+	}
+	if ts := tables([]byte(`{"TableName":"a"}`)); len(ts) != 1 || ts[0] != "a" {
+		t.Errorf("tables %v, want a", ts)
+	}
+}
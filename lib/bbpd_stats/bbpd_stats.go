@@ -14,6 +14,9 @@ type Summary struct {
 	AverageResponse string
 	LastResponse    string
 	ResponseCount   string
+	CacheHits       string
+	CacheMisses     string
+	CoalescedReads  string
 }
 
 var (
@@ -27,6 +30,11 @@ var (
 
 	last_response time.Time
 
+	cache_hits   uint64
+	cache_misses uint64
+
+	coalesced_reads uint64
+
 	stat_lock sync.RWMutex
 )
 
@@ -56,6 +64,27 @@ func AddResponse(start time.Time) {
 	stat_lock.Unlock()
 }
 
+// AddCacheHit counts a read served from the item cache.
+func AddCacheHit() {
+	stat_lock.Lock()
+	cache_hits++
+	stat_lock.Unlock()
+}
+
+// AddCacheMiss counts a cacheable read that was not found in the item cache.
+func AddCacheMiss() {
+	stat_lock.Lock()
+	cache_misses++
+	stat_lock.Unlock()
+}
+
+// AddCoalescedRead counts a read that shared the response of an identical in-flight read.
+func AddCoalescedRead() {
+	stat_lock.Lock()
+	coalesced_reads++
+	stat_lock.Unlock()
+}
+
 // GetSummary returns a struct of formatted strings that provide human-readable run stats.
 func GetSummary() Summary {
 	n := time.Since(bbpd_start)
@@ -66,6 +95,9 @@ func GetSummary() Summary {
 	if response_count > 0 {
 		l = fmt.Sprintf("%v, (%v ago)", last_response, time.Since(last_response))
 	}
+	hits := cache_hits
+	misses := cache_misses
+	coalesced := coalesced_reads
 	stat_lock.RUnlock()
 	return Summary{
 		StartTime:       fmt.Sprintf("%v", bbpd_start),
@@ -74,5 +106,8 @@ func GetSummary() Summary {
 		AverageResponse: fmt.Sprintf("%.2fms", average_response_ms),
 		LastResponse:    fmt.Sprintf("%v", l),
 		ResponseCount:   fmt.Sprintf("%d", response_count),
+		CacheHits:       fmt.Sprintf("%d", hits),
+		CacheMisses:     fmt.Sprintf("%d", misses),
+		CoalescedReads:  fmt.Sprintf("%d", coalesced),
 	}
 }
@@ -0,0 +1,117 @@
+// TLS for the TCP listeners of bbpd, optionally requiring client certificates signed by a
+// configured CA bundle. Reload re-reads the certificate, key and CA bundle, so they can be
+// rotated without closing the listeners; each new connection is made with the files as they
+// were last loaded, and established connections are not disturbed.
+package bbpd_tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	cert_file      string
+	key_file       string
+	client_ca_file string
+	cert           *tls.Certificate
+	client_cas     *x509.CertPool
+	tls_mut        sync.RWMutex
+)
+
+// Configure sets the paths of the certificate and key, and of the CA bundle that client
+// certificates must be signed by, and loads them. An empty cert_path disables TLS. An empty
+// client_ca_path does not ask for client certificates.
+func Configure(cert_path, key_path, client_ca_path string) error {
+	if cert_path != "" && key_path == "" {
+		e := fmt.Sprintf("bbpd_tls.Configure:a key file is needed for %s", cert_path)
+		return errors.New(e)
+	}
+	tls_mut.Lock()
+	cert_file = cert_path
+	key_file = key_path
+	client_ca_file = client_ca_path
+	cert = nil
+	client_cas = nil
+	tls_mut.Unlock()
+	return Reload()
+}
+
+// Enabled returns true if a certificate is configured.
+func Enabled() bool {
+	tls_mut.RLock()
+	defer tls_mut.RUnlock()
+	return cert_file != ""
+}
+
+// Reload re-reads the certificate, key and client CA bundle. If any cannot be read, the
+// ones loaded before are kept and an error is returned.
+func Reload() error {
+	tls_mut.RLock()
+	c_path, k_path, ca_path := cert_file, key_file, client_ca_file
+	tls_mut.RUnlock()
+	if c_path == "" {
+		return nil
+	}
+	c, load_err := tls.LoadX509KeyPair(c_path, k_path)
+	if load_err != nil {
+		e := fmt.Sprintf("bbpd_tls.Reload:cannot load %s and %s: %s", c_path, k_path, load_err.Error())
+		return errors.New(e)
+	}
+	var pool *x509.CertPool
+	if ca_path != "" {
+		ca_bytes, read_err := ioutil.ReadFile(ca_path)
+		if read_err != nil {
+			e := fmt.Sprintf("bbpd_tls.Reload:cannot read %s: %s", ca_path, read_err.Error())
+			return errors.New(e)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca_bytes) {
+			e := fmt.Sprintf("bbpd_tls.Reload:no certificates found in %s", ca_path)
+			return errors.New(e)
+		}
+	}
+	tls_mut.Lock()
+	cert = &c
+	client_cas = pool
+	tls_mut.Unlock()
+	bbpd_log.Infof("bbpd_tls.Reload:loaded %s", c_path)
+	return nil
+}
+
+// current returns the TLS configuration for a new connection, from the files as last loaded.
+func current() *tls.Config {
+	tls_mut.RLock()
+	defer tls_mut.RUnlock()
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{*cert},
+	}
+	if client_cas != nil {
+		c.ClientCAs = client_cas
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c
+}
+
+// Config returns the TLS configuration for a server. It should only be called once
+// Configure has loaded a certificate.
+func Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tls_mut.RLock()
+			defer tls_mut.RUnlock()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current(), nil
+		},
+	}
+}
@@ -0,0 +1,73 @@
+// Wire compatibility with DynamoDB for the compatibility mode route, so that an AWS SDK can
+// use bbpd as its endpoint. Responses are given the headers DynamoDB sets; SDKs check the
+// CRC32 of the body, and log the request id. The SigV4 Authorization header an SDK sends is
+// accepted but not checked, as bbpd signs its own requests with the GoDynamo credentials.
+package bbpd_wire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+)
+
+const (
+	REQUEST_ID_HDR = "x-amzn-RequestId"
+	CRC32_HDR      = "x-amz-crc32"
+)
+
+// recorder holds a handler's response so its headers can be set once the body is known.
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// RequestId returns a new request id, in the form DynamoDB uses: 52 upper-case letters and digits.
+func RequestId() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// Serve calls handler and writes its response with the DynamoDB content type and the
+// x-amzn-RequestId and x-amz-crc32 headers. The status code and body, including those of
+// errors, are written as the handler wrote them.
+func Serve(w http.ResponseWriter, req *http.Request, handler http.HandlerFunc) {
+	rec := &recorder{header: make(http.Header)}
+	handler(rec, req)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	body := rec.body.Bytes()
+	h := w.Header()
+	for k, v := range rec.header {
+		h[k] = v
+	}
+	h.Set(bbpd_const.CONTENTTYPE, bbpd_const.AMZJSONMIME)
+	h.Set(bbpd_const.CONTENTLENGTH, strconv.Itoa(len(body)))
+	h.Set(REQUEST_ID_HDR, RequestId())
+	h.Set(CRC32_HDR, strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10))
+	w.WriteHeader(rec.code)
+	w.Write(body)
+}
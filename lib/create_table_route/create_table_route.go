@@ -4,6 +4,7 @@ package create_table_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
@@ -11,7 +12,6 @@ import (
 	create "github.com/smugmug/godynamo/endpoints/create_table"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -30,15 +30,15 @@ func CreateTableHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "create_table_route.CreateTableHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "create_table_route.CreateTableHandler:cannot parse path. try /create, call as POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +46,8 @@ func CreateTableHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("create_table_route.CreateTableHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,16 +56,16 @@ func CreateTableHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("create_table_route.CreateTableHandler unmarshal err on %s to Create: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
 	// the table name can't be too long, 256 bytes binary utf8
 	if !create.ValidTableName(c.TableName) {
 		e := fmt.Sprintf("create_table_route.CreateTableHandler: tablename over 256 bytes")
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -74,8 +74,8 @@ func CreateTableHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("create_table_route.CreateTableHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -93,6 +93,6 @@ func CreateTableHandler(w http.ResponseWriter, req *http.Request) {
 		create.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("create_table_route.CreateTableHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
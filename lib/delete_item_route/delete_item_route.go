@@ -4,6 +4,9 @@ package delete_item_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
@@ -11,12 +14,16 @@ import (
 	delete_item "github.com/smugmug/godynamo/endpoints/delete_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
+const (
+	// JSON_ENDPOINT_NAME names the bbpd-only basic JSON variant of DeleteItem.
+	JSON_ENDPOINT_NAME = delete_item.ENDPOINT_NAME + "JSON"
+)
+
 // RawPostHandler relays the DeleteItem request to Dynamo directly.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
 	raw.RawPostReq(w, req, delete_item.DELETEITEM_ENDPOINT)
@@ -30,15 +37,15 @@ func DeleteItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler: method only supports POST")
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler:cannot parse path. try /delete-item, call as POST")
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +53,8 @@ func DeleteItemHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,8 +63,8 @@ func DeleteItemHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler unmarshal err on %s to PutExpected: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -66,8 +73,8 @@ func DeleteItemHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -85,6 +92,81 @@ func DeleteItemHandler(w http.ResponseWriter, req *http.Request) {
 		delete_item.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("delete_item_route.DeleteItemHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// BBPD-only endpoint.
+// DeleteItemJSONHandler relays the DeleteItem request to Dynamo.
+// This variant allows the Key, ExpressionAttributeValues and Expected values to be encoded as basic JSON, and
+// returns any Attributes in basic JSON. As there is always a conversion that needs to be
+// performed, this endpoint cannot utilize RawPost.
+func DeleteItemJSONHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := "delete_item_route.DeleteItemJSONHandler:method only supports POST"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("delete_item_route.DeleteItemJSONHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, delete_item.DELETEITEM_ENDPOINT) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("delete_item_route.DeleteItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	// relay through raw.Req so the item cache sees the write
+	resp_body, code, resp_err := raw.Req(reqbytes, delete_item.DELETEITEM_ENDPOINT)
+
+	if resp_err != nil {
+		e := fmt.Sprintf("delete_item_route.DeleteItemJSONHandler:err %s",
+			resp_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		route_response.WriteError(w, code, "delete_item_route.DeleteItemJSONHandler", resp_body)
+		return
+	}
+
+	json_body, jerr := bbpd_json.ResponseToJSON(resp_body, "Attributes")
+	if jerr != nil {
+		e := fmt.Sprintf("delete_item_route.DeleteItemJSONHandler:err %s", jerr.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		json_body,
+		code,
+		start,
+		JSON_ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("delete_item_route.DeleteItemJSONHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
 	}
 }
@@ -1,99 +1,233 @@
 // Supports proxying the DeleteTable endpoint.
-// It is recommended that you do NOT bind this to a route, its too dangerous.
+// As it is dangerous, DeleteTable is refused unless the table matches one of the configured
+// patterns and the request carries the X-Bbpd-Confirm-Delete header naming the table. A dry
+// run, with the X-Bbpd-Dry-Run header, returns the DescribeTable output for the table instead
+// of deleting it; if so configured, a dry run is required shortly before each deletion.
 package delete_table_route
 
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
 	ep "github.com/smugmug/godynamo/endpoint"
 	delete_table "github.com/smugmug/godynamo/endpoints/delete_table"
+	desc "github.com/smugmug/godynamo/endpoints/describe_table"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
-// RawPostHandler relays the DeleteTable request to Dynamo directly.
-func RawPostHandler(w http.ResponseWriter, req *http.Request) {
-	raw.RawPostReq(w, req, delete_table.DELETETABLE_ENDPOINT)
+const (
+	// how long a dry run allows the deletion of its table, if none is configured
+	DEFAULT_DRY_RUN_WINDOW = 5 * time.Minute
+)
+
+var (
+	patterns        []string
+	require_dry_run bool
+	dry_run_window  time.Duration
+	// when each table was last dry run
+	dry_runs   map[string]time.Time
+	delete_mut sync.Mutex
+)
+
+func init() {
+	Configure(nil, false, 0)
 }
 
-// DeleteTableHandler can be used via POST (passing in JSON) or GET (as /DeleteTable/TableName).
-func DeleteTableHandler(w http.ResponseWriter, req *http.Request) {
-	if bbpd_runinfo.BBPDAbortIfClosed(w) {
-		return
+// Configure sets the patterns, as matched by path.Match, of the tables that may be deleted,
+// and whether a dry run must precede each deletion, within window. No patterns disables
+// DeleteTable. Patterns that cannot be matched are logged and ignored.
+func Configure(tables []string, dry_run bool, window time.Duration) {
+	p := make([]string, 0, len(tables))
+	for _, t := range tables {
+		if _, match_err := path.Match(t, ""); match_err != nil {
+			bbpd_log.Errorf("delete_table_route.Configure:ignoring bad table pattern '%s'", t)
+			continue
+		}
+		p = append(p, t)
 	}
-	if req.Method == "POST" {
-		deleteTable_POST_Handler(w, req)
-	} else {
-		e := fmt.Sprintf("delete_table_route.DeleteTablesHandler:bad method %s", req.Method)
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	if window <= 0 {
+		window = DEFAULT_DRY_RUN_WINDOW
 	}
+	delete_mut.Lock()
+	patterns = p
+	require_dry_run = dry_run
+	dry_run_window = window
+	dry_runs = make(map[string]time.Time)
+	delete_mut.Unlock()
 }
 
-// Executes DeleteTable assuming it were requested with the POST method.
-func deleteTable_POST_Handler(w http.ResponseWriter, req *http.Request) {
-	start := time.Now()
-	pathElts := strings.Split(req.URL.Path, "/")
-	if len(pathElts) != 2 {
-		e := "delete_table_route.deleteTable_POST_Handler:cannot parse path. try /desc-table"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
-		return
+// Enabled returns true if any tables may be deleted.
+func Enabled() bool {
+	delete_mut.Lock()
+	defer delete_mut.Unlock()
+	return len(patterns) != 0
+}
+
+// deletable returns true if table matches one of the configured patterns.
+func deletable(table string) bool {
+	delete_mut.Lock()
+	defer delete_mut.Unlock()
+	for _, p := range patterns {
+		if m, _ := path.Match(p, table); m {
+			return true
+		}
 	}
+	return false
+}
 
+// dryRunMissing returns true if a dry run is required and table has not been dry run within
+// the window.
+func dryRunMissing(table string) bool {
+	delete_mut.Lock()
+	defer delete_mut.Unlock()
+	if !require_dry_run {
+		return false
+	}
+	last, ok := dry_runs[table]
+	return !ok || time.Since(last) > dry_run_window
+}
+
+// useDryRun uses up the dry run of table once it has been deleted, so the next deletion needs
+// another. A deletion that fails keeps the dry run, and may be retried within the window.
+func useDryRun(table string) {
+	delete_mut.Lock()
+	delete(dry_runs, table)
+	delete_mut.Unlock()
+}
+
+// recordDryRun notes that table was dry run now.
+func recordDryRun(table string) {
+	delete_mut.Lock()
+	dry_runs[table] = time.Now()
+	delete_mut.Unlock()
+}
+
+// RawPostHandler relays the DeleteTable request to Dynamo, if it is allowed.
+func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
 	bodybytes, read_err := ioutil.ReadAll(req.Body)
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
-		e := fmt.Sprintf("delete_table_route.deleteTable_POST_Handler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		e := fmt.Sprintf("delete_table_route.RawPostHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
-	d := delete_table.NewDeleteTable()
+	if !Enabled() {
+		e := "delete_table_route.RawPostHandler:DeleteTable is not enabled"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusForbidden)
+		return
+	}
 
-	um_err := json.Unmarshal(bodybytes, d)
-	if um_err != nil {
-		e := fmt.Sprintf("delete_table_route.deleteTable_POST_Handler unmarshal err on %s to Get %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	var d struct {
+		TableName string
+	}
+	um_err := json.Unmarshal(bodybytes, &d)
+	if um_err != nil || d.TableName == "" {
+		e := fmt.Sprintf("delete_table_route.RawPostHandler:no TableName in %s", string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
-	resp_body, code, resp_err := d.EndpointReq()
+	if !deletable(d.TableName) {
+		e := fmt.Sprintf("delete_table_route.RawPostHandler:table %s may not be deleted", d.TableName)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusForbidden)
+		return
+	}
+
+	amzTarget := delete_table.DELETETABLE_ENDPOINT
+	endpoint_name := delete_table.ENDPOINT_NAME
+	_, dry_run := req.Header[bbpd_const.X_BBPD_DRY_RUN]
+	if dry_run {
+		bodybytes, _ = json.Marshal(d)
+		amzTarget = desc.DESCTABLE_ENDPOINT
+		endpoint_name = desc.ENDPOINT_NAME
+	} else {
+		confirm := req.Header.Get(bbpd_const.X_BBPD_CONFIRM_DELETE)
+		if confirm != d.TableName {
+			e := fmt.Sprintf("delete_table_route.RawPostHandler:set '-H \"%s: %s\"' to delete table %s",
+				bbpd_const.X_BBPD_CONFIRM_DELETE, d.TableName, d.TableName)
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusPreconditionFailed)
+			return
+		}
+		if dryRunMissing(d.TableName) {
+			e := fmt.Sprintf("delete_table_route.RawPostHandler:table %s must be dry run with '-H \"%s: True\"' first",
+				d.TableName, bbpd_const.X_BBPD_DRY_RUN)
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	resp_body, code, resp_err := raw.Req(bodybytes, amzTarget)
 
 	if resp_err != nil {
-		e := fmt.Sprintf("delete_table_route.deleteTable_POST_Handler:err %s",
-			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		e := fmt.Sprintf("delete_table_route.RawPostHandler:err %s", resp_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
 	if ep.HttpErr(code) {
-		route_response.WriteError(w, code, "delete_table_route.deleteTable_POST_Handler", resp_body)
+		route_response.WriteError(w, code, "delete_table_route.RawPostHandler", resp_body)
 		return
 	}
 
+	if dry_run {
+		recordDryRun(d.TableName)
+	} else {
+		useDryRun(d.TableName)
+		bbpd_log.Infof("delete_table_route.RawPostHandler:table %s is being deleted", d.TableName)
+	}
+
 	mr_err := route_response.MakeRouteResponse(
 		w,
 		req,
 		resp_body,
 		code,
 		start,
-		delete_table.ENDPOINT_NAME)
+		endpoint_name)
 	if mr_err != nil {
-		e := fmt.Sprintf("delete_table_route.deleteTable_POST_Handler %s",
-			mr_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		e := fmt.Sprintf("delete_table_route.RawPostHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
+// DeleteTableHandler can be used via POST (passing in JSON), as /DeleteTable.
+func DeleteTableHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	if req.Method != "POST" {
+		e := fmt.Sprintf("delete_table_route.DeleteTableHandler:bad method %s", req.Method)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	pathElts := strings.Split(req.URL.Path, "/")
+	if len(pathElts) != 2 {
+		e := "delete_table_route.DeleteTableHandler:cannot parse path. try /DeleteTable"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
+	RawPostHandler(w, req)
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
 	"github.com/smugmug/bbpd/lib/bbpd_msg"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
@@ -13,7 +15,6 @@ import (
 	desc "github.com/smugmug/godynamo/endpoints/describe_table"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -34,23 +35,23 @@ func StatusTableHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "GET" {
 		e := "describe_table_route.StatusTableHandler:method only supports GET"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 3 {
 		e := "describe_table_route.StatusTableHandler:cannot parse path. try /status-table/TABLENAME"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	ue_tn, ue_err := url.QueryUnescape(string(pathElts[2]))
 	if ue_err != nil {
 		e := fmt.Sprintf("cannot unescape %s, %s",
 			string(pathElts[2]), ue_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -77,8 +78,8 @@ func StatusTableHandler(w http.ResponseWriter, req *http.Request) {
 
 	if status_err != nil {
 		e := fmt.Sprintf("describe_table_route.StatusTableHandler:cannot get status %s from %s, err %s", status, ue_tn, status_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -86,8 +87,8 @@ func StatusTableHandler(w http.ResponseWriter, req *http.Request) {
 	sj, sjerr := json.Marshal(s)
 	if sjerr != nil {
 		e := fmt.Sprintf("describe_table_route.StatusTableHandler:cannot get convert status to json, err %s", sjerr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	end := time.Now()
@@ -104,8 +105,8 @@ func StatusTableHandler(w http.ResponseWriter, req *http.Request) {
 			End:      end}})
 	if json_err != nil {
 		e := fmt.Sprintf("describe_table_route.StatusTableHandler:desc marshal failure %s", json_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	io.WriteString(w, string(b))
@@ -120,8 +121,8 @@ func DescribeTableHandler(w http.ResponseWriter, req *http.Request) {
 		describeTable_POST_Handler(w, req)
 	} else {
 		e := fmt.Sprintf("describe_tables_route.DescribeTablesHandler:bad method %s", req.Method)
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 	}
 }
 
@@ -131,8 +132,8 @@ func describeTable_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "describe_table_route.describeTable_POST_Handler:cannot parse path."
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -140,8 +141,8 @@ func describeTable_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("describe_table_route.describeTable_POST_Handler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -150,18 +151,19 @@ func describeTable_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	um_err := json.Unmarshal(bodybytes, d)
 	if um_err != nil {
 		e := fmt.Sprintf("describe_table_route.describeTable_POST_Handler unmarshal err on %s to Get %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
 	resp_body, code, resp_err := d.EndpointReq()
+	bbpd_metrics.AddUpstream(resp_body, code, resp_err)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("describe_table_route.describeTable_POST_Handler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -180,8 +182,8 @@ func describeTable_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	if mr_err != nil {
 		e := fmt.Sprintf("describe_table_route.describeTable_POST_Handler %s",
 			mr_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 }
@@ -0,0 +1,385 @@
+// Micro-batching of GetItem requests. GetItem requests for the same table that arrive
+// within a short window, and that agree on ConsistentRead and projection, are issued
+// together as one BatchGetItem. Each caller receives an ordinary GetItem response.
+package get_item_batcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	"github.com/smugmug/godynamo/aws_const"
+	ep "github.com/smugmug/godynamo/endpoint"
+	bgi "github.com/smugmug/godynamo/endpoints/batch_get_item"
+	get "github.com/smugmug/godynamo/endpoints/get_item"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BatchGetItem accepts at most this many keys
+	MAX_BATCH_KEYS = 100
+	// attempts made to read UnprocessedKeys before falling back to GetItem
+	UNPROCESSED_RETRIES = 5
+	UNPROCESSED_BACKOFF = 10 * time.Millisecond
+	// ExpressionAttributeNames placeholders used to add key attributes to a projection
+	KEY_NAME_PLACEHOLDER = "#bbpd_key"
+)
+
+var BATCHGETITEM_ENDPOINT = aws_const.CURRENT_API_VERSION + "." + bgi.ENDPOINT_NAME
+
+// a GetItem request, as far as batching is concerned
+type getItemReq struct {
+	TableName                string
+	Key                      map[string]json.RawMessage
+	ConsistentRead           bool
+	AttributesToGet          []string
+	ProjectionExpression     string
+	ExpressionAttributeNames map[string]string
+}
+
+// the result delivered to each waiting caller
+type result struct {
+	resp_body []byte
+	code      int
+	err       error
+}
+
+type waiter struct {
+	bodybytes []byte
+	key       map[string]json.RawMessage
+	canon     string
+	done      chan result
+}
+
+// a set of compatible requests waiting to be sent as one BatchGetItem
+type group struct {
+	sig     string
+	req     getItemReq
+	waiters []*waiter
+}
+
+var (
+	window     time.Duration
+	groups     map[string]*group
+	groups_mut sync.Mutex
+)
+
+func init() {
+	groups = make(map[string]*group)
+}
+
+// Configure sets the batching window. A zero window disables batching.
+func Configure(batch_window time.Duration) {
+	groups_mut.Lock()
+	window = batch_window
+	groups_mut.Unlock()
+}
+
+// Enabled returns true if a batching window has been configured.
+func Enabled() bool {
+	groups_mut.Lock()
+	defer groups_mut.Unlock()
+	return window > 0
+}
+
+// canonicalKey serializes key attributes in sorted name order.
+func canonicalKey(key map[string]json.RawMessage) (string, bool) {
+	canon := make(map[string]interface{}, len(key))
+	for k, v := range key {
+		var i interface{}
+		if um_err := json.Unmarshal(v, &i); um_err != nil {
+			return "", false
+		}
+		canon[k] = i
+	}
+	b, m_err := json.Marshal(canon)
+	if m_err != nil || len(key) == 0 {
+		return "", false
+	}
+	return string(b), true
+}
+
+// parse returns the request if it can be batched. Requests with fields other than those
+// in getItemReq (such as ReturnConsumedCapacity) are not batched.
+func parse(bodybytes []byte) (*getItemReq, bool) {
+	var fields map[string]json.RawMessage
+	if um_err := json.Unmarshal(bodybytes, &fields); um_err != nil {
+		return nil, false
+	}
+	for k, v := range fields {
+		switch k {
+		case "TableName", "Key", "ConsistentRead", "AttributesToGet",
+			"ProjectionExpression", "ExpressionAttributeNames":
+		case "ReturnConsumedCapacity":
+			if string(v) != `"NONE"` && string(v) != "null" {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	r := new(getItemReq)
+	if um_err := json.Unmarshal(bodybytes, r); um_err != nil {
+		return nil, false
+	}
+	if r.TableName == "" || len(r.Key) == 0 {
+		return nil, false
+	}
+	return r, true
+}
+
+// signature identifies the requests that may share a BatchGetItem.
+func (r *getItemReq) signature() string {
+	ean := make([]string, 0, len(r.ExpressionAttributeNames))
+	for k, v := range r.ExpressionAttributeNames {
+		ean = append(ean, k+"="+v)
+	}
+	sort.Strings(ean)
+	return fmt.Sprintf("%s\x00%v\x00%s\x00%s\x00%s", r.TableName, r.ConsistentRead,
+		strings.Join(r.AttributesToGet, ","), r.ProjectionExpression, strings.Join(ean, ","))
+}
+
+// Batchable returns true if batching is enabled and the request could be batched.
+func Batchable(bodybytes []byte) bool {
+	if !Enabled() {
+		return false
+	}
+	r, ok := parse(bodybytes)
+	if !ok {
+		return false
+	}
+	_, canon_ok := canonicalKey(r.Key)
+	return canon_ok
+}
+
+// Do returns the response to the GetItem request in bodybytes, issuing it as part of a
+// BatchGetItem. If the request cannot be batched, the final return value is false and the
+// caller should issue the GetItem itself.
+func Do(bodybytes []byte) ([]byte, int, error, bool) {
+	if !Enabled() {
+		return nil, 0, nil, false
+	}
+	r, ok := parse(bodybytes)
+	if !ok {
+		return nil, 0, nil, false
+	}
+	canon, canon_ok := canonicalKey(r.Key)
+	if !canon_ok {
+		return nil, 0, nil, false
+	}
+	wt := &waiter{bodybytes: bodybytes, key: r.Key, canon: canon, done: make(chan result, 1)}
+	sig := r.signature()
+
+	groups_mut.Lock()
+	g, g_ok := groups[sig]
+	if !g_ok {
+		g = &group{sig: sig, req: *r}
+		groups[sig] = g
+		time.AfterFunc(window, func() { flush(g) })
+	}
+	g.waiters = append(g.waiters, wt)
+	if len(g.waiters) >= MAX_BATCH_KEYS {
+		// full, send it now rather than waiting for the window to close
+		delete(groups, sig)
+		go flush(g)
+	}
+	groups_mut.Unlock()
+
+	res := <-wt.done
+	return res.resp_body, res.code, res.err, true
+}
+
+// flush sends the group's requests as one BatchGetItem, if it has not already been sent.
+func flush(g *group) {
+	groups_mut.Lock()
+	if groups[g.sig] == g {
+		delete(groups, g.sig)
+	}
+	waiters := g.waiters
+	g.waiters = nil
+	groups_mut.Unlock()
+	if len(waiters) == 0 {
+		// already sent when it filled
+		return
+	}
+
+	// duplicate keys are not permitted in a BatchGetItem
+	by_canon := make(map[string][]*waiter)
+	keys := make([]map[string]json.RawMessage, 0, len(waiters))
+	key_names := make(map[string]bool)
+	for _, wt := range waiters {
+		if _, seen := by_canon[wt.canon]; !seen {
+			keys = append(keys, wt.key)
+			for k := range wt.key {
+				key_names[k] = true
+			}
+		}
+		by_canon[wt.canon] = append(by_canon[wt.canon], wt)
+	}
+
+	table_req, strip := projectKeys(&g.req, key_names)
+	items, unprocessed, err := batchGet(g.req.TableName, table_req, keys)
+	for i := 0; err == nil && len(unprocessed) != 0 && i < UNPROCESSED_RETRIES; i++ {
+		time.Sleep(UNPROCESSED_BACKOFF << uint(i))
+		bbpd_metrics.AddRetry("get_item_batcher")
+		var more map[string]map[string]json.RawMessage
+		more, unprocessed, err = batchGet(g.req.TableName, table_req, unprocessed)
+		for k, v := range more {
+			items[k] = v
+		}
+	}
+	if err != nil {
+		// let each caller see the response to its own request
+		bbpd_log.Infof("get_item_batcher.flush:batch of %d failed, reissuing as GetItem: %s", len(keys), err.Error())
+		for _, ws := range by_canon {
+			fallback(ws)
+		}
+		return
+	}
+	pending := make(map[string]bool)
+	for _, k := range unprocessed {
+		if canon, ok := canonicalKey(k); ok {
+			pending[canon] = true
+		}
+	}
+
+	for canon, ws := range by_canon {
+		if pending[canon] {
+			fallback(ws)
+			continue
+		}
+		resp := map[string]interface{}{}
+		if item, found := items[canon]; found {
+			resp["Item"] = stripItem(item, strip)
+		}
+		resp_body, m_err := json.Marshal(resp)
+		for _, wt := range ws {
+			wt.done <- result{resp_body: resp_body, code: http.StatusOK, err: m_err}
+		}
+	}
+}
+
+// fallback issues each waiter's original GetItem individually.
+func fallback(ws []*waiter) {
+	for _, wt := range ws {
+		go func(wt *waiter) {
+			resp_body, code, err := raw.Req(wt.bodybytes, get.GETITEM_ENDPOINT)
+			wt.done <- result{resp_body: resp_body, code: code, err: err}
+		}(wt)
+	}
+}
+
+// projectKeys builds the per-table BatchGetItem request for the group. If the group has a
+// projection, the key attributes are added to it so returned Items can be matched to their
+// keys. The key attributes the callers did not ask for are returned, to be stripped again.
+func projectKeys(r *getItemReq, key_names map[string]bool) (map[string]interface{}, []string) {
+	table_req := map[string]interface{}{"ConsistentRead": r.ConsistentRead}
+	strip := make([]string, 0)
+	if len(r.AttributesToGet) != 0 {
+		attrs := append([]string{}, r.AttributesToGet...)
+		requested := make(map[string]bool)
+		for _, a := range attrs {
+			requested[a] = true
+		}
+		for k := range key_names {
+			if !requested[k] {
+				attrs = append(attrs, k)
+				strip = append(strip, k)
+			}
+		}
+		table_req["AttributesToGet"] = attrs
+	}
+	ean := make(map[string]string)
+	for k, v := range r.ExpressionAttributeNames {
+		ean[k] = v
+	}
+	if r.ProjectionExpression != "" {
+		requested := make(map[string]bool)
+		for _, path := range strings.Split(r.ProjectionExpression, ",") {
+			name := strings.TrimSpace(path)
+			if i := strings.IndexAny(name, ".["); i != -1 {
+				name = name[:i]
+			}
+			if n, ok := ean[name]; ok {
+				name = n
+			}
+			requested[name] = true
+		}
+		projection := r.ProjectionExpression
+		i := 0
+		for k := range key_names {
+			if !requested[k] {
+				placeholder := KEY_NAME_PLACEHOLDER + strconv.Itoa(i)
+				ean[placeholder] = k
+				projection += ", " + placeholder
+				strip = append(strip, k)
+				i++
+			}
+		}
+		table_req["ProjectionExpression"] = projection
+	}
+	if len(ean) != 0 {
+		table_req["ExpressionAttributeNames"] = ean
+	}
+	return table_req, strip
+}
+
+// stripItem removes attributes that were only requested to match the Item to its key.
+func stripItem(item map[string]json.RawMessage, strip []string) map[string]json.RawMessage {
+	for _, k := range strip {
+		delete(item, k)
+	}
+	return item
+}
+
+// batchGet issues one BatchGetItem for keys of table. It returns the Items found, indexed by
+// canonical key, and any UnprocessedKeys. An http error from Dynamo is returned as an error.
+func batchGet(table string, table_req map[string]interface{}, keys []map[string]json.RawMessage) (map[string]map[string]json.RawMessage, []map[string]json.RawMessage, error) {
+	table_req["Keys"] = keys
+	reqbytes, m_err := json.Marshal(map[string]interface{}{
+		"RequestItems": map[string]interface{}{table: table_req}})
+	if m_err != nil {
+		return nil, nil, m_err
+	}
+	resp_body, code, resp_err := raw.Req(reqbytes, BATCHGETITEM_ENDPOINT)
+	if resp_err != nil {
+		return nil, nil, resp_err
+	}
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("http err %d %s", code, string(resp_body))
+		return nil, nil, errors.New(e)
+	}
+	var resp struct {
+		Responses       map[string][]map[string]json.RawMessage
+		UnprocessedKeys map[string]struct {
+			Keys []map[string]json.RawMessage
+		}
+	}
+	if um_err := json.Unmarshal(resp_body, &resp); um_err != nil {
+		return nil, nil, um_err
+	}
+
+	// the key attribute names are those of the requested keys
+	names := make([]string, 0)
+	for k := range keys[0] {
+		names = append(names, k)
+	}
+	items := make(map[string]map[string]json.RawMessage)
+	for _, item := range resp.Responses[table] {
+		key := make(map[string]json.RawMessage, len(names))
+		for _, n := range names {
+			key[n] = item[n]
+		}
+		if canon, ok := canonicalKey(key); ok {
+			items[canon] = item
+		}
+	}
+	return items, resp.UnprocessedKeys[table].Keys, nil
+}
@@ -0,0 +1,181 @@
+package get_item_batcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sig returns the signature of the GetItem request in body, which must be batchable.
+func sig(t *testing.T, body string) string {
+	r, ok := parse([]byte(body))
+	if !ok {
+		t.Fatalf("cannot batch %s", body)
+	}
+	return r.signature()
+}
+
+func TestParse(t *testing.T) {
+	for body, want := range map[string]bool{
+		`{"TableName":"t","Key":{"id":{"S":"a"}}}`:                                  true,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ReturnConsumedCapacity":"NONE"}`:  true,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ReturnConsumedCapacity":"TOTAL"}`: false,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"v"}`:       true,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ExpressionAttributeValues":{}}`:   false,
+		`{"TableName":"t","Key":{}}`:                                                false,
+		`{"Key":{"id":{"S":"a"}}}`:                                                  false,
+		`not json`:                                                                  false,
+	} {
+		if _, ok := parse([]byte(body)); ok != want {
+			t.Errorf("parse(%s) = %v, want %v", body, ok, want)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	base := sig(t, `{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"#v","ExpressionAttributeNames":{"#v":"v","#w":"w"}}`)
+	// the key and the order of ExpressionAttributeNames do not matter
+	if s := sig(t, `{"TableName":"t","Key":{"id":{"S":"b"}},"ProjectionExpression":"#v","ExpressionAttributeNames":{"#w":"w","#v":"v"}}`); s != base {
+		t.Errorf("requests differing only in key have different signatures")
+	}
+	for _, body := range []string{
+		`{"TableName":"u","Key":{"id":{"S":"a"}},"ProjectionExpression":"#v","ExpressionAttributeNames":{"#v":"v","#w":"w"}}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"#v","ExpressionAttributeNames":{"#v":"v","#w":"w"},"ConsistentRead":true}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"#w","ExpressionAttributeNames":{"#v":"v","#w":"w"}}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ProjectionExpression":"#v","ExpressionAttributeNames":{"#v":"x","#w":"w"}}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}}}`,
+	} {
+		if sig(t, body) == base {
+			t.Errorf("%s shares a signature with a different request", body)
+		}
+	}
+	if sig(t, `{"TableName":"t","Key":{"id":{"S":"a"}},"AttributesToGet":["v"]}`) ==
+		sig(t, `{"TableName":"t","Key":{"id":{"S":"a"}},"AttributesToGet":["w"]}`) {
+		t.Errorf("requests for different AttributesToGet share a signature")
+	}
+}
+
+func TestDoGroups(t *testing.T) {
+	Configure(time.Hour)
+	defer Configure(0)
+	bodies := []string{
+		`{"TableName":"t","Key":{"id":{"S":"a"}}}`,
+		`{"TableName":"t","Key":{"id":{"S":"b"}}}`,
+		`{"TableName":"t","Key":{"id":{"S":"a"}},"ConsistentRead":true}`,
+	}
+	var wg sync.WaitGroup
+	for _, body := range bodies {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			resp_body, code, err, batched := Do([]byte(body))
+			if !batched || err != nil || code != http.StatusOK || string(resp_body) != "{}" {
+				t.Errorf("Do(%s) = %s %d %v %v", body, resp_body, code, err, batched)
+			}
+		}(body)
+	}
+	var sizes []int
+	for i := 0; i < 100; i++ {
+		groups_mut.Lock()
+		n := 0
+		sizes = sizes[:0]
+		for _, g := range groups {
+			n += len(g.waiters)
+			sizes = append(sizes, len(g.waiters))
+		}
+		groups_mut.Unlock()
+		if n == len(bodies) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sort.Ints(sizes)
+	if len(sizes) != 2 || sizes[0] != 1 || sizes[1] != 2 {
+		t.Errorf("group sizes %v, want [1 2]", sizes)
+	}
+	// answer the waiters rather than sending the batches
+	groups_mut.Lock()
+	for sig, g := range groups {
+		for _, wt := range g.waiters {
+			wt.done <- result{resp_body: []byte("{}"), code: http.StatusOK}
+		}
+		delete(groups, sig)
+	}
+	groups_mut.Unlock()
+	wg.Wait()
+}
+
+func TestDoNotBatchable(t *testing.T) {
+	body := []byte(`{"TableName":"t","Key":{"id":{"S":"a"}}}`)
+	if _, _, _, batched := Do(body); batched || Batchable(body) {
+		t.Errorf("batched with batching disabled")
+	}
+	Configure(time.Hour)
+	defer Configure(0)
+	body = []byte(`{"TableName":"t","Key":{"id":{"S":"a"}},"ReturnConsumedCapacity":"TOTAL"}`)
+	if _, _, _, batched := Do(body); batched || Batchable(body) {
+		t.Errorf("batched a request for consumed capacity")
+	}
+}
+
+func TestProjectKeysNone(t *testing.T) {
+	table_req, strip := projectKeys(&getItemReq{TableName: "t"}, map[string]bool{"id": true})
+	if _, ok := table_req["AttributesToGet"]; ok {
+		t.Errorf("AttributesToGet added to a request without a projection")
+	}
+	if _, ok := table_req["ProjectionExpression"]; ok {
+		t.Errorf("ProjectionExpression added to a request without a projection")
+	}
+	if len(strip) != 0 {
+		t.Errorf("strip %v, want none", strip)
+	}
+}
+
+func TestProjectKeysAttributesToGet(t *testing.T) {
+	r := &getItemReq{TableName: "t", AttributesToGet: []string{"v", "id"}}
+	table_req, strip := projectKeys(r, map[string]bool{"id": true, "rk": true})
+	attrs := table_req["AttributesToGet"].([]string)
+	sort.Strings(attrs)
+	if strings.Join(attrs, ",") != "id,rk,v" {
+		t.Errorf("AttributesToGet %v, want id, rk and v", attrs)
+	}
+	if len(strip) != 1 || strip[0] != "rk" {
+		t.Errorf("strip %v, want only the unrequested rk", strip)
+	}
+	if len(r.AttributesToGet) != 2 {
+		t.Errorf("the request's AttributesToGet was changed")
+	}
+}
+
+func TestProjectKeysExpression(t *testing.T) {
+	r := &getItemReq{
+		TableName:                "t",
+		ProjectionExpression:     "v.w[0], #i",
+		ExpressionAttributeNames: map[string]string{"#i": "id"},
+	}
+	table_req, strip := projectKeys(r, map[string]bool{"id": true, "rk": true})
+	ean := table_req["ExpressionAttributeNames"].(map[string]string)
+	want := "v.w[0], #i, " + KEY_NAME_PLACEHOLDER + "0"
+	if table_req["ProjectionExpression"] != want || ean[KEY_NAME_PLACEHOLDER+"0"] != "rk" || ean["#i"] != "id" {
+		t.Errorf("ProjectionExpression %v %v, want %s with rk", table_req["ProjectionExpression"], ean, want)
+	}
+	if len(strip) != 1 || strip[0] != "rk" {
+		t.Errorf("strip %v, want only the unrequested rk", strip)
+	}
+	if len(r.ExpressionAttributeNames) != 1 {
+		t.Errorf("the request's ExpressionAttributeNames were changed")
+	}
+}
+
+func TestStripItem(t *testing.T) {
+	var item map[string]json.RawMessage
+	json.Unmarshal([]byte(`{"id":{"S":"a"},"rk":{"N":"1"},"v":{"S":"x"}}`), &item)
+	b, _ := json.Marshal(stripItem(item, []string{"rk"}))
+	if string(b) != `{"id":{"S":"a"},"v":{"S":"x"}}` {
+		t.Errorf("stripped Item %s, want it without rk", b)
+	}
+}
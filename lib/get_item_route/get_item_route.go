@@ -4,25 +4,98 @@ package get_item_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_cache"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/get_item_batcher"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
-	"github.com/smugmug/godynamo/authreq"
 	ep "github.com/smugmug/godynamo/endpoint"
 	get "github.com/smugmug/godynamo/endpoints/get_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// RawPostHandler relays the GetItem request to Dynamo directly.
+// RawPostHandler relays the GetItem request to Dynamo directly. If GetItem batching
+// is configured, the request may be sent as part of a BatchGetItem.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if get_item_batcher.Enabled() {
+		batchingHandler(w, req)
+		return
+	}
 	raw.RawPostReq(w, req, get.GETITEM_ENDPOINT)
 }
 
+// batchingHandler relays the GetItem request through the get_item_batcher, if it can
+// be batched, or directly to Dynamo otherwise. The item cache is consulted first.
+func batchingHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("get_item_route.batchingHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, get.GETITEM_ENDPOINT) {
+		return
+	}
+
+	var resp_body []byte
+	var code int
+	var resp_err error
+	if get_item_batcher.Batchable(bodybytes) {
+		cached, pending := bbpd_cache.LookupGetItem(bodybytes)
+		if cached != nil {
+			resp_body, code = cached, http.StatusOK
+		} else {
+			resp_body, code, resp_err, _ = get_item_batcher.Do(bodybytes)
+			if pending != nil && resp_err == nil && !ep.HttpErr(code) {
+				pending.Store(resp_body)
+			}
+		}
+	} else {
+		resp_body, code, resp_err = raw.Req(bodybytes, get.GETITEM_ENDPOINT)
+	}
+
+	if resp_err != nil {
+		e := fmt.Sprintf("get_item_route.batchingHandler: resp err calling %s err %s (input json: %s)",
+			get.GETITEM_ENDPOINT, resp_err.Error(), string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("get_item_route.batchingHandler: http err %d calling %s (input json: %s)",
+			code, get.GETITEM_ENDPOINT, string(bodybytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		resp_body,
+		code,
+		start,
+		get.GETITEM_ENDPOINT)
+	if mr_err != nil {
+		e := fmt.Sprintf("get_item_route.batchingHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
 // GetItemHandler relays the GetItem request to Dynamo but first validates it through a local type.
 func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
@@ -31,15 +104,15 @@ func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "get_item_route.GetItemHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "get_item_route.GetItemHandler:cannot parse path."
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -47,8 +120,8 @@ func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("get_item_route.GetItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -57,8 +130,8 @@ func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	um_err := json.Unmarshal(bodybytes, g)
 	if um_err != nil {
 		e := fmt.Sprintf("get_item_route.GetItemHandler unmarshal err on %s to Get %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -67,8 +140,8 @@ func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("get_item_route.GetItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -87,15 +160,15 @@ func GetItemHandler(w http.ResponseWriter, req *http.Request) {
 	if mr_err != nil {
 		e := fmt.Sprintf("get_item_route.GetItemHandler %s",
 			mr_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 }
 
 // BBPD-only endpoint.
-// GetItemJSONHandler issues a GetItem request to aws and then transforms the Response into
-// a ResponseItemJSON.
+// GetItemJSONHandler issues a GetItem request, whose Key may be given in basic JSON, to aws
+// and then transforms the Item in the Response into basic JSON.
 func GetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
@@ -105,52 +178,46 @@ func GetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("get_item_route.GetItemJSONHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, get.GETITEM_ENDPOINT) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("get_item_route.GetItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
-	resp_body, code, resp_err := authreq.RetryReqJSON_V4(bodybytes, get.GETITEM_ENDPOINT)
+	resp_body, code, resp_err := raw.Req(reqbytes, get.GETITEM_ENDPOINT)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("get_item_route.GetItemJSONHandler: resp err calling %s err %s (input json: %s)",
-			get.GETITEM_ENDPOINT, resp_err.Error(), string(bodybytes))
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+			get.GETITEM_ENDPOINT, resp_err.Error(), string(reqbytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
 	if ep.HttpErr(code) {
 		e := fmt.Sprintf("get_item_route.GetItemJSONHandler: http err %d calling %s (input json: %s)",
-			code, get.GETITEM_ENDPOINT, string(bodybytes))
+			code, get.GETITEM_ENDPOINT, string(reqbytes))
 		route_response.WriteError(w, code, e, resp_body)
 		return
 	}
 
-	// translate the Response to a ResponseItemJSON
-	resp := get.NewResponse()
-	um_err := json.Unmarshal([]byte(resp_body), resp)
-	if um_err != nil {
-		e := fmt.Sprintf("get_item_route.GetItemJSONHandler:err %s",
-			um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
-	}
-	resp_json, rerr := resp.ToResponseItemJSON()
-	if rerr != nil {
-		e := fmt.Sprintf("get_item_route.GetItemJSONHandler:err %s",
-			rerr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
-	}
-	json_body, jerr := json.Marshal(resp_json)
+	json_body, jerr := bbpd_json.ResponseToJSON(resp_body, "Item")
 	if jerr != nil {
 		e := fmt.Sprintf("get_item_route.GetItemJSONHandler:err %s",
 			jerr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 	mr_err := route_response.MakeRouteResponse(
@@ -163,8 +230,8 @@ func GetItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	if mr_err != nil {
 		e := fmt.Sprintf("get_item_route.GetItemJSONHandler %s",
 			mr_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 }
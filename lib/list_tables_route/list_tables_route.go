@@ -4,6 +4,8 @@ package list_tables_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
@@ -11,7 +13,6 @@ import (
 	list "github.com/smugmug/godynamo/endpoints/list_tables"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -38,8 +39,8 @@ func ListTablesHandler(w http.ResponseWriter, req *http.Request) {
 		listTables_POST_Handler(w, req)
 	} else {
 		e := fmt.Sprintf("list_tables_route.ListTablesHandler:bad method %s", req.Method)
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 	}
 }
 
@@ -49,8 +50,8 @@ func listTables_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "list_tables_route.listTables_POST_Handler:cannot parse path. try /batch-get-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -58,8 +59,8 @@ func listTables_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("list_tables_route.listTables_POST_Handler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -68,18 +69,19 @@ func listTables_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	um_err := json.Unmarshal(bodybytes, &l)
 	if um_err != nil {
 		e := fmt.Sprintf("list_tables_route.listTables_POST_Handler unmarshal err on %s to Get %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
 	resp_body, code, resp_err := l.EndpointReq()
+	bbpd_metrics.AddUpstream(resp_body, code, resp_err)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("list_table_route.ListTable_POST_Handler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -98,8 +100,8 @@ func listTables_POST_Handler(w http.ResponseWriter, req *http.Request) {
 	if mr_err != nil {
 		e := fmt.Sprintf("list_tables_route.listTables_POST_Handler %s",
 			mr_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 }
@@ -111,8 +113,8 @@ func listTables_GET_Handler(w http.ResponseWriter, req *http.Request) {
 	if len(pathElts) != 2 {
 		e := "list_table_route.ListTablesHandler:cannot parse path." +
 			"try /list?ExclusiveStartTableName=$T&Limit=$L"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	queryMap := make(map[string]string)
@@ -131,28 +133,29 @@ func listTables_GET_Handler(w http.ResponseWriter, req *http.Request) {
 		limit_conv, conv_err := strconv.ParseUint(q_limit, 10, 64)
 		if conv_err != nil {
 			e := fmt.Sprintf("list_table_route.listTables_GET_Handler bad limit %s", q_limit)
-			log.Printf(e)
+			bbpd_log.Errorf(e)
 		} else {
 			limit = limit_conv
 			if limit > DEFAULT_LIMIT {
 				e := fmt.Sprintf("list_table_route.listTables_GET_Handler: high limit %d", limit_conv)
-				log.Printf(e)
+				bbpd_log.Infof(e)
 				limit = DEFAULT_LIMIT
 			}
 		}
 	}
 
 	l := list.List{
-		Limit: limit,
+		Limit:                   limit,
 		ExclusiveStartTableName: estn}
 
 	resp_body, code, resp_err := l.EndpointReq()
+	bbpd_metrics.AddUpstream(resp_body, code, resp_err)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("list_table_route.ListTable_GET_Handler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -170,6 +173,6 @@ func listTables_GET_Handler(w http.ResponseWriter, req *http.Request) {
 		list.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("list_table_route.listTable_GET_Handler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
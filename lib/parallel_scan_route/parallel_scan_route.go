@@ -0,0 +1,355 @@
+// Supports a bbpd-only parallel Scan, fanning out one paginated Scan per segment.
+package parallel_scan_route
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_paginate"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_stats"
+	"github.com/smugmug/bbpd/lib/route_response"
+	ep "github.com/smugmug/godynamo/endpoint"
+	scan "github.com/smugmug/godynamo/endpoints/scan"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ENDPOINT_NAME      = "Parallel" + scan.ENDPOINT_NAME
+	JSON_ENDPOINT_NAME = ENDPOINT_NAME + "JSON"
+	SEGMENT            = "Segment"
+	TOTAL_SEGMENTS     = "TotalSegments"
+
+	// AWS permits up to 1000000 segments, but each is a request body built up front and an
+	// entry in the results, so bbpd allows no more than this many
+	MAX_TOTAL_SEGMENTS = 1000
+	// the default concurrency when X-Bbpd-Concurrency is not set
+	DEFAULT_CONCURRENCY = 8
+)
+
+// SegmentResult reports the outcome of scanning one segment.
+type SegmentResult struct {
+	Segment          uint64
+	Count            uint64
+	ScannedCount     uint64
+	Pages            uint64
+	LastEvaluatedKey json.RawMessage `json:",omitempty"`
+	Error            string          `json:",omitempty"`
+}
+
+// Response is the merged result of all segments. Items from each segment are
+// grouped together in segment order.
+type Response struct {
+	Items        []json.RawMessage
+	Count        uint64
+	ScannedCount uint64
+	Segments     []SegmentResult
+}
+
+// the per-segment work, shared by the merged and streamed variants
+type segmentFunc func(segment uint64, page *bbpd_paginate.Page) error
+
+// ParallelScanHandler relays a parallel Scan, returning AttributeValue Items.
+func ParallelScanHandler(w http.ResponseWriter, req *http.Request) {
+	parallelScan(w, req, "parallel_scan_route.ParallelScanHandler", nil)
+}
+
+// BBPD-only endpoint.
+// ParallelScanJSONHandler relays a parallel Scan, returning basic JSON Items. The
+// ExclusiveStartKey and attribute values of the request may also be given in basic JSON.
+func ParallelScanJSONHandler(w http.ResponseWriter, req *http.Request) {
+	parallelScan(w, req, "parallel_scan_route.ParallelScanJSONHandler", bbpd_json.ItemToJSON)
+}
+
+// parallelScan reads a Scan request whose TotalSegments is set and scans each segment
+// in its own goroutine, with at most X-Bbpd-Concurrency segments in flight. Each segment
+// follows LastEvaluatedKey, subject to any X-Bbpd-Max-Items or X-Bbpd-Max-Pages cap, which
+// are applied per segment. A failure in one segment does not stop the others; it is
+// reported in that segment's SegmentResult. If the client goes away, no more pages are
+// read. If coerce is set, the request is also coerced from basic JSON.
+func parallelScan(w http.ResponseWriter, req *http.Request, origin string, coerce func([]byte) ([]byte, error)) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := fmt.Sprintf("%s:method only supports POST", origin)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	caps, caps_err := bbpd_paginate.CapsFromRequest(req)
+	if caps_err != nil {
+		e := fmt.Sprintf("%s:%s", origin, caps_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("%s err reading req body: %s", origin, read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, scan.SCAN_ENDPOINT) {
+		return
+	}
+
+	var reqmap map[string]json.RawMessage
+	um_err := json.Unmarshal(bodybytes, &reqmap)
+	if um_err != nil {
+		e := fmt.Sprintf("%s unmarshal err on %s to Scan %s", origin, string(bodybytes), um_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	if coerce != nil {
+		if c_err := bbpd_json.RequestMapFromJSON(reqmap); c_err != nil {
+			e := fmt.Sprintf("%s cannot convert %s from basic JSON: %s", origin, string(bodybytes), c_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
+			return
+		}
+	}
+	if _, segment_ok := reqmap[SEGMENT]; segment_ok {
+		e := fmt.Sprintf("%s:%s is chosen by bbpd and must not be set", origin, SEGMENT)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	total_segments := uint64(0)
+	if ts, ts_ok := reqmap[TOTAL_SEGMENTS]; ts_ok {
+		if ts_err := json.Unmarshal(ts, &total_segments); ts_err != nil {
+			total_segments = 0
+		}
+	}
+	if total_segments == 0 || total_segments > MAX_TOTAL_SEGMENTS {
+		e := fmt.Sprintf("%s:%s must be set between 1 and %d", origin, TOTAL_SEGMENTS, MAX_TOTAL_SEGMENTS)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	concurrency := uint64(DEFAULT_CONCURRENCY)
+	if v := req.Header.Get(bbpd_const.X_BBPD_CONCURRENCY); v != "" {
+		c, conv_err := strconv.ParseUint(v, 10, 64)
+		if conv_err != nil || c == 0 {
+			e := fmt.Sprintf("%s:bad %s value '%s'", origin, bbpd_const.X_BBPD_CONCURRENCY, v)
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
+			return
+		}
+		concurrency = c
+	}
+	if concurrency > total_segments {
+		concurrency = total_segments
+	}
+
+	// build each segment's request up front so a marshal failure is reported before any work
+	segment_bodies := make([][]byte, total_segments)
+	for i := uint64(0); i < total_segments; i++ {
+		reqmap[SEGMENT] = json.RawMessage(strconv.FormatUint(i, 10))
+		segment_body, m_err := json.Marshal(reqmap)
+		if m_err != nil {
+			e := fmt.Sprintf("%s:cannot marshal segment %d: %s", origin, i, m_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusInternalServerError)
+			return
+		}
+		segment_bodies[i] = segment_body
+	}
+
+	if bbpd_paginate.StreamRequested(req) {
+		streamSegments(req.Context(), w, segment_bodies, concurrency, caps, origin, coerce)
+		bbpd_stats.AddResponse(start)
+		return
+	}
+
+	resp := Response{Items: make([]json.RawMessage, 0)}
+	segment_items := make([][]json.RawMessage, total_segments)
+	resp.Segments = scanSegments(req.Context(), segment_bodies, concurrency, caps,
+		func(segment uint64, page *bbpd_paginate.Page) error {
+			for _, item := range page.Items {
+				if coerce != nil {
+					c, c_err := coerce(item)
+					if c_err != nil {
+						return c_err
+					}
+					item = c
+				}
+				segment_items[segment] = append(segment_items[segment], item)
+			}
+			return nil
+		})
+	for i := range resp.Segments {
+		resp.Items = append(resp.Items, segment_items[i]...)
+		resp.Count += resp.Segments[i].Count
+		resp.ScannedCount += resp.Segments[i].ScannedCount
+	}
+	if coerce != nil {
+		coerceKeys(resp.Segments, coerce)
+	}
+
+	resp_body, m_err := json.Marshal(resp)
+	if m_err != nil {
+		e := fmt.Sprintf("%s:cannot marshal response %s", origin, m_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		resp_body,
+		http.StatusOK,
+		start,
+		ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("%s %s", origin, mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
+// scanSegments paginates each segment body, at most concurrency at a time, calling fn
+// with each page. Each segment's fn calls are made from one goroutine. Once ctx is done,
+// segments stop after their current page and those not yet started are not scanned.
+func scanSegments(ctx context.Context, segment_bodies [][]byte, concurrency uint64, caps bbpd_paginate.Caps, fn segmentFunc) []SegmentResult {
+	results := make([]SegmentResult, len(segment_bodies))
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i := range segment_bodies {
+		select {
+		case sem <- true:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			for j := i; j < len(segment_bodies); j++ {
+				results[j].Segment = uint64(j)
+				results[j].Error = ctx.Err().Error()
+			}
+			bbpd_log.Errorf("parallel_scan_route.scanSegments: %d segments not scanned, err %s",
+				len(segment_bodies)-i, ctx.Err().Error())
+			break
+		}
+		wg.Add(1)
+		go func(segment uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result := &results[segment]
+			result.Segment = segment
+			resp_body, code, err := bbpd_paginate.Paginate(segment_bodies[segment], scan.SCAN_ENDPOINT, caps,
+				func(page *bbpd_paginate.Page) error {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					result.Pages++
+					result.Count += page.Count
+					result.ScannedCount += page.ScannedCount
+					result.LastEvaluatedKey = page.LastEvaluatedKey
+					return fn(segment, page)
+				})
+			if err != nil {
+				result.Error = err.Error()
+			} else if ep.HttpErr(code) {
+				result.Error = fmt.Sprintf("(%d) %s", code, string(resp_body))
+			}
+			if !(len(result.LastEvaluatedKey) != 0 && string(result.LastEvaluatedKey) != "null") {
+				result.LastEvaluatedKey = nil
+			}
+			if result.Error != "" {
+				bbpd_log.Errorf("parallel_scan_route.scanSegments: segment %d err %s", segment, result.Error)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	return results
+}
+
+// coerceKeys converts each segment's LastEvaluatedKey with the Item coercion.
+func coerceKeys(results []SegmentResult, coerce func([]byte) ([]byte, error)) {
+	for i := range results {
+		if results[i].LastEvaluatedKey == nil {
+			continue
+		}
+		c, c_err := coerce(results[i].LastEvaluatedKey)
+		if c_err != nil {
+			results[i].Error = c_err.Error()
+			continue
+		}
+		results[i].LastEvaluatedKey = c
+	}
+}
+
+// streamSegments writes each Item as newline-delimited JSON as its page arrives,
+// interleaving segments. The per-segment results are sent in the X-Bbpd-Segments trailer.
+func streamSegments(ctx context.Context, w http.ResponseWriter, segment_bodies [][]byte, concurrency uint64, caps bbpd_paginate.Caps,
+	origin string, coerce func([]byte) ([]byte, error)) {
+	rc := http.NewResponseController(w)
+	w.Header().Set(bbpd_const.CONTENTTYPE, bbpd_const.NDJSONMIME)
+	w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_COUNT)
+	w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_SCANNED_COUNT)
+	w.Header().Add(bbpd_const.TRAILER, bbpd_const.X_BBPD_SEGMENTS)
+	w.WriteHeader(http.StatusOK)
+
+	var write_mut sync.Mutex
+	results := scanSegments(ctx, segment_bodies, concurrency, caps,
+		func(segment uint64, page *bbpd_paginate.Page) error {
+			lines := make([]byte, 0)
+			for _, item := range page.Items {
+				if coerce != nil {
+					c, c_err := coerce(item)
+					if c_err != nil {
+						return c_err
+					}
+					item = c
+				}
+				lines = append(lines, item...)
+				lines = append(lines, '\n')
+			}
+			write_mut.Lock()
+			defer write_mut.Unlock()
+			dl_err := rc.SetWriteDeadline(time.Now().Add(bbpd_paginate.STREAM_PAGE_TIMEOUT))
+			if dl_err != nil && dl_err != http.ErrNotSupported {
+				return dl_err
+			}
+			if _, w_err := w.Write(lines); w_err != nil {
+				return w_err
+			}
+			if f_err := rc.Flush(); f_err != nil && f_err != http.ErrNotSupported {
+				return f_err
+			}
+			return nil
+		})
+	if coerce != nil {
+		coerceKeys(results, coerce)
+	}
+
+	count := uint64(0)
+	scanned_count := uint64(0)
+	for _, result := range results {
+		count += result.Count
+		scanned_count += result.ScannedCount
+	}
+	w.Header().Set(bbpd_const.X_BBPD_COUNT, strconv.FormatUint(count, 10))
+	w.Header().Set(bbpd_const.X_BBPD_SCANNED_COUNT, strconv.FormatUint(scanned_count, 10))
+	results_json, m_err := json.Marshal(results)
+	if m_err != nil {
+		e := fmt.Sprintf("%s:cannot marshal segment results %s", origin, m_err.Error())
+		bbpd_log.Errorf(e)
+		return
+	}
+	w.Header().Set(bbpd_const.X_BBPD_SEGMENTS, string(results_json))
+}
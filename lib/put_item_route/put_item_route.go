@@ -4,24 +4,109 @@ package put_item_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_spool"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
+	"github.com/smugmug/bbpd/lib/write_behind"
 	ep "github.com/smugmug/godynamo/endpoint"
 	put "github.com/smugmug/godynamo/endpoints/put_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// RawPostHandler relays the PutItem request to Dynamo directly.
+const (
+	// ASYNC_ENDPOINT_NAME names the bbpd-only write-behind variant of PutItem.
+	ASYNC_ENDPOINT_NAME = put.ENDPOINT_NAME + "Async"
+)
+
+// RawPostHandler relays the PutItem request to Dynamo directly. If the X-Bbpd-Async
+// header is set, the request is handled as by PutItemAsyncHandler. If the spool is
+// configured, the request is spooled should Dynamo be unavailable.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if asyncRequested(req) {
+		PutItemAsyncHandler(w, req)
+		return
+	}
+	if bbpd_spool.Enabled() {
+		bbpd_spool.SpoolHandler(w, req, put.PUTITEM_ENDPOINT)
+		return
+	}
 	raw.RawPostReq(w, req, put.PUTITEM_ENDPOINT)
 }
 
+func asyncRequested(req *http.Request) bool {
+	_, async := req.Header[bbpd_const.X_BBPD_ASYNC]
+	return async
+}
+
+// BBPD-only endpoint.
+// PutItemAsyncHandler queues the PutItem request to be written later in a BatchWriteItem,
+// and responds immediately with 202 Accepted. Write-behind must be enabled in the conf.
+func PutItemAsyncHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := "put_item_route.PutItemAsyncHandler:method only supports POST"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("put_item_route.PutItemAsyncHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	if bbpd_ratelimit.Limited(w, req, bodybytes, put.PUTITEM_ENDPOINT) {
+		return
+	}
+	enqueue(w, req, bodybytes, start, "put_item_route.PutItemAsyncHandler")
+}
+
+// enqueue hands the PutItem request to the write-behind queue and acknowledges it.
+func enqueue(w http.ResponseWriter, req *http.Request, bodybytes []byte, start time.Time, origin string) {
+	if !write_behind.Enabled() {
+		e := fmt.Sprintf("%s:write-behind is not enabled", origin)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	q_err := write_behind.Enqueue(bodybytes)
+	if q_err != nil {
+		e := fmt.Sprintf("%s:cannot queue %s: %s", origin, string(bodybytes), q_err.Error())
+		bbpd_log.Errorf(e)
+		code := http.StatusBadRequest
+		if write_behind.Full() {
+			code = http.StatusServiceUnavailable
+		}
+		route_response.Error(w, e, code)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		[]byte("{}"),
+		http.StatusAccepted,
+		start,
+		ASYNC_ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("%s %s", origin, mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
+
 // PutItemHandler relays the PutItem request to Dynamo but first validates it through a local type.
 func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
@@ -30,15 +115,15 @@ func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "put_item_route.PutItemHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "put_item_route.PutItemHandler:cannot parse path. try /put-item, call as POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +131,8 @@ func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("put_item_route.PutItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,8 +141,8 @@ func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("put_item_route.PutItemHandler unmarshal err on %s to PutExpected: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -66,8 +151,8 @@ func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("put_item_route.PutItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -85,15 +170,16 @@ func PutItemHandler(w http.ResponseWriter, req *http.Request) {
 		put.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("put_item_route.PutItemHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
 
 // BBPD-only endpoint.
-// PutItemJSONHandler relays the PutItem request to Dynamo but first validates it through a local type.
-// This variant allows the Item to be encoded as basic JSON. As there is always a conversion that
-// needs to be performed from a PutIemJSON struct to a PutItem, this endpoint cannot utilize
-// RawPost.
+// PutItemJSONHandler relays the PutItem request to Dynamo.
+// This variant allows the Item, ExpressionAttributeValues and Expected values to be encoded as
+// basic JSON, and returns any Attributes in basic JSON. As there is always a conversion that
+// needs to be performed, this endpoint cannot utilize RawPost. If the X-Bbpd-Async header is
+// set, the converted request is queued as by PutItemAsyncHandler.
 func PutItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	if bbpd_runinfo.BBPDAbortIfClosed(w) {
 		return
@@ -101,15 +187,15 @@ func PutItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "put_item_route.PutItemJSONHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "put_item_route.PutItemJSONHandler:cannot parse path. try /put-item, call as POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -117,36 +203,36 @@ func PutItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("put_item_route.PutItemJSONHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
-	p_json := put.NewPutItemJSON()
-	um_err := json.Unmarshal(bodybytes, p_json)
+	if bbpd_ratelimit.Limited(w, req, bodybytes, put.PUTITEM_ENDPOINT) {
+		return
+	}
 
-	if um_err != nil {
-		e := fmt.Sprintf("put_item_route.PutItemJSONHandler unmarshal err on %s to PutExpected: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	// relay through bbpd_spool.Req so the item cache sees the write, and so it may be spooled
+	pbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("put_item_route.PutItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
-	p, perr := p_json.ToPutItem()
-	if perr != nil {
-		e := fmt.Sprintf("put_item_route.PutItemJSONHandler cannot convert PutItemJSON to PutItem:%s", perr.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	if asyncRequested(req) {
+		enqueue(w, req, pbytes, start, "put_item_route.PutItemJSONHandler")
 		return
 	}
 
-	resp_body, code, resp_err := p.EndpointReq()
+	resp_body, code, resp_err := bbpd_spool.Req(pbytes, put.PUTITEM_ENDPOINT)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("put_item_route.PutItemJSONHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -155,15 +241,23 @@ func PutItemJSONHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	json_body, jerr := bbpd_json.ResponseToJSON(resp_body, "Attributes")
+	if jerr != nil {
+		e := fmt.Sprintf("put_item_route.PutItemJSONHandler:err %s", jerr.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
 	mr_err := route_response.MakeRouteResponse(
 		w,
 		req,
-		resp_body,
+		json_body,
 		code,
 		start,
 		put.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("put_item_route.PutItemJSONHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
 	}
 }
@@ -4,6 +4,10 @@ package query_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_paginate"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
@@ -11,14 +15,28 @@ import (
 	query "github.com/smugmug/godynamo/endpoints/query"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// RawPostHandler relays the Query request to Dynamo directly.
+const (
+	// JSON_ENDPOINT_NAME names the bbpd-only basic JSON variant of Query.
+	JSON_ENDPOINT_NAME = query.ENDPOINT_NAME + "JSON"
+)
+
+// RawPostHandler relays the Query request to Dynamo directly. If the X-Bbpd-Paginate
+// header is set, all pages are collected and returned as one response. If the
+// X-Bbpd-Stream header is set, all pages are streamed back as newline-delimited JSON.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_paginate.StreamRequested(req) {
+		bbpd_paginate.StreamHandler(w, req, query.QUERY_ENDPOINT, nil, nil)
+		return
+	}
+	if bbpd_paginate.Requested(req) {
+		bbpd_paginate.PaginateHandler(w, req, query.QUERY_ENDPOINT)
+		return
+	}
 	raw.RawPostReq(w, req, query.QUERY_ENDPOINT)
 }
 
@@ -30,15 +48,15 @@ func QueryHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "query_route.QueryHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "query_route.QueryHandler:cannot parse path. try /create, call as POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +64,8 @@ func QueryHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("query_route.QueryHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,8 +74,8 @@ func QueryHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("query_route.QueryHandler unmarshal err on %s to Create: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -66,8 +84,8 @@ func QueryHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("query_route.QueryHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -85,6 +103,101 @@ func QueryHandler(w http.ResponseWriter, req *http.Request) {
 		query.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("query_route.QueryHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// BBPD-only endpoint.
+// QueryJSONHandler issues a Query request to aws and then transforms each Item (and
+// the LastEvaluatedKey) in the Response into basic JSON. X-Bbpd-Paginate and
+// X-Bbpd-Stream are honored as they are for RawPostHandler. The ExclusiveStartKey and
+// attribute values of the request may also be given in basic JSON.
+func QueryJSONHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := "query_route.QueryJSONHandler:method only supports POST"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	if bbpd_paginate.StreamRequested(req) {
+		bbpd_paginate.StreamHandler(w, req, query.QUERY_ENDPOINT, bbpd_json.RequestFromJSON, bbpd_json.ItemToJSON)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("query_route.QueryJSONHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, query.QUERY_ENDPOINT) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("query_route.QueryJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes = reqbytes
+
+	var resp_body []byte
+	var code int
+	var resp_err error
+	if bbpd_paginate.Requested(req) {
+		caps, caps_err := bbpd_paginate.CapsFromRequest(req)
+		if caps_err != nil {
+			e := fmt.Sprintf("query_route.QueryJSONHandler:%s", caps_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
+			return
+		}
+		resp_body, code, resp_err = bbpd_paginate.Collect(bodybytes, query.QUERY_ENDPOINT, caps)
+	} else {
+		resp_body, code, resp_err = raw.Req(bodybytes, query.QUERY_ENDPOINT)
+	}
+
+	if resp_err != nil {
+		e := fmt.Sprintf("query_route.QueryJSONHandler: resp err calling %s err %s (input json: %s)",
+			query.QUERY_ENDPOINT, resp_err.Error(), string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("query_route.QueryJSONHandler: http err %d calling %s (input json: %s)",
+			code, query.QUERY_ENDPOINT, string(bodybytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	// translate the Response to an ItemsResponseJSON
+	json_body, jerr := bbpd_json.ItemsResponseToJSON(resp_body)
+	if jerr != nil {
+		e := fmt.Sprintf("query_route.QueryJSONHandler:err %s",
+			jerr.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		json_body,
+		http.StatusOK,
+		start,
+		query.ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("query_route.QueryJSONHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
 	}
 }
@@ -1,20 +1,65 @@
 package raw_post_route
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_adaptive"
+	"github.com/smugmug/bbpd/lib/bbpd_cache"
+	"github.com/smugmug/bbpd/lib/bbpd_capacity"
+	"github.com/smugmug/bbpd/lib/bbpd_coalesce"
+	"github.com/smugmug/bbpd/lib/bbpd_conf"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_stats"
 	"github.com/smugmug/bbpd/lib/route_response"
 	"github.com/smugmug/godynamo/authreq"
+	"github.com/smugmug/godynamo/aws_const"
 	ep "github.com/smugmug/godynamo/endpoint"
+	bgi "github.com/smugmug/godynamo/endpoints/batch_get_item"
+	bwi "github.com/smugmug/godynamo/endpoints/batch_write_item"
+	desc "github.com/smugmug/godynamo/endpoints/describe_table"
+	get "github.com/smugmug/godynamo/endpoints/get_item"
+	query "github.com/smugmug/godynamo/endpoints/query"
+	scan "github.com/smugmug/godynamo/endpoints/scan"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
+var (
+	BATCHGETITEM_ENDPOINT   = aws_const.CURRENT_API_VERSION + "." + bgi.ENDPOINT_NAME
+	BATCHWRITEITEM_ENDPOINT = aws_const.CURRENT_API_VERSION + "." + bwi.ENDPOINT_NAME
+)
+
+// Request_Error is returned by BatchGetReq and BatchWriteReq for a request body that cannot
+// be parsed. Such a request is not sent to Dynamo, and sending it again cannot succeed.
+type Request_Error struct {
+	Msg string
+}
+
+func (e *Request_Error) Error() string {
+	return e.Msg
+}
+
+// IsRequestErr returns true if err is a Request_Error.
+func IsRequestErr(err error) bool {
+	_, ok := err.(*Request_Error)
+	return ok
+}
+
+// read-only targets whose identical concurrent requests may share one upstream call
+var coalesce_targets = map[string]bool{
+	get.GETITEM_ENDPOINT:    true,
+	query.QUERY_ENDPOINT:    true,
+	scan.SCAN_ENDPOINT:      true,
+	desc.DESCTABLE_ENDPOINT: true,
+}
+
 // RawPostHandler relays POST data directly to Dynamo, typically called by other endpoint proxy packages
 // that are recognized by the string in the request path.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
@@ -23,23 +68,23 @@ func RawPostHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	if req.Method != "POST" {
 		e := fmt.Sprintf("raw_post_route.RawPostHandler: method only supports POST")
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 3 {
 		e := "raw_post_route.RawPostHandler:cannot parse path"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
 	ue_ep, ue_err := url.QueryUnescape(string(pathElts[2]))
 	if ue_err != nil {
 		e := fmt.Sprintf("raw_table_route.RawPostHandler:cannot unescape %s, %s", string(pathElts[2]), ue_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,18 +101,22 @@ func RawPostReq(w http.ResponseWriter, req *http.Request, amzTarget string) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("raw_post_route.RawPostReq err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, amzTarget) {
 		return
 	}
 
-	resp_body, code, resp_err := authreq.RetryReqJSON_V4(bodybytes, amzTarget)
+	resp_body, code, resp_err := Req(bodybytes, amzTarget)
 
 	if resp_err != nil {
 		e := fmt.Sprintf("raw_post_route.RawPostReq: resp err calling %s err %s (input json: %s)",
 			amzTarget, resp_err.Error(), string(bodybytes))
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -87,6 +136,118 @@ func RawPostReq(w http.ResponseWriter, req *http.Request, amzTarget string) {
 		amzTarget)
 	if mr_err != nil {
 		e := fmt.Sprintf("raw_post_route.RawPostReq %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// Req sends the JSON request bodybytes to the endpoint amzTarget and returns the response
+// body and code. Handlers that relay a request body to Dynamo should call Req rather than
+// authreq directly, so that the item cache is consulted for GetItem and invalidated by writes,
+// and so that identical concurrent reads are coalesced if so configured.
+func Req(bodybytes []byte, amzTarget string) ([]byte, int, error) {
+	var pending *bbpd_cache.Pending
+	if amzTarget == get.GETITEM_ENDPOINT {
+		var cached []byte
+		cached, pending = bbpd_cache.LookupGetItem(bodybytes)
+		if cached != nil {
+			return cached, http.StatusOK, nil
+		}
+	}
+	resp_body, code, resp_err := upstream(bodybytes, amzTarget)
+	// a failed write may still have been applied, so invalidate regardless of the outcome
+	bbpd_cache.Invalidate(amzTarget, bodybytes)
+	if pending != nil && resp_err == nil && !ep.HttpErr(code) {
+		pending.Store(resp_body)
 	}
+	return resp_body, code, resp_err
+}
+
+// coalesceable returns true if identical concurrent requests to amzTarget may share a response.
+// Consistent reads are never shared, as the in-flight read may have started before a write
+// that the caller expects to see.
+func coalesceable(bodybytes []byte, amzTarget string) bool {
+	if !coalesce_targets[amzTarget] {
+		return false
+	}
+	bbpd_conf.Vals.ConfLock.RLock()
+	coalesce_reads := bbpd_conf.Vals.CoalesceReads
+	bbpd_conf.Vals.ConfLock.RUnlock()
+	if !coalesce_reads {
+		return false
+	}
+	var r struct {
+		ConsistentRead bool
+	}
+	um_err := json.Unmarshal(bodybytes, &r)
+	return um_err == nil && !r.ConsistentRead
+}
+
+// upstream makes the request to Dynamo, sharing the call with identical in-flight reads.
+func upstream(bodybytes []byte, amzTarget string) ([]byte, int, error) {
+	if !coalesceable(bodybytes, amzTarget) {
+		return send(bodybytes, amzTarget)
+	}
+	resp_body, code, resp_err, shared := bbpd_coalesce.Do(amzTarget+" "+string(bodybytes),
+		func() ([]byte, int, error) {
+			return send(bodybytes, amzTarget)
+		})
+	if shared {
+		bbpd_stats.AddCoalescedRead()
+	}
+	return resp_body, code, resp_err
+}
+
+// limited makes the request with fn within the adaptive concurrency limits of its tables,
+// recording the capacity consumed.
+func limited(bodybytes []byte, amzTarget string, fn func([]byte) ([]byte, int, error)) ([]byte, int, error) {
+	return bbpd_adaptive.Do(bodybytes, amzTarget, func(limitedbytes []byte) ([]byte, int, error) {
+		return bbpd_capacity.Do(limitedbytes, amzTarget, fn)
+	})
+}
+
+// send makes the request to Dynamo, recording any error and the capacity consumed.
+func send(bodybytes []byte, amzTarget string) ([]byte, int, error) {
+	return limited(bodybytes, amzTarget, func(reqbytes []byte) ([]byte, int, error) {
+		resp_body, code, resp_err := authreq.RetryReqJSON_V4(reqbytes, amzTarget)
+		bbpd_metrics.AddUpstream(resp_body, code, resp_err)
+		return resp_body, code, resp_err
+	})
+}
+
+// BatchGetReq sends the BatchGetItem request bodybytes to Dynamo with DoBatchGet, which
+// splits requests of more than 100 keys. A body that cannot be parsed is a Request_Error.
+// Handlers should call BatchGetReq rather than DoBatchGet directly, so that concurrency is
+// limited and errors and consumed capacity are recorded.
+func BatchGetReq(bodybytes []byte) ([]byte, int, error) {
+	return limited(bodybytes, BATCHGETITEM_ENDPOINT, func(reqbytes []byte) ([]byte, int, error) {
+		b := bgi.NewBatchGetItem()
+		um_err := json.Unmarshal(reqbytes, b)
+		if um_err != nil {
+			e := fmt.Sprintf("raw_post_route.BatchGetReq unmarshal err on %s to BatchGetItem %s", string(reqbytes), um_err.Error())
+			return nil, 0, &Request_Error{Msg: e}
+		}
+		resp_body, code, resp_err := b.DoBatchGet()
+		bbpd_metrics.AddUpstream(resp_body, code, resp_err)
+		return resp_body, code, resp_err
+	})
+}
+
+// BatchWriteReq sends the BatchWriteItem request bodybytes to Dynamo with DoBatchWrite, which
+// splits requests of more than 25 items. A body that cannot be parsed is a Request_Error.
+// Handlers should call BatchWriteReq rather than DoBatchWrite directly, so that concurrency
+// is limited, the item cache is invalidated, and errors and consumed capacity are recorded.
+func BatchWriteReq(bodybytes []byte) ([]byte, int, error) {
+	return limited(bodybytes, BATCHWRITEITEM_ENDPOINT, func(reqbytes []byte) ([]byte, int, error) {
+		b := bwi.NewBatchWriteItem()
+		um_err := json.Unmarshal(reqbytes, b)
+		if um_err != nil {
+			e := fmt.Sprintf("raw_post_route.BatchWriteReq unmarshal err on %s to BatchWriteItem %s", string(reqbytes), um_err.Error())
+			return nil, 0, &Request_Error{Msg: e}
+		}
+		resp_body, code, resp_err := b.DoBatchWrite()
+		bbpd_metrics.AddUpstream(resp_body, code, resp_err)
+		// a failed write may still have been applied, so invalidate regardless of the outcome
+		bbpd_cache.InvalidateBatchWrite(reqbytes)
+		return resp_body, code, resp_err
+	})
 }
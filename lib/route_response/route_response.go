@@ -5,35 +5,62 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
 	"github.com/smugmug/bbpd/lib/bbpd_const"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
 	"github.com/smugmug/bbpd/lib/bbpd_msg"
 	"github.com/smugmug/bbpd/lib/bbpd_stats"
 	ep "github.com/smugmug/godynamo/endpoint"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
-// WriteError is a convenience wrapper for emitting an error.
+// writeErrorBody writes the DynamoDB error response body with the status code.
+func writeErrorBody(w http.ResponseWriter, body []byte, code int) {
+	h := w.Header()
+	h.Del(bbpd_const.CONTENTLENGTH)
+	h.Set(bbpd_const.CONTENTTYPE, bbpd_const.AMZJSONMIME)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// Error replies to the request with an error in the form DynamoDB uses,
+// {"__type": ..., "message": ...}, so that AWS SDKs can parse errors raised by bbpd itself.
+// It is used in place of http.Error; the __type is chosen from the status code.
+func Error(w http.ResponseWriter, message string, code int) {
+	writeErrorBody(w, aws_error.Body(aws_error.TypeForStatus(code), message), code)
+}
+
+// TypedError replies to the request with an error of the __type aws_type.
+func TypedError(w http.ResponseWriter, aws_type, message string, code int) {
+	writeErrorBody(w, aws_error.Body(aws_type, message), code)
+}
+
+// WriteError relays the error response resp_body from Dynamo with its original status code,
+// so that its AWS error type is preserved. If resp_body is not a DynamoDB error, an error
+// with a type chosen from the status code is written instead.
 func WriteError(w http.ResponseWriter, code int, origin string, resp_body []byte) {
-	if ep.ReqErr(code) { // 4xx err
-		e := fmt.Sprintf("%s:(%d) %s", origin, code, string(resp_body))
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
-	} else { // 5xx err
-		e := fmt.Sprintf("%s:(%d) Server Error", origin, code)
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+	e := fmt.Sprintf("%s:(%d) %s", origin, code, string(resp_body))
+	bbpd_log.Errorf(e)
+	if aws_error.Type(resp_body) != "" {
+		writeErrorBody(w, resp_body, code)
+		return
+	}
+	if !ep.ReqErr(code) { // 5xx err
+		e = fmt.Sprintf("%s:(%d) Server Error", origin, code)
 	}
+	Error(w, e, code)
 }
 
 // MakeRouteResponse wraps a dynamo response with some debugging information related to http codes and request duration.
+// Any 2xx code is written as the response status.
 func MakeRouteResponse(w http.ResponseWriter, req *http.Request, resp_body []byte, code int, start time.Time, endpoint_name string) error {
 	end := time.Now()
 	duration := fmt.Sprintf("%v", end.Sub(start))
-	if resp_body != nil && code == http.StatusOK {
+	if resp_body != nil && !ep.HttpErr(code) {
 		// add the response to the stats
 		bbpd_stats.AddResponse(start)
 
@@ -62,38 +89,30 @@ func MakeRouteResponse(w http.ResponseWriter, req *http.Request, resp_body []byt
 			if json_err != nil {
 				e := fmt.Sprintf("route_response.MakeRouteResponse:marshal failure %s",
 					json_err.Error())
-				log.Printf(e)
-				http.Error(w, e, http.StatusInternalServerError)
+				bbpd_log.Errorf(e)
+				Error(w, e, http.StatusInternalServerError)
 				return json_err
 			}
 		}
 
 		// we support pretty-printing (indent)
 		// just pass indent=1 (the 1 can be anything) in the url
+		out_str := string(b)
 		if indent_output {
 			var buf bytes.Buffer
 			if i_err := json.Indent(&buf, b, "", "\t"); i_err != nil {
 				// could not pretty print!
 				e := fmt.Sprintf("route_response.MakeRouteResponse cannot indent %s", string(b))
-				log.Printf(e)
-				unindented_str := string(b)
-				w.Header().Set(bbpd_const.CONTENTLENGTH,
-					strconv.Itoa(len(unindented_str)))
-				io.WriteString(w, unindented_str)
+				bbpd_log.Errorf(e)
 			} else {
 				// do the pretty print
-				indented_str := buf.String()
-				w.Header().Set(bbpd_const.CONTENTLENGTH,
-					strconv.Itoa(len(indented_str)))
-				io.WriteString(w, indented_str)
+				out_str = buf.String()
 			}
-		} else {
-			// no pretty print requested
-			unindented_str := string(b)
-			w.Header().Set(bbpd_const.CONTENTLENGTH,
-				strconv.Itoa(len(unindented_str)))
-			io.WriteString(w, unindented_str)
 		}
+		w.Header().Set(bbpd_const.CONTENTLENGTH,
+			strconv.Itoa(len(out_str)))
+		w.WriteHeader(code)
+		io.WriteString(w, out_str)
 		return nil
 	} else {
 		s := ""
@@ -101,8 +120,12 @@ func MakeRouteResponse(w http.ResponseWriter, req *http.Request, resp_body []byt
 			s = string(resp_body)
 		}
 		e := fmt.Sprintf("route_response.MakeRouteResponse %s", s)
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		if ep.HttpErr(code) {
+			WriteError(w, code, "route_response.MakeRouteResponse", resp_body)
+		} else {
+			bbpd_log.Errorf(e)
+			Error(w, e, http.StatusInternalServerError)
+		}
 		return errors.New(e)
 	}
 }
@@ -4,6 +4,10 @@ package scan_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_paginate"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
@@ -11,14 +15,28 @@ import (
 	scan "github.com/smugmug/godynamo/endpoints/scan"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// RawPostHandler relays the Scan request to Dynamo directly.
+const (
+	// JSON_ENDPOINT_NAME names the bbpd-only basic JSON variant of Scan.
+	JSON_ENDPOINT_NAME = scan.ENDPOINT_NAME + "JSON"
+)
+
+// RawPostHandler relays the Scan request to Dynamo directly. If the X-Bbpd-Paginate
+// header is set, all pages are collected and returned as one response. If the
+// X-Bbpd-Stream header is set, all pages are streamed back as newline-delimited JSON.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_paginate.StreamRequested(req) {
+		bbpd_paginate.StreamHandler(w, req, scan.SCAN_ENDPOINT, nil, nil)
+		return
+	}
+	if bbpd_paginate.Requested(req) {
+		bbpd_paginate.PaginateHandler(w, req, scan.SCAN_ENDPOINT)
+		return
+	}
 	raw.RawPostReq(w, req, scan.SCAN_ENDPOINT)
 }
 
@@ -30,15 +48,15 @@ func ScanHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "scan_route.ScanHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "scan_route.ScanHandler:cannot parse path. try /create, call as POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +64,8 @@ func ScanHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("scan_route.ScanHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,8 +74,8 @@ func ScanHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("scan_route.ScanHandler unmarshal err on %s to Create: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -66,8 +84,8 @@ func ScanHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("scan_route.ScanHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -85,6 +103,101 @@ func ScanHandler(w http.ResponseWriter, req *http.Request) {
 		scan.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("scan_route.ScanHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// BBPD-only endpoint.
+// ScanJSONHandler issues a Scan request to aws and then transforms each Item (and
+// the LastEvaluatedKey) in the Response into basic JSON. X-Bbpd-Paginate and
+// X-Bbpd-Stream are honored as they are for RawPostHandler. The ExclusiveStartKey and
+// attribute values of the request may also be given in basic JSON.
+func ScanJSONHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := "scan_route.ScanJSONHandler:method only supports POST"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	if bbpd_paginate.StreamRequested(req) {
+		bbpd_paginate.StreamHandler(w, req, scan.SCAN_ENDPOINT, bbpd_json.RequestFromJSON, bbpd_json.ItemToJSON)
+		return
+	}
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, scan.SCAN_ENDPOINT) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	bodybytes = reqbytes
+
+	var resp_body []byte
+	var code int
+	var resp_err error
+	if bbpd_paginate.Requested(req) {
+		caps, caps_err := bbpd_paginate.CapsFromRequest(req)
+		if caps_err != nil {
+			e := fmt.Sprintf("scan_route.ScanJSONHandler:%s", caps_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusBadRequest)
+			return
+		}
+		resp_body, code, resp_err = bbpd_paginate.Collect(bodybytes, scan.SCAN_ENDPOINT, caps)
+	} else {
+		resp_body, code, resp_err = raw.Req(bodybytes, scan.SCAN_ENDPOINT)
+	}
+
+	if resp_err != nil {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler: resp err calling %s err %s (input json: %s)",
+			scan.SCAN_ENDPOINT, resp_err.Error(), string(bodybytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler: http err %d calling %s (input json: %s)",
+			code, scan.SCAN_ENDPOINT, string(bodybytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	// translate the Response to an ItemsResponseJSON
+	json_body, jerr := bbpd_json.ItemsResponseToJSON(resp_body)
+	if jerr != nil {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler:err %s",
+			jerr.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		json_body,
+		http.StatusOK,
+		start,
+		scan.ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("scan_route.ScanJSONHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
 	}
 }
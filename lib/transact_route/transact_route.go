@@ -0,0 +1,144 @@
+// Supports proxying the TransactWriteItems and TransactGetItems endpoints with Items, Keys
+// and attribute values in basic JSON.
+package transact_route
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_endpoints"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
+	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	"github.com/smugmug/bbpd/lib/route_response"
+	ep "github.com/smugmug/godynamo/endpoint"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	WRITE_JSON_ENDPOINT_NAME = bbpd_endpoints.TRANSACT_WRITE_ITEMS + "JSON"
+	GET_JSON_ENDPOINT_NAME   = bbpd_endpoints.TRANSACT_GET_ITEMS + "JSON"
+)
+
+// getResponseToJSON coerces the Item of each of the Responses of a TransactGetItems
+// response to basic JSON.
+func getResponseToJSON(resp_body []byte) ([]byte, error) {
+	var respmap map[string]json.RawMessage
+	if um_err := json.Unmarshal(resp_body, &respmap); um_err != nil {
+		return nil, um_err
+	}
+	responses_body, ok := respmap["Responses"]
+	if !ok {
+		return resp_body, nil
+	}
+	var responses []map[string]json.RawMessage
+	if um_err := json.Unmarshal(responses_body, &responses); um_err != nil {
+		return nil, um_err
+	}
+	for _, r := range responses {
+		if c_err := bbpd_json.FieldsToJSON(r, "Item"); c_err != nil {
+			return nil, c_err
+		}
+	}
+	b, m_err := json.Marshal(responses)
+	if m_err != nil {
+		return nil, m_err
+	}
+	respmap["Responses"] = b
+	return json.Marshal(respmap)
+}
+
+// TransactWriteItemsJSONHandler relays the TransactWriteItems request to Dynamo, with the
+// Items, Keys and ExpressionAttributeValues of its actions given in basic JSON.
+func TransactWriteItemsJSONHandler(w http.ResponseWriter, req *http.Request) {
+	transactJSON(w, req, bbpd_endpoints.TRANSACTWRITEITEMS_ENDPOINT, WRITE_JSON_ENDPOINT_NAME,
+		"transact_route.TransactWriteItemsJSONHandler", nil)
+}
+
+// TransactGetItemsJSONHandler relays the TransactGetItems request to Dynamo, with the Keys
+// of its actions given in basic JSON, and returns the Items of the response in basic JSON.
+func TransactGetItemsJSONHandler(w http.ResponseWriter, req *http.Request) {
+	transactJSON(w, req, bbpd_endpoints.TRANSACTGETITEMS_ENDPOINT, GET_JSON_ENDPOINT_NAME,
+		"transact_route.TransactGetItemsJSONHandler", getResponseToJSON)
+}
+
+// transactJSON coerces the request from basic JSON and relays it to amzTarget. If coerce is
+// set, it is applied to a successful response.
+func transactJSON(w http.ResponseWriter, req *http.Request, amzTarget, endpoint_name, origin string,
+	coerce func([]byte) ([]byte, error)) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := fmt.Sprintf("%s:method only supports POST", origin)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("%s err reading req body: %s", origin, read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, amzTarget) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("%s cannot convert %s from basic JSON: %s", origin, string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	resp_body, code, resp_err := raw.Req(reqbytes, amzTarget)
+
+	if resp_err != nil {
+		e := fmt.Sprintf("%s: resp err calling %s err %s (input json: %s)",
+			origin, amzTarget, resp_err.Error(), string(reqbytes))
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		e := fmt.Sprintf("%s: http err %d calling %s (input json: %s)",
+			origin, code, amzTarget, string(reqbytes))
+		route_response.WriteError(w, code, e, resp_body)
+		return
+	}
+
+	if coerce != nil {
+		json_body, json_err := coerce(resp_body)
+		if json_err != nil {
+			e := fmt.Sprintf("%s:err %s", origin, json_err.Error())
+			bbpd_log.Errorf(e)
+			route_response.Error(w, e, http.StatusInternalServerError)
+			return
+		}
+		resp_body = json_body
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		resp_body,
+		code,
+		start,
+		endpoint_name)
+	if mr_err != nil {
+		e := fmt.Sprintf("%s %s", origin, mr_err.Error())
+		bbpd_log.Errorf(e)
+	}
+}
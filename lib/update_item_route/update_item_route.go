@@ -4,21 +4,34 @@ package update_item_route
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/smugmug/bbpd/lib/bbpd_json"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_ratelimit"
 	"github.com/smugmug/bbpd/lib/bbpd_runinfo"
+	"github.com/smugmug/bbpd/lib/bbpd_spool"
 	raw "github.com/smugmug/bbpd/lib/raw_post_route"
 	"github.com/smugmug/bbpd/lib/route_response"
 	ep "github.com/smugmug/godynamo/endpoint"
 	update_item "github.com/smugmug/godynamo/endpoints/update_item"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// RawPostHandler relays the UpdateItem request to Dynamo directly.
+const (
+	// JSON_ENDPOINT_NAME names the bbpd-only basic JSON variant of UpdateItem.
+	JSON_ENDPOINT_NAME = update_item.ENDPOINT_NAME + "JSON"
+)
+
+// RawPostHandler relays the UpdateItem request to Dynamo directly. If the spool is
+// configured, the request is spooled should Dynamo be unavailable.
 func RawPostHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_spool.Enabled() {
+		bbpd_spool.SpoolHandler(w, req, update_item.UPDATEITEM_ENDPOINT)
+		return
+	}
 	raw.RawPostReq(w, req, update_item.UPDATEITEM_ENDPOINT)
 }
 
@@ -30,15 +43,15 @@ func UpdateItemHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	if req.Method != "POST" {
 		e := "update_item_route.UpdateItemHandler:method only supports POST"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 	pathElts := strings.Split(req.URL.Path, "/")
 	if len(pathElts) != 2 {
 		e := "update_item_route.UpdateItemHandler:cannot parse path. try /update-item"
-		log.Printf(e)
-		http.Error(w, e, http.StatusBadRequest)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
 		return
 	}
 
@@ -46,8 +59,8 @@ func UpdateItemHandler(w http.ResponseWriter, req *http.Request) {
 	req.Body.Close()
 	if read_err != nil && read_err != io.EOF {
 		e := fmt.Sprintf("update_item_route.UpdateItemHandler err reading req body: %s", read_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -56,8 +69,8 @@ func UpdateItemHandler(w http.ResponseWriter, req *http.Request) {
 
 	if um_err != nil {
 		e := fmt.Sprintf("update_item_route.UpdateItemHandler unmarshal err on %s to Update: %s", string(bodybytes), um_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -66,8 +79,8 @@ func UpdateItemHandler(w http.ResponseWriter, req *http.Request) {
 	if resp_err != nil {
 		e := fmt.Sprintf("update_item_route.UpdateItemHandler:err %s",
 			resp_err.Error())
-		log.Printf(e)
-		http.Error(w, e, http.StatusInternalServerError)
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
 		return
 	}
 
@@ -85,6 +98,83 @@ func UpdateItemHandler(w http.ResponseWriter, req *http.Request) {
 		update_item.ENDPOINT_NAME)
 	if mr_err != nil {
 		e := fmt.Sprintf("update_item_route.UpdateItemHandler %s", mr_err.Error())
-		log.Printf(e)
+		bbpd_log.Errorf(e)
+	}
+}
+
+// BBPD-only endpoint.
+// UpdateItemJSONHandler relays the UpdateItem request to Dynamo.
+// This variant allows the Key, ExpressionAttributeValues, Expected values and
+// AttributeUpdates values to be encoded as basic JSON, and
+// returns any Attributes in basic JSON. As there is always a conversion that needs to be
+// performed, this endpoint cannot utilize RawPost. If the spool is configured,
+// the request is spooled should Dynamo be unavailable.
+func UpdateItemJSONHandler(w http.ResponseWriter, req *http.Request) {
+	if bbpd_runinfo.BBPDAbortIfClosed(w) {
+		return
+	}
+	start := time.Now()
+	if req.Method != "POST" {
+		e := "update_item_route.UpdateItemJSONHandler:method only supports POST"
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	bodybytes, read_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if read_err != nil && read_err != io.EOF {
+		e := fmt.Sprintf("update_item_route.UpdateItemJSONHandler err reading req body: %s", read_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if bbpd_ratelimit.Limited(w, req, bodybytes, update_item.UPDATEITEM_ENDPOINT) {
+		return
+	}
+
+	reqbytes, c_err := bbpd_json.RequestFromJSON(bodybytes)
+	if c_err != nil {
+		e := fmt.Sprintf("update_item_route.UpdateItemJSONHandler cannot convert %s from basic JSON: %s", string(bodybytes), c_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	// relay through bbpd_spool.Req so the item cache sees the write, and so it may be spooled
+	resp_body, code, resp_err := bbpd_spool.Req(reqbytes, update_item.UPDATEITEM_ENDPOINT)
+
+	if resp_err != nil {
+		e := fmt.Sprintf("update_item_route.UpdateItemJSONHandler:err %s",
+			resp_err.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	if ep.HttpErr(code) {
+		route_response.WriteError(w, code, "update_item_route.UpdateItemJSONHandler", resp_body)
+		return
+	}
+
+	json_body, jerr := bbpd_json.ResponseToJSON(resp_body, "Attributes")
+	if jerr != nil {
+		e := fmt.Sprintf("update_item_route.UpdateItemJSONHandler:err %s", jerr.Error())
+		bbpd_log.Errorf(e)
+		route_response.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	mr_err := route_response.MakeRouteResponse(
+		w,
+		req,
+		json_body,
+		code,
+		start,
+		JSON_ENDPOINT_NAME)
+	if mr_err != nil {
+		e := fmt.Sprintf("update_item_route.UpdateItemJSONHandler %s", mr_err.Error())
+		bbpd_log.Errorf(e)
 	}
 }
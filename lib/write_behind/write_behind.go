@@ -0,0 +1,390 @@
+// Write-behind buffering of PutItem requests. Items are acknowledged as soon as they are
+// queued, and a background flusher writes them with BatchWriteItem requests of up to 25
+// Items, retrying any UnprocessedItems with backoff. Items that cannot be written after
+// MAX_ATTEMPTS are handed to the write spool, if it is open, and otherwise dropped.
+package write_behind
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smugmug/bbpd/lib/aws_error"
+	"github.com/smugmug/bbpd/lib/bbpd_log"
+	"github.com/smugmug/bbpd/lib/bbpd_metrics"
+	"github.com/smugmug/bbpd/lib/bbpd_spool"
+	raw "github.com/smugmug/bbpd/lib/raw_post_route"
+	ep "github.com/smugmug/godynamo/endpoint"
+	put "github.com/smugmug/godynamo/endpoints/put_item"
+	"sync"
+	"time"
+)
+
+const (
+	// BatchWriteItem accepts at most this many requests
+	BATCH_SIZE = 25
+	// an Item is spooled or dropped after this many failed attempts to write it
+	MAX_ATTEMPTS = 10
+	// the bounds of the wait after a batch that was not entirely written
+	MIN_BACKOFF = 100 * time.Millisecond
+	MAX_BACKOFF = 30 * time.Second
+	// the default interval between flushes of a partial batch
+	DEFAULT_FLUSH_INTERVAL = 100 * time.Millisecond
+	// how long Flush waits for the queue to drain
+	FLUSH_TIMEOUT = 10 * time.Second
+)
+
+// Summary reports the state of the write-behind queue.
+type Summary struct {
+	Enabled    bool
+	QueueDepth int
+	Written    uint64
+	Retried    uint64
+	Failed     uint64
+}
+
+// a queued PutItem
+type write struct {
+	table    string
+	item     json.RawMessage
+	attempts int
+}
+
+var (
+	queue          []*write
+	queue_size     int
+	flush_interval time.Duration
+	// writes taken from the queue but not yet written
+	in_flight int
+	written   uint64
+	retried   uint64
+	failed    uint64
+	queue_mut sync.Mutex
+	// held while a batch is written, so that an older version of an Item that is returned
+	// to the queue cannot be written after a newer one
+	flush_mut sync.Mutex
+	// wakes the flusher when a full batch is queued
+	wake    chan bool
+	started bool
+)
+
+func init() {
+	wake = make(chan bool, 1)
+}
+
+// Configure sets the maximum queue depth and flush interval, and starts the flusher.
+// A size of 0 disables write-behind; Items already queued are still written.
+func Configure(size int, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_FLUSH_INTERVAL
+	}
+	queue_mut.Lock()
+	queue_size = size
+	flush_interval = interval
+	if size > 0 && !started {
+		started = true
+		go flusher()
+	}
+	queue_mut.Unlock()
+}
+
+// Enabled returns true if write-behind has been configured.
+func Enabled() bool {
+	queue_mut.Lock()
+	defer queue_mut.Unlock()
+	return queue_size > 0
+}
+
+// GetSummary returns the current queue statistics.
+func GetSummary() Summary {
+	queue_mut.Lock()
+	defer queue_mut.Unlock()
+	return Summary{
+		Enabled:    queue_size > 0,
+		QueueDepth: len(queue) + in_flight,
+		Written:    written,
+		Retried:    retried,
+		Failed:     failed}
+}
+
+// Full returns true if the queue cannot accept more Items.
+func Full() bool {
+	queue_mut.Lock()
+	defer queue_mut.Unlock()
+	return len(queue) >= queue_size
+}
+
+// the only PutItem fields that can be expressed in a BatchWriteItem
+type putReq struct {
+	TableName string
+	Item      json.RawMessage
+}
+
+// Enqueue queues the PutItem request in bodybytes. Requests that use conditions or
+// ask for return values cannot be batched and are rejected.
+func Enqueue(bodybytes []byte) error {
+	var fields map[string]json.RawMessage
+	if um_err := json.Unmarshal(bodybytes, &fields); um_err != nil {
+		return um_err
+	}
+	for k, v := range fields {
+		switch k {
+		case "TableName", "Item":
+		case "ReturnValues", "ReturnConsumedCapacity", "ReturnItemCollectionMetrics":
+			if string(v) != `"NONE"` && string(v) != "null" {
+				e := fmt.Sprintf("%s cannot be used with an asynchronous PutItem", k)
+				return errors.New(e)
+			}
+		default:
+			e := fmt.Sprintf("%s cannot be used with an asynchronous PutItem", k)
+			return errors.New(e)
+		}
+	}
+	var p putReq
+	if um_err := json.Unmarshal(bodybytes, &p); um_err != nil {
+		return um_err
+	}
+	if p.TableName == "" || len(p.Item) == 0 {
+		return errors.New("TableName and Item are required")
+	}
+	queue_mut.Lock()
+	defer queue_mut.Unlock()
+	if queue_size == 0 {
+		return errors.New("write-behind is not enabled")
+	}
+	if len(queue) >= queue_size {
+		return errors.New("write-behind queue is full")
+	}
+	queue = append(queue, &write{table: p.TableName, item: p.Item})
+	if len(queue) >= BATCH_SIZE {
+		select {
+		case wake <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+// flusher writes a batch whenever one is full, or every flush_interval.
+func flusher() {
+	for {
+		queue_mut.Lock()
+		interval := flush_interval
+		queue_mut.Unlock()
+		select {
+		case <-wake:
+		case <-time.After(interval):
+		}
+		backoff := time.Duration(0)
+		for {
+			n, retries := flushBatch()
+			if retries > 0 {
+				backoff = nextBackoff(backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			backoff = 0
+			if n < BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// nextBackoff returns the wait after another batch that was not entirely written.
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < MIN_BACKOFF {
+		backoff = MIN_BACKOFF
+	}
+	if backoff > MAX_BACKOFF {
+		backoff = MAX_BACKOFF
+	}
+	return backoff
+}
+
+// flushBatch writes up to BATCH_SIZE queued Items and returns the number taken from the queue
+// and the number returned to the front of the queue to be retried, as they were unprocessed
+// or failed. Items that have run out of attempts are spooled or dropped.
+func flushBatch() (int, int) {
+	flush_mut.Lock()
+	defer flush_mut.Unlock()
+	queue_mut.Lock()
+	n := len(queue)
+	if n > BATCH_SIZE {
+		n = BATCH_SIZE
+	}
+	batch := queue[:n]
+	queue = queue[n:]
+	in_flight += n
+	queue_mut.Unlock()
+	if n == 0 {
+		return 0, 0
+	}
+
+	retry, rejected := writeBatch(batch)
+
+	queue_mut.Lock()
+	in_flight -= n
+	failed += uint64(rejected)
+	requeue := make([]*write, 0, len(retry))
+	exhausted := make([]*write, 0)
+	for _, w := range retry {
+		w.attempts++
+		if w.attempts >= MAX_ATTEMPTS {
+			exhausted = append(exhausted, w)
+			continue
+		}
+		retried++
+		bbpd_metrics.AddRetry("write_behind")
+		requeue = append(requeue, w)
+	}
+	written += uint64(n - len(retry) - rejected)
+	queue = append(requeue, queue...)
+	queue_mut.Unlock()
+
+	for _, w := range exhausted {
+		giveUp(w)
+	}
+	return n, len(requeue)
+}
+
+// giveUp hands the write w, which has run out of attempts, to the write spool if it is open,
+// and otherwise drops it.
+func giveUp(w *write) {
+	if bbpd_spool.Enabled() {
+		bodybytes, m_err := json.Marshal(map[string]interface{}{"TableName": w.table, "Item": w.item})
+		if m_err == nil {
+			s_err := bbpd_spool.Spool(bodybytes, put.PUTITEM_ENDPOINT)
+			if s_err == nil {
+				bbpd_log.Infof("write_behind.giveUp:spooled Item for %s after %d attempts", w.table, w.attempts)
+				queue_mut.Lock()
+				written++
+				queue_mut.Unlock()
+				return
+			}
+			bbpd_log.Errorf("write_behind.giveUp:cannot spool Item for %s: %s", w.table, s_err.Error())
+		}
+	}
+	queue_mut.Lock()
+	failed++
+	queue_mut.Unlock()
+	bbpd_log.Errorf("write_behind.giveUp:dropping Item for %s after %d attempts: %s",
+		w.table, w.attempts, string(w.item))
+}
+
+// writeBatch issues one BatchWriteItem for the batch. It returns the writes that must be
+// retried and the number of Items rejected by Dynamo. If Dynamo rejects the batch outright
+// (for example, if two Items share a key), each Item is written with its own PutItem instead.
+func writeBatch(batch []*write) ([]*write, int) {
+	request_items := make(map[string][]interface{})
+	attempts := 0
+	for _, w := range batch {
+		request_items[w.table] = append(request_items[w.table],
+			map[string]interface{}{"PutRequest": map[string]interface{}{"Item": w.item}})
+		if w.attempts > attempts {
+			attempts = w.attempts
+		}
+	}
+	bodybytes, m_err := json.Marshal(map[string]interface{}{"RequestItems": request_items})
+	if m_err != nil {
+		bbpd_log.Errorf("write_behind.writeBatch:cannot marshal batch: %s", m_err.Error())
+		return batch, 0
+	}
+	resp_body, code, resp_err := raw.BatchWriteReq(bodybytes)
+	if resp_err != nil {
+		bbpd_log.Errorf("write_behind.writeBatch:err %s", resp_err.Error())
+		return batch, 0
+	}
+	if ep.ReqErr(code) && !aws_error.Throttled(resp_body) {
+		bbpd_log.Infof("write_behind.writeBatch:batch rejected (%d) %s, writing Items individually", code, string(resp_body))
+		return writeEach(batch)
+	}
+	if ep.HttpErr(code) {
+		bbpd_log.Errorf("write_behind.writeBatch:http err (%d) %s", code, string(resp_body))
+		return batch, 0
+	}
+
+	var resp struct {
+		UnprocessedItems map[string][]struct {
+			PutRequest *struct {
+				Item json.RawMessage
+			}
+		}
+	}
+	if um_err := json.Unmarshal(resp_body, &resp); um_err != nil {
+		bbpd_log.Errorf("write_behind.writeBatch:cannot unmarshal response %s: %s", string(resp_body), um_err.Error())
+		return nil, 0
+	}
+	// unprocessed Items cannot be reliably matched to the writes in the batch, so they
+	// inherit the highest attempt count in the batch
+	retry := make([]*write, 0)
+	for table, unprocessed := range resp.UnprocessedItems {
+		for _, u := range unprocessed {
+			if u.PutRequest != nil {
+				retry = append(retry, &write{table: table, item: u.PutRequest.Item, attempts: attempts})
+			}
+		}
+	}
+	return retry, 0
+}
+
+// writeEach writes each Item with its own PutItem. It returns the writes that must be
+// retried and the number of Items rejected by Dynamo, which are dropped.
+func writeEach(batch []*write) ([]*write, int) {
+	retry := make([]*write, 0)
+	rejected := 0
+	for _, w := range batch {
+		bodybytes, m_err := json.Marshal(map[string]interface{}{"TableName": w.table, "Item": w.item})
+		if m_err != nil {
+			retry = append(retry, w)
+			continue
+		}
+		resp_body, code, resp_err := raw.Req(bodybytes, put.PUTITEM_ENDPOINT)
+		if resp_err != nil {
+			retry = append(retry, w)
+		} else if ep.ReqErr(code) && !aws_error.Throttled(resp_body) {
+			bbpd_log.Errorf("write_behind.writeEach:Item for %s rejected (%d) %s: %s",
+				w.table, code, string(resp_body), string(w.item))
+			rejected++
+		} else if ep.HttpErr(code) {
+			retry = append(retry, w)
+		}
+	}
+	return retry, rejected
+}
+
+// Flush writes every queued Item, waiting at most FLUSH_TIMEOUT, after which the Items left in
+// the queue are spooled or dropped. It should be called when bbpd stops, as queued Items have
+// already been acknowledged to callers.
+func Flush() error {
+	deadline := time.Now().Add(FLUSH_TIMEOUT)
+	backoff := time.Duration(0)
+	for time.Now().Before(deadline) {
+		queue_mut.Lock()
+		depth := len(queue) + in_flight
+		queue_mut.Unlock()
+		if depth == 0 {
+			return nil
+		}
+		if _, retries := flushBatch(); retries > 0 {
+			backoff = nextBackoff(backoff)
+			if remaining := time.Until(deadline); backoff > remaining {
+				backoff = remaining
+			}
+			time.Sleep(backoff)
+		} else {
+			backoff = 0
+		}
+	}
+	// what could not be written in time is spooled, if possible
+	queue_mut.Lock()
+	unwritten := queue
+	queue = nil
+	depth := len(unwritten) + in_flight
+	queue_mut.Unlock()
+	for _, w := range unwritten {
+		giveUp(w)
+	}
+	e := fmt.Sprintf("write_behind.Flush:timed out with %d Items unwritten", depth)
+	return errors.New(e)
+}
@@ -0,0 +1,19 @@
+# run as: bbpd -admin 127.0.0.1:12399
+curl "http://127.0.0.1:12399/State";
+echo "";
+curl -X POST "http://127.0.0.1:12399/Drain";
+echo "";
+# refused while drained, 503
+curl "http://localhost:12333/Status";
+echo "";
+curl -X POST "http://127.0.0.1:12399/Resume";
+echo "";
+curl -X POST -d '{"LogLevel":"debug"}' "http://127.0.0.1:12399/LogLevel";
+echo "";
+curl "http://127.0.0.1:12399/Connections";
+echo "";
+curl "http://127.0.0.1:12399/Goroutines" | head -20;
+curl -X POST "http://127.0.0.1:12399/Reload";
+echo "";
+curl -X POST "http://127.0.0.1:12399/Shutdown";
+echo "";
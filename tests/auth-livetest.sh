@@ -0,0 +1,14 @@
+# run with an Auth PolicyFile in bbpd-config.json, giving the key "reporting-key" GetItem on
+# reports_* and making Status public
+curl "http://localhost:12333/Status";
+echo "";
+curl -H "X-Bbpd-Api-Key: reporting-key" -X POST -d '{"TableName":"reports_daily","Key":{"id":{"S":"1"}}}' "http://localhost:12333/GetItem";
+echo "";
+# denied: not in the policy, 403
+curl -H "X-Bbpd-Api-Key: reporting-key" -X POST -d '{"TableName":"users","Key":{"id":{"S":"1"}}}' "http://localhost:12333/GetItem";
+echo "";
+curl -H "X-Bbpd-Api-Key: reporting-key" -H "X-Amz-Target: DynamoDB_20120810.PutItem" -X POST -d '{"TableName":"reports_daily","Item":{"id":{"S":"1"}}}' "http://localhost:12333/";
+echo "";
+# denied: no key, 403
+curl -X POST -d '{"TableName":"reports_daily","Key":{"id":{"S":"1"}}}' "http://localhost:12333/GetItem";
+echo "";
@@ -0,0 +1 @@
+curl "http://localhost:12333/Capacity"
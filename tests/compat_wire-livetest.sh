@@ -0,0 +1,5 @@
+curl -i -H "Content-Type: application/x-amz-json-1.0" -H "X-Amz-Target: DynamoDB_20120810.DescribeTable" -X POST -d '{"TableName":"test-godynamo-livetest"}' "http://localhost:12333/";
+echo "";
+curl -i -H "Content-Type: application/x-amz-json-1.0" -H "X-Amz-Target: DynamoDB_20120810.DescribeTable" -X POST -d '{"TableName":"no-such-table"}' "http://localhost:12333/";
+echo "";
+aws dynamodb describe-table --table-name test-godynamo-livetest --endpoint-url http://localhost:12333
@@ -0,0 +1,15 @@
+# run with "DeleteTable": {"Tables": ["scratch_*"], "RequireDryRun": true} in bbpd-config.json
+# refused: no confirmation header, 412
+curl -X POST -d '{"TableName":"scratch_1"}' "http://localhost:12333/DeleteTable";
+echo "";
+# refused: no dry run yet, 412
+curl -H "X-Bbpd-Confirm-Delete: scratch_1" -X POST -d '{"TableName":"scratch_1"}' "http://localhost:12333/DeleteTable";
+echo "";
+# dry run: DescribeTable output
+curl -H "X-Bbpd-Dry-Run: True" -X POST -d '{"TableName":"scratch_1"}' "http://localhost:12333/DeleteTable";
+echo "";
+curl -H "X-Bbpd-Confirm-Delete: scratch_1" -X POST -d '{"TableName":"scratch_1"}' "http://localhost:12333/DeleteTable";
+echo "";
+# refused: not in the allowed patterns, 403
+curl -H "X-Amz-Target: DynamoDB_20120810.DeleteTable" -H "X-Bbpd-Confirm-Delete: users" -X POST -d '{"TableName":"users"}' "http://localhost:12333/";
+echo "";
@@ -0,0 +1,7 @@
+# requires a non-zero WindowMillis in the GetItemBatching section of bbpd-config.json
+# these GetItems arrive within the window; the first two share a projection and are sent together
+# as one BatchGetItem, without the range key that was only added to match Items to their keys
+curl -H "X-Amz-Target: DynamoDB_20120810.GetItem" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key"},"TheRangeKey":{"N":"1"}},"ProjectionExpression":"num"}' "http://localhost:12333/" &
+curl -H "X-Amz-Target: DynamoDB_20120810.GetItem" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key"},"TheRangeKey":{"N":"2"}},"ProjectionExpression":"num"}' "http://localhost:12333/" &
+curl -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key"},"TheRangeKey":{"N":"1"}}}' "http://localhost:12333/GetItem" &
+wait
@@ -0,0 +1,12 @@
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":1,"num":1,"stringlist":["a","b"]}}' "http://localhost:12333/PutItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":1}}' "http://localhost:12333/GetItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":1},"UpdateExpression":"SET num = num + :inc","ExpressionAttributeValues":{":inc":2},"ReturnValues":"ALL_NEW"}' "http://localhost:12333/UpdateItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","KeyConditionExpression":"TheHashKey = :h","ExpressionAttributeValues":{":h":"a-hash-key-json-keys"},"Limit":1,"ExclusiveStartKey":{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":0}}' "http://localhost:12333/QueryJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"RequestItems":{"test-godynamo-livetest":{"Keys":[{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":1}]}}}' "http://localhost:12333/BatchGetItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key-json-keys","TheRangeKey":1},"Expected":{"num":{"Value":3}},"ReturnValues":"ALL_OLD"}' "http://localhost:12333/DeleteItemJSON";
+echo "";
@@ -0,0 +1,6 @@
+# run as: bbpd -listen 127.0.0.1:12335 -socket /tmp/bbpd.sock -socket-mode 0600
+curl "http://127.0.0.1:12335/Status";
+echo "";
+ls -l /tmp/bbpd.sock;
+curl --unix-socket /tmp/bbpd.sock -H "X-Amz-Target: DynamoDB_20120810.ListTables" -X POST -d '{}' "http://localhost/";
+echo "";
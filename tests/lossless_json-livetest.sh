@@ -0,0 +1,9 @@
+# run with "TypeHints": {"Enabled": true, "LearnKeySchema": true, "Tables": {"test-godynamo-livetest": {"bin": "B"}}}
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":"a-hash-key-lossless","TheRangeKey":1,"big":123456789012345678901234567890.123456789,"bin":"AAECAwQ=","nothing":null}}' "http://localhost:12333/PutItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key-lossless","TheRangeKey":1}}' "http://localhost:12333/GetItemJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key-lossless"},"TheRangeKey":{"N":"1"}}}' "http://localhost:12333/GetItem";
+echo "";
+curl -H "X-Bbpd-Indent: true" "http://localhost:12333/Status";
+echo "";
@@ -0,0 +1 @@
+curl -H "X-Bbpd-Concurrency: 2" -X POST -d '{"TableName":"test-godynamo-livetest","TotalSegments":4}' http://localhost:12333/ParallelScan
@@ -0,0 +1,2 @@
+curl -X POST -d '{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":{"S":"a-hash-key"},"TheRangeKey":{"N":"1"},"num":{"N":"1"}}}' http://localhost:12333/PutItemAsync
+curl -H "X-Bbpd-Async: True" -X POST -d '{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":"a-hash-key","TheRangeKey":2,"num":2}}' http://localhost:12333/PutItemJSON
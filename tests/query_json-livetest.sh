@@ -0,0 +1 @@
+curl -X POST -d '{"KeyConditions":{"TheHashKey":{"AttributeValueList":[{"S":"AHashKey100"}],"ComparisonOperator":"EQ"}},"Limit":10000,"ReturnConsumedCapacity":"NONE","ScanIndexForward":true,"TableName":"test-godynamo-livetest","Select":"ALL_ATTRIBUTES"}' http://localhost:12333/QueryJSON
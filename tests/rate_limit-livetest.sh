@@ -0,0 +1,5 @@
+# requires a RateLimit entry for test-godynamo-livetest in bbpd-config.json
+for i in 1 2 3 4 5; do
+    curl -s -o /dev/null -w "%{http_code} %header{retry-after}\n" -H "X-Amz-Target: DynamoDB_20120810.GetItem" -X POST -d '{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key"},"TheRangeKey":{"N":"1"}}}' "http://localhost:12333/";
+done
+curl "http://localhost:12333/Status"
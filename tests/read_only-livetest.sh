@@ -0,0 +1,16 @@
+# run as: bbpd -read-only -admin 127.0.0.1:12399
+curl "http://127.0.0.1:12399/ReadOnly";
+echo "";
+# refused, 403
+curl -X POST -d '{"TableName":"mytable","Item":{"id":{"S":"1"}}}' "http://localhost:12333/PutItem";
+echo "";
+curl -H "X-Amz-Target: DynamoDB_20120810.PutItem" -X POST -d '{"TableName":"mytable","Item":{"id":{"S":"1"}}}' "http://localhost:12333/";
+echo "";
+curl -X POST -d '{"TableName":"mytable","Item":{"id":{"S":"1"}}}' "http://localhost:12333/RawPost/DynamoDB_20120810.PutItem";
+echo "";
+# allowed
+curl -X POST -d '{"TableName":"mytable","Key":{"id":{"S":"1"}}}' "http://localhost:12333/GetItem";
+echo "";
+# turn read-only mode off
+curl -X POST -d '{"ReadOnly":false}' "http://127.0.0.1:12399/ReadOnly";
+echo "";
@@ -0,0 +1 @@
+curl -X POST -d '{"ReturnConsumedCapacity":"NONE","TableName":"test-godynamo-livetest"}' http://localhost:12333/ScanJSON
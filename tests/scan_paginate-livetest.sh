@@ -0,0 +1 @@
+curl -H "X-Bbpd-Paginate: True" -H "X-Bbpd-Max-Pages: 5" -X POST -d '{"Limit":10,"ReturnConsumedCapacity":"TOTAL","TableName":"test-godynamo-livetest"}' http://localhost:12333/Scan
@@ -0,0 +1 @@
+curl --raw -H "X-Bbpd-Stream: True" -X POST -d '{"Limit":10,"TableName":"test-godynamo-livetest"}' http://localhost:12333/ScanJSON
@@ -0,0 +1,10 @@
+# run with a TLS section in bbpd-config.json naming ca-signed server and client certificates
+curl --cacert ca.pem --cert client.pem --key client.key "https://localhost:12333/Status";
+echo "";
+# no client certificate: the handshake is refused when ClientCAFile is set
+curl --cacert ca.pem "https://localhost:12333/Status";
+echo "";
+# after replacing the certificate files, reload them without closing the listeners
+kill -1 `pgrep -x bbpd`;
+curl --cacert ca.pem --cert client.pem --key client.key "https://localhost:12333/Status";
+echo "";
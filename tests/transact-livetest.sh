@@ -0,0 +1,9 @@
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TransactItems":[{"Put":{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":{"S":"a-hash-key-transact"},"TheRangeKey":{"N":"1"},"num":{"N":"1"}}}},{"Update":{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key-transact"},"TheRangeKey":{"N":"2"}},"UpdateExpression":"SET num = :n","ExpressionAttributeValues":{":n":{"N":"2"}}}}]}' "http://localhost:12333/TransactWriteItems";
+echo "";
+curl -H "X-Bbpd-Indent: true" -H "X-Amz-Target: DynamoDB_20120810.TransactGetItems" -X POST -d '{"TransactItems":[{"Get":{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":{"S":"a-hash-key-transact"},"TheRangeKey":{"N":"1"}}}}]}' "http://localhost:12333/";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"Statement":"SELECT * FROM \"test-godynamo-livetest\" WHERE TheHashKey = '"'"'a-hash-key-transact'"'"'"}' "http://localhost:12333/ExecuteStatement";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TableName":"test-godynamo-livetest"}' "http://localhost:12333/DescribeTimeToLive";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{}' "http://localhost:12333/DescribeLimits";
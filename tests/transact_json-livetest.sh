@@ -0,0 +1,3 @@
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TransactItems":[{"Put":{"TableName":"test-godynamo-livetest","Item":{"TheHashKey":"a-hash-key-transact-json","TheRangeKey":1,"num":1,"stringlist":["a","b"]}}},{"ConditionCheck":{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key","TheRangeKey":1},"ConditionExpression":"num = :n","ExpressionAttributeValues":{":n":1}}}]}' "http://localhost:12333/TransactWriteItemsJSON";
+echo "";
+curl -H "X-Bbpd-Indent: true" -X POST -d '{"TransactItems":[{"Get":{"TableName":"test-godynamo-livetest","Key":{"TheHashKey":"a-hash-key-transact-json","TheRangeKey":1}}}]}' "http://localhost:12333/TransactGetItemsJSON";